@@ -8,9 +8,13 @@ CREATE TABLE IF NOT EXISTS marketo.activities (
     campaignId INT,
     primaryAttributeValueId INT,
     primaryAttributeValue CITEXT,
-    attributes JSONB
+    attributes JSONB,
+    importId INT
 );
 
+-- Tables created before importId was added need it for -stamp-import-id
+ALTER TABLE marketo.activities ADD COLUMN IF NOT EXISTS importId INT;
+
 CREATE UNIQUE INDEX IF NOT EXISTS activities_marketoguid_idx
     ON marketo.activities (marketoGUID);
 CREATE INDEX IF NOT EXISTS activities_leadid_idx
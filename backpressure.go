@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// backpressure accumulates the time the reader spends waiting for the workers to take
+// records and the time the workers spend waiting for records to tell whether
+// the producer of the input or the load is the bottleneck.
+// Only the waits are timed, a channel operation that doesn't block costs nothing extra.
+type backpressure struct {
+	readBlocked    atomic.Int64
+	workersStarved atomic.Int64
+}
+
+// backpressureTotals are the waits of a load, the one of the workers summed over all of them.
+type backpressureTotals struct {
+	ReadBlocked    time.Duration
+	WorkersStarved time.Duration
+}
+
+// send hands the record over to the workers unless the pipeline is cancelled first.
+func (b *backpressure) send(done <-chan struct{}, records chan<- inputRecord, record inputRecord) bool {
+	select {
+	case records <- record:
+		return true
+	case <-done:
+		return false
+	default:
+	}
+
+	if b != nil {
+		start := time.Now()
+		defer func() { b.readBlocked.Add(int64(time.Since(start))) }()
+	}
+
+	select {
+	case records <- record:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// receive takes the next record off the channel, the second value is false once it is closed.
+func (b *backpressure) receive(records <-chan inputRecord) (inputRecord, bool) {
+	if b == nil {
+		record, ok := <-records
+		return record, ok
+	}
+
+	select {
+	case record, ok := <-records:
+		return record, ok
+	default:
+	}
+
+	start := time.Now()
+	record, ok := <-records
+	b.workersStarved.Add(int64(time.Since(start)))
+
+	return record, ok
+}
+
+func (b *backpressure) totals() *backpressureTotals {
+	if b == nil {
+		return nil
+	}
+
+	return &backpressureTotals{
+		ReadBlocked:    time.Duration(b.readBlocked.Load()),
+		WorkersStarved: time.Duration(b.workersStarved.Load()),
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// benchmarkEpoch is the point in time generated dates and timestamps count from.
+var benchmarkEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const benchmarkLetters = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// benchmark generates synthetic records in place of the input.
+// The same seed always produces the same records.
+type benchmark struct {
+	Rows     int
+	Seed     int64
+	DupeRate float64
+	// Generates the value of every loaded column out of the number of the record
+	generators []func(r *rand.Rand, n int) string
+	// Generates the conflict key out of its number, the same for the same number
+	key func(n int) string
+}
+
+// describe picks the value generators after the types of the columns in the table.
+// The columns the table doesn't have get text values.
+func (b *benchmark) describe(db *sql.DB, config config) error {
+	types, err := describeColumnTypes(db, config.Table)
+	if err != nil {
+		return err
+	}
+
+	b.generators = make([]func(*rand.Rand, int) string, len(config.Columns))
+	for i, column := range config.Columns {
+		b.generators[i] = benchmarkGenerator(types[strings.ToLower(column)])
+	}
+
+	switch types[conflictKey] {
+	case "smallint", "integer", "bigint", "numeric":
+		b.key = strconv.Itoa
+	case "uuid":
+		b.key = func(n int) string { return fmt.Sprintf("00000000-0000-4000-8000-%012x", n) }
+	default:
+		b.key = func(n int) string { return "benchmark-" + strconv.Itoa(n) }
+	}
+
+	return nil
+}
+
+// benchmarkGenerator returns the value generator for a column of the given data type.
+func benchmarkGenerator(typ string) func(r *rand.Rand, n int) string {
+	switch typ {
+	case "smallint":
+		return func(r *rand.Rand, n int) string { return strconv.Itoa(n % 32768) }
+	case "integer":
+		return func(r *rand.Rand, n int) string { return strconv.Itoa(n % 2147483648) }
+	case "bigint":
+		return func(r *rand.Rand, n int) string { return strconv.Itoa(n) }
+	case "numeric", "real", "double precision":
+		return func(r *rand.Rand, n int) string { return fmt.Sprintf("%d.%02d", n, r.IntN(100)) }
+	case "boolean":
+		return func(r *rand.Rand, n int) string { return strconv.FormatBool(r.IntN(2) == 1) }
+	case "date":
+		return func(r *rand.Rand, n int) string { return benchmarkEpoch.AddDate(0, 0, n%3650).Format("2006-01-02") }
+	case "timestamp without time zone", "timestamp with time zone":
+		return func(r *rand.Rand, n int) string {
+			return benchmarkEpoch.Add(time.Duration(n) * time.Second).Format(time.RFC3339)
+		}
+	case "uuid":
+		return func(r *rand.Rand, n int) string {
+			return fmt.Sprintf("%08x-0000-4000-8000-%012x", r.Uint32(), n)
+		}
+	case "json", "jsonb":
+		return func(r *rand.Rand, n int) string { return fmt.Sprintf(`{"n":%d,"r":%d}`, n, r.IntN(1000)) }
+	}
+
+	return func(r *rand.Rand, n int) string {
+		value := make([]byte, 8+r.IntN(25))
+		for i := range value {
+			value[i] = benchmarkLetters[r.IntN(len(benchmarkLetters))]
+		}
+		return strconv.Itoa(n) + "-" + string(value)
+	}
+}
+
+// generate sends the synthetic records to the records channel until they run out
+// or the pipeline is cancelled. A record reuses the key of one of the records
+// before it with the probability of the dupe rate.
+func (b *benchmark) generate(done <-chan struct{}, config config, records chan<- inputRecord) error {
+	r := rand.New(rand.NewPCG(uint64(b.Seed), uint64(b.Seed)))
+	keyIndex := columnIndex(config.Columns, conflictKey)
+	// The number of the key of every record so far when some are to be reused
+	var keys []int
+
+	for i := 0; i < b.Rows; i++ {
+		record := make([]string, len(b.generators))
+		for j, generate := range b.generators {
+			record[j] = generate(r, i)
+		}
+		if keyIndex >= 0 {
+			key := i
+			if i > 0 && r.Float64() < b.DupeRate {
+				key = keys[r.IntN(i)]
+			}
+			if b.DupeRate > 0 {
+				keys = append(keys, key)
+			}
+			record[keyIndex] = b.key(key)
+		}
+
+		// Numbered as if they were the lines of a file without a header
+		select {
+		case records <- inputRecord{line: i + 1, fields: record}:
+		case <-done:
+			return errCancelled
+		}
+	}
+
+	return nil
+}
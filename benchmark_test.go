@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// generated returns the records the benchmark generates for the columns of testConfig.
+func generated(t *testing.T, b *benchmark) [][]string {
+	t.Helper()
+
+	b.generators = []func(*rand.Rand, int) string{benchmarkGenerator("text"), benchmarkGenerator("bigint")}
+	b.key = func(n int) string { return "benchmark-" + strconv.Itoa(n) }
+
+	records := make(chan inputRecord, b.Rows)
+	if err := b.generate(make(chan struct{}), testConfig(), records); err != nil {
+		t.Fatal(err)
+	}
+	close(records)
+
+	var all [][]string
+	for record := range records {
+		if record.line != len(all)+1 {
+			t.Fatalf("got record numbered %d, want %d", record.line, len(all)+1)
+		}
+		all = append(all, record.fields)
+	}
+
+	return all
+}
+
+func TestBenchmarkSeed(t *testing.T) {
+	first := generated(t, &benchmark{Rows: 100, Seed: 42, DupeRate: 0.2})
+	if len(first) != 100 {
+		t.Fatalf("got %d records, want 100", len(first))
+	}
+	if again := generated(t, &benchmark{Rows: 100, Seed: 42, DupeRate: 0.2}); !reflect.DeepEqual(again, first) {
+		t.Error("got other records for the same seed")
+	}
+	if other := generated(t, &benchmark{Rows: 100, Seed: 43, DupeRate: 0.2}); reflect.DeepEqual(other, first) {
+		t.Error("got the same records for another seed")
+	}
+}
+
+func TestBenchmarkDupeRate(t *testing.T) {
+	tests := []struct {
+		rate     float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{0.1, 850, 1150},
+		{0.5, 4700, 5300},
+		{1, 9999, 9999},
+	}
+
+	for _, tt := range tests {
+		records := generated(t, &benchmark{Rows: 10000, Seed: 1, DupeRate: tt.rate})
+
+		seen := make(map[string]bool)
+		dupes := 0
+		for _, record := range records {
+			if seen[record[0]] {
+				dupes++
+			}
+			seen[record[0]] = true
+		}
+		if dupes < tt.min || dupes > tt.max {
+			t.Errorf("got %d duplicate keys out of %d at the rate %v, want %d to %d", dupes, len(records), tt.rate, tt.min, tt.max)
+		}
+	}
+}
+
+func TestBenchmarkCancel(t *testing.T) {
+	b := &benchmark{
+		Rows:       10,
+		generators: []func(*rand.Rand, int) string{benchmarkGenerator("text"), benchmarkGenerator("bigint")},
+		key:        strconv.Itoa,
+	}
+	done := make(chan struct{})
+	close(done)
+
+	// Nobody receives
+	if err := b.generate(done, testConfig(), make(chan inputRecord)); err != errCancelled {
+		t.Errorf("got %v, want %v", err, errCancelled)
+	}
+}
+
+func TestBenchmarkGenerator(t *testing.T) {
+	valid := func(pattern string) func(string) bool {
+		return regexp.MustCompile(pattern).MatchString
+	}
+	parses := func(layout string) func(string) bool {
+		return func(value string) bool {
+			_, err := time.Parse(layout, value)
+			return err == nil
+		}
+	}
+
+	tests := []struct {
+		typ   string
+		valid func(string) bool
+	}{
+		{"smallint", valid(`^[0-9]+$`)},
+		{"integer", valid(`^[0-9]+$`)},
+		{"bigint", valid(`^[0-9]+$`)},
+		{"numeric", valid(`^[0-9]+\.[0-9]{2}$`)},
+		{"double precision", valid(`^[0-9]+\.[0-9]{2}$`)},
+		{"boolean", valid(`^(true|false)$`)},
+		{"date", parses("2006-01-02")},
+		{"timestamp with time zone", parses(time.RFC3339)},
+		{"uuid", valid(`^[0-9a-f]{8}-0000-4000-8000-[0-9a-f]{12}$`)},
+		{"jsonb", func(value string) bool { return json.Valid([]byte(value)) }},
+		{"text", valid(`^[0-9]+-[a-z0-9]{8,32}$`)},
+		{"", valid(`^[0-9]+-[a-z0-9]{8,32}$`)},
+	}
+
+	r := rand.New(rand.NewPCG(1, 1))
+	for _, tt := range tests {
+		generate := benchmarkGenerator(tt.typ)
+		for _, n := range []int{0, 1, 32767, 40000, 1 << 40} {
+			if value := generate(r, n); !tt.valid(value) {
+				t.Errorf("got %q for %s record %d", value, tt.typ, n)
+			}
+		}
+	}
+
+	// Values stay within the range of the type
+	if value := benchmarkGenerator("smallint")(r, 40000); value != "7232" {
+		t.Errorf("got smallint %s, want 7232", value)
+	}
+}
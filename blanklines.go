@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"strings"
+	"sync"
+)
+
+// blankLines skips the records that are blank lines, with a single empty field or none,
+// and counts them along with the empty lines the CSV reader drops on its own so that
+// the skipped lines reconcile with the lines of the input.
+type blankLines struct {
+	r io.Reader
+
+	mu sync.Mutex
+	// Line the last record read ends on, 0 if it isn't known
+	end     int
+	skipped int
+	// Newlines since the last byte of the input that is not a line break
+	trailing int
+}
+
+// reader counts the empty lines the input ends with as the CSV reader reads it.
+// Every reader starts the count over.
+func (b *blankLines) reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.r = r
+	b.end, b.skipped, b.trailing = 0, 0, 0
+
+	return b
+}
+
+func (b *blankLines) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rest := bytes.TrimRight(p[:n], "\r\n")
+	if len(rest) > 0 {
+		b.trailing = 0
+	}
+	b.trailing += bytes.Count(p[len(rest):n], []byte("\n"))
+
+	return n, err
+}
+
+// skip reports whether the record just read is a blank line. The empty lines before it
+// that the CSV reader skipped are counted as well. A single empty field is a value,
+// not a blank line, when the records have a single field.
+func (b *blankLines) skip(reader *csv.Reader, record []string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(record) == 0 {
+		b.skipped++
+		return true
+	}
+
+	start, _ := reader.FieldPos(0)
+	if b.end > 0 {
+		b.skipped += max(start-b.end-1, 0)
+	}
+	b.end, _ = reader.FieldPos(len(record) - 1)
+	b.end += strings.Count(record[len(record)-1], "\n")
+
+	if len(record) == 1 && record[0] == "" && reader.FieldsPerRecord != 1 {
+		b.skipped++
+		return true
+	}
+
+	return false
+}
+
+// lost forgets where the last record ended after one that failed to parse
+// so that the lines it spans aren't taken for empty lines.
+func (b *blankLines) lost() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.end = 0
+}
+
+// lines returns the number of blank lines skipped, the empty lines after the last
+// record included. The line break that ends the last record is not an empty line.
+func (b *blankLines) lines() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.skipped + max(b.trailing-1, 0)
+}
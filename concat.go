@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// concatReader reads the files one after another as one input. Every file is
+// decompressed on its own and closed as soon as it has been read through.
+type concatReader struct {
+	paths []string
+	size  int
+	// Wraps a file with a decompressing reader if it is gzipped
+	uncompress func(*bufio.Reader) (io.Reader, error)
+	// Wraps a file before it is buffered, e.g. to count the bytes read
+	wrap func(io.Reader) io.Reader
+
+	// The file being read and its decompressed content
+	path string
+	file *os.File
+	r    io.Reader
+	// Whether the content so far ends with a newline or is empty
+	newline bool
+}
+
+func newConcatReader(paths []string, size int, uncompress func(*bufio.Reader) (io.Reader, error), wrap func(io.Reader) io.Reader) *concatReader {
+	return &concatReader{paths: paths, size: size, uncompress: uncompress, wrap: wrap, newline: true}
+}
+
+func (c *concatReader) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			if len(c.paths) == 0 {
+				return 0, io.EOF
+			}
+			// Keep the last line of a file without a newline off the first line of the next one
+			if !c.newline {
+				c.newline = true
+				return copy(b, "\n"), nil
+			}
+			if err := c.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := c.r.Read(b)
+		if n > 0 {
+			c.newline = b[n-1] == '\n'
+		}
+		if err == io.EOF {
+			if err := c.Close(); err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("Can't read input file '%s': %w", c.path, err)
+		}
+
+		return n, nil
+	}
+}
+
+// next opens the following file.
+func (c *concatReader) next() error {
+	c.path, c.paths = c.paths[0], c.paths[1:]
+
+	file, err := os.Open(c.path)
+	if err != nil {
+		return fmt.Errorf("Can't open input file '%s': %w", c.path, err)
+	}
+
+	r, err := c.uncompress(bufio.NewReaderSize(c.wrap(file), c.size))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Can't read input file '%s': %w", c.path, err)
+	}
+	c.file, c.r = file, r
+
+	return nil
+}
+
+// Close closes the file being read along with its decompressing reader.
+func (c *concatReader) Close() error {
+	if c.file == nil {
+		return nil
+	}
+
+	var err error
+	if closer, ok := c.r.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = fmt.Errorf("Can't close input file '%s': %w", c.path, err)
+	}
+	c.file, c.r = nil, nil
+
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes the contents to files of a temporary directory and returns their paths.
+func writeFiles(t *testing.T, contents ...[]byte) []string {
+	t.Helper()
+
+	dir := t.TempDir()
+	paths := make([]string, len(contents))
+	for i, content := range contents {
+		paths[i] = filepath.Join(dir, "part"+string(rune('a'+i)))
+		if err := os.WriteFile(paths[i], content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return paths
+}
+
+func concatenate(paths []string) *concatReader {
+	return newConcatReader(paths, defaultReadBuffer, decompress, func(r io.Reader) io.Reader { return r })
+}
+
+func TestConcatReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents [][]byte
+		want     string
+	}{
+		{"newlines", [][]byte{[]byte("g1,1\n"), []byte("g2,2\n")}, "g1,1\ng2,2\n"},
+		// The last line of a file doesn't run into the first line of the next one
+		{"no trailing newline", [][]byte{[]byte("g1,1"), []byte("g2,2"), []byte("g3,3\n")}, "g1,1\ng2,2\ng3,3\n"},
+		// The end of the input is left as it is
+		{"no trailing newline at the end", [][]byte{[]byte("g1,1\n"), []byte("g2,2")}, "g1,1\ng2,2"},
+		{"empty", [][]byte{[]byte("g1,1"), nil, []byte("g2,2\n")}, "g1,1\ng2,2\n"},
+		{"gzip and plain", [][]byte{gzipped(t, "g1,1"), []byte("g2,2\n"), gzipped(t, "g3,3\n")}, "g1,1\ng2,2\ng3,3\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := concatenate(writeFiles(t, tt.contents...))
+			defer c.Close()
+
+			got, err := io.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcatReaderSmallReads(t *testing.T) {
+	c := concatenate(writeFiles(t, gzipped(t, "g1,1\ng2,2"), []byte("g3,3")))
+	defer c.Close()
+
+	// Read a byte at a time as bufio does with a tiny buffer
+	var got strings.Builder
+	b := make([]byte, 1)
+	for {
+		n, err := c.Read(b)
+		got.Write(b[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := "g1,1\ng2,2\ng3,3"; got.String() != want {
+		t.Errorf("got %q, want %q", got.String(), want)
+	}
+}
+
+func TestConcatReaderErrors(t *testing.T) {
+	corrupt := gzipped(t, strings.Repeat("g1,1\n", 100))
+	corrupt = corrupt[:len(corrupt)/2]
+
+	tests := []struct {
+		name   string
+		paths  func(t *testing.T) []string
+		failed int
+		want   string
+	}{
+		{
+			"missing",
+			func(t *testing.T) []string {
+				paths := writeFiles(t, []byte("g1,1\n"))
+				return append(paths, filepath.Join(filepath.Dir(paths[0]), "missing"))
+			},
+			1,
+			"Can't open input file",
+		},
+		{
+			"truncated gzip",
+			func(t *testing.T) []string { return writeFiles(t, []byte("g1,1\n"), corrupt) },
+			1,
+			"Can't read input file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := tt.paths(t)
+			c := concatenate(paths)
+			defer c.Close()
+
+			_, err := io.ReadAll(bufio.NewReader(c))
+			want := tt.want + " '" + paths[tt.failed] + "'"
+			if err == nil || !strings.HasPrefix(err.Error(), want) {
+				t.Errorf("got %v, want %s", err, want)
+			}
+		})
+	}
+}
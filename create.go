@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How -create-table-types picks the column types of a new table
+const (
+	createTypesInfer = "infer"
+	createTypesText  = "text"
+)
+
+// timestampLayouts are the timestamp formats a column type can be inferred from.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// timestamptzLayouts are the timestamp formats with a time zone a column type can be inferred from.
+var timestamptzLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02 15:04:05Z0700",
+	"2006-01-02T15:04:05Z07",
+	"2006-01-02 15:04:05Z07",
+}
+
+// sampleAndCreate creates the table from the first records unless it exists.
+// The records are then passed on as if they had never been looked at.
+func sampleAndCreate(done <-chan struct{}, db *sql.DB, config config, records <-chan inputRecord) (<-chan inputRecord, error) {
+	var sample []inputRecord
+	for record := range records {
+		sample = append(sample, record)
+		if len(sample) >= config.CreateTableSample {
+			break
+		}
+	}
+
+	fields := make([][]string, len(sample))
+	for i, record := range sample {
+		fields[i] = record.fields
+	}
+	err := createTable(db, config, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	replayed := make(chan inputRecord, config.Workers)
+	go func() {
+		defer close(replayed)
+
+		for _, record := range sample {
+			select {
+			case replayed <- record:
+			case <-done:
+				return
+			}
+		}
+		for record := range records {
+			select {
+			case replayed <- record:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return replayed, nil
+}
+
+// createTable creates the table with the loaded columns unless it exists.
+// The column types are inferred from the sample, the conflict key is made unique.
+func createTable(db *sql.DB, config config, sample [][]string) error {
+	var definitions []string
+	if config.StampImportId {
+		definitions = append(definitions, importIdColumn+" bigint")
+	}
+	for i, column := range config.Columns {
+		typ := createTypesText
+		if config.CreateTableTypes == createTypesInfer {
+			typ = inferType(sample, i)
+		}
+		definition := column + " " + typ
+		if strings.EqualFold(column, conflictKey) {
+			definition += " UNIQUE"
+		}
+		definitions = append(definitions, definition)
+	}
+	// The type of an expression is anybody's guess
+	for _, column := range config.Exprs.columns() {
+		definitions = append(definitions, column+" text")
+	}
+
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", config.Table, strings.Join(definitions, ", ")))
+	if err != nil {
+		return fmt.Errorf("Can't create table '%s': %w", config.Table, err)
+	}
+
+	return nil
+}
+
+// inferType picks the narrowest type all the sampled values of the field parse as.
+func inferType(sample [][]string, field int) string {
+	candidates := []struct {
+		typ   string
+		parse func(string) bool
+	}{
+		{"bigint", func(value string) bool {
+			_, err := strconv.ParseInt(value, 10, 64)
+			return err == nil
+		}},
+		{"numeric", func(value string) bool {
+			_, err := strconv.ParseFloat(value, 64)
+			return err == nil
+		}},
+		{"boolean", func(value string) bool {
+			switch strings.ToLower(value) {
+			case "t", "f", "true", "false", "y", "n", "yes", "no":
+				return true
+			}
+			return false
+		}},
+		{"date", func(value string) bool {
+			_, err := time.Parse("2006-01-02", value)
+			return err == nil
+		}},
+		{"timestamp", func(value string) bool { return parsesAs(value, timestampLayouts) }},
+		{"timestamptz", func(value string) bool { return parsesAs(value, timestamptzLayouts) }},
+	}
+
+	var values []string
+	for _, record := range sample {
+		if field < len(record) && record[field] != nullValue {
+			values = append(values, record[field])
+		}
+	}
+	if len(values) == 0 {
+		return createTypesText
+	}
+
+	for _, candidate := range candidates {
+		all := true
+		for _, value := range values {
+			if !candidate.parse(value) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return candidate.typ
+		}
+	}
+
+	return createTypesText
+}
+
+func parsesAs(value string, layouts []string) bool {
+	for _, layout := range layouts {
+		if _, err := time.Parse(layout, value); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
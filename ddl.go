@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	createTablePattern = regexp.MustCompile(`(?i)\bCREATE\s+(?:(?:GLOBAL|LOCAL)\s+)?(?:(?:TEMP|TEMPORARY|UNLOGGED)\s+)?TABLE\b`)
+	// Both generated and identity columns are GENERATED ALWAYS or BY DEFAULT
+	generatedPattern = regexp.MustCompile(`(?i)\bGENERATED\s+(ALWAYS|BY\s+DEFAULT)\b`)
+	// EXCLUDE is not a reserved word, it starts a constraint only when followed by its index method or elements
+	excludePattern = regexp.MustCompile(`(?i)^\s*(USING\b|\()`)
+	typeModifiers  = regexp.MustCompile(`\s*\([^)]*\)`)
+)
+
+// tableConstraints start the elements of a column list that aren't columns.
+// All of them but EXCLUDE are reserved words that can't name a column unless quoted.
+var tableConstraints = map[string]bool{
+	"CONSTRAINT": true,
+	"PRIMARY":    true,
+	"UNIQUE":     true,
+	"CHECK":      true,
+	"FOREIGN":    true,
+	"EXCLUDE":    true,
+	"LIKE":       true,
+}
+
+// columnConstraints end the data type of a column definition.
+var columnConstraints = map[string]bool{
+	"COLLATE":     true,
+	"COMPRESSION": true,
+	"CONSTRAINT":  true,
+	"NOT":         true,
+	"NULL":        true,
+	"DEFAULT":     true,
+	"GENERATED":   true,
+	"PRIMARY":     true,
+	"UNIQUE":      true,
+	"CHECK":       true,
+	"REFERENCES":  true,
+	"DEFERRABLE":  true,
+	"INITIALLY":   true,
+}
+
+// ddlTypes maps the data types of a CREATE TABLE statement to the -types they are converted as.
+var ddlTypes = map[string]string{
+	"bytea":       "bytea",
+	"smallint":    "smallint",
+	"int2":        "smallint",
+	"smallserial": "smallint",
+	"serial2":     "smallint",
+	"integer":     "integer",
+	"int":         "integer",
+	"int4":        "integer",
+	"serial":      "integer",
+	"serial4":     "integer",
+	"bigint":      "bigint",
+	"int8":        "bigint",
+	"bigserial":   "bigint",
+	"serial8":     "bigint",
+}
+
+// ddlColumn is a column as it is defined in a CREATE TABLE statement.
+type ddlColumn struct {
+	// The identifier as it is written, quotes included
+	Name string
+	// The data type in lower case without the modifiers e.g. character varying
+	Type      string
+	Generated bool
+}
+
+// readDDL reads the columns of the first CREATE TABLE statement in the file.
+func readDDL(path string) ([]ddlColumn, error) {
+	ddl, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open DDL file '%s'", path)
+	}
+
+	columns, err := parseDDL(string(ddl))
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse DDL file '%s': %v", path, err)
+	}
+
+	return columns, nil
+}
+
+// parseDDL parses the column list between the outer parentheses of a CREATE TABLE statement.
+// It is not a SQL parser: it only knows enough to split the list into column definitions
+// and table constraints, and to tell the name and the type of a column apart.
+func parseDDL(ddl string) ([]ddlColumn, error) {
+	ddl = stripComments(ddl)
+
+	match := createTablePattern.FindStringIndex(ddl)
+	if match == nil {
+		return nil, fmt.Errorf("no CREATE TABLE statement")
+	}
+
+	elements, err := columnList(ddl[match[1]:])
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []ddlColumn
+	for _, element := range elements {
+		name, rest := ddlIdentifier(element)
+		if name == "" || tableConstraints[strings.ToUpper(name)] && (!strings.EqualFold(name, "EXCLUDE") || excludePattern.MatchString(rest)) {
+			continue
+		}
+
+		var typ []string
+		for _, word := range strings.Fields(rest) {
+			if columnConstraints[strings.ToUpper(word)] {
+				break
+			}
+			typ = append(typ, word)
+		}
+
+		// GENERATED in a default or a check, quoted or in parentheses, doesn't make a column generated
+		generated := generatedPattern.MatchString(blankNested(rest))
+		columns = append(columns, ddlColumn{Name: name, Type: baseType(strings.Join(typ, " ")), Generated: generated})
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns in the CREATE TABLE statement")
+	}
+
+	return columns, nil
+}
+
+// columnList splits the parenthesized list following the table name into its elements
+// at the commas that are neither nested in parentheses nor quoted.
+func columnList(ddl string) ([]string, error) {
+	var (
+		elements []string
+		element  strings.Builder
+		depth    int
+		quote    rune
+	)
+	for _, r := range ddl {
+		switch {
+		case quote != 0:
+			// A doubled quote reads as the end of the quoted text and a new one right after
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case r == ')':
+			depth--
+			if depth == 0 {
+				return append(elements, strings.TrimSpace(element.String())), nil
+			}
+		case r == ',' && depth == 1:
+			elements = append(elements, strings.TrimSpace(element.String()))
+			element.Reset()
+			continue
+		case r == ';' && depth == 0:
+			return nil, fmt.Errorf("no column list in the CREATE TABLE statement")
+		}
+		if depth > 0 {
+			element.WriteRune(r)
+		}
+	}
+
+	return nil, fmt.Errorf("unterminated column list in the CREATE TABLE statement")
+}
+
+// blankNested blanks out quoted text and what is in parentheses leaving the words of the definition itself.
+func blankNested(definition string) string {
+	blanked := []byte(definition)
+	var (
+		depth int
+		quote byte
+	)
+	for i, c := range blanked {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		default:
+			if depth == 0 {
+				continue
+			}
+		}
+		blanked[i] = ' '
+	}
+
+	return string(blanked)
+}
+
+// ddlIdentifier splits the leading identifier, quoted or not, off the definition.
+func ddlIdentifier(definition string) (string, string) {
+	if strings.HasPrefix(definition, `"`) {
+		for i := 1; i < len(definition); i++ {
+			if definition[i] != '"' {
+				continue
+			}
+			if i+1 < len(definition) && definition[i+1] == '"' {
+				i++
+				continue
+			}
+			return definition[:i+1], definition[i+1:]
+		}
+		return "", ""
+	}
+
+	end := strings.IndexFunc(definition, func(r rune) bool { return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '(' })
+	if end < 0 {
+		return definition, ""
+	}
+
+	return definition[:end], definition[end:]
+}
+
+// baseType drops the modifiers from a data type, arrays stay arrays e.g. integer[].
+func baseType(typ string) string {
+	typ = typeModifiers.ReplaceAllString(typ, "")
+
+	return strings.ToLower(strings.Join(strings.Fields(typ), " "))
+}
+
+// stripComments blanks out -- and /* */ comments outside of quoted text.
+func stripComments(ddl string) string {
+	var (
+		stripped strings.Builder
+		quote    byte
+	)
+	for i := 0; i < len(ddl); i++ {
+		c := ddl[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '-' && strings.HasPrefix(ddl[i:], "--"):
+			end := strings.IndexByte(ddl[i:], '\n')
+			if end < 0 {
+				return stripped.String()
+			}
+			i += end
+			c = '\n'
+		case c == '/' && strings.HasPrefix(ddl[i:], "/*"):
+			end := strings.Index(ddl[i+2:], "*/")
+			if end < 0 {
+				return stripped.String()
+			}
+			i += end + 3
+			c = ' '
+		}
+		stripped.WriteByte(c)
+	}
+
+	return stripped.String()
+}
+
+// ddlColumnNames returns the columns of the DDL to load leaving out generated and identity
+// columns and the ones pload fills in itself, the same ones -cols-from-table leaves out.
+func ddlColumnNames(columns []ddlColumn, config config) ([]string, error) {
+	exclude := config.Exprs.columns()
+	if config.StampImportId {
+		exclude = append(exclude, importIdColumn)
+	}
+
+	var names []string
+	for _, column := range columns {
+		if column.Generated || columnIndex(exclude, unquoteIdentifier(column.Name)) >= 0 {
+			continue
+		}
+		names = append(names, column.Name)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No columns left to load in the DDL")
+	}
+
+	return names, nil
+}
+
+// ddlColumnTypes returns -types for the loaded columns the DDL defines as one of
+// the types -types converts, except for the ones -types is given for explicitly.
+func ddlColumnTypes(columns []ddlColumn, config config) columnValues {
+	var types columnValues
+	for _, column := range columns {
+		typ, ok := ddlTypes[column.Type]
+		if !ok || columnIndex(config.Columns, column.Name) < 0 || columnIndex(config.Types.columns(), column.Name) >= 0 {
+			continue
+		}
+		types = append(types, columnValue{Column: column.Name, Value: typ})
+	}
+
+	return types
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDDL(t *testing.T) {
+	tests := []struct {
+		name    string
+		ddl     string
+		want    []ddlColumn
+		wantErr bool
+	}{
+		{
+			name: "if not exists",
+			ddl:  "CREATE TABLE IF NOT EXISTS marketo.activities (marketoGUID text NOT NULL, leadId bigint);",
+			want: []ddlColumn{{"marketoGUID", "text", false}, {"leadId", "bigint", false}},
+		},
+		{
+			name: "unlogged",
+			ddl:  "create unlogged table t (a int4)",
+			want: []ddlColumn{{"a", "int4", false}},
+		},
+		{
+			name: "quoted identifiers",
+			ddl:  `CREATE TABLE "Lead ""Data""" ("Lead ""Id""" integer, "a,b" text, "(" text)`,
+			want: []ddlColumn{{`"Lead ""Id"""`, "integer", false}, {`"a,b"`, "text", false}, {`"("`, "text", false}},
+		},
+		{
+			name: "constraint lines",
+			ddl: `CREATE TABLE t (
+				a int,
+				CONSTRAINT t_pkey PRIMARY KEY (a),
+				PRIMARY KEY (a),
+				UNIQUE (a, b),
+				CHECK (a > 0),
+				FOREIGN KEY (b) REFERENCES other (id),
+				EXCLUDE USING gist (r WITH &&),
+				EXCLUDE (a WITH =),
+				LIKE other INCLUDING ALL,
+				b text
+			)`,
+			want: []ddlColumn{{"a", "int", false}, {"b", "text", false}},
+		},
+		{
+			name: "columns named like constraints",
+			ddl:  `CREATE TABLE t (exclude boolean, "primary" text, "check" int)`,
+			want: []ddlColumn{{"exclude", "boolean", false}, {`"primary"`, "text", false}, {`"check"`, "int", false}},
+		},
+		{
+			name: "nested parentheses",
+			ddl: `CREATE TABLE t (
+				amount numeric(10, 2) DEFAULT (round(1.5, 0) + 1),
+				kind varchar(20) CHECK (kind IN ('a', 'b')),
+				tags text[],
+				at timestamp(3) with time zone
+			)`,
+			want: []ddlColumn{{"amount", "numeric", false}, {"kind", "varchar", false}, {"tags", "text[]", false}, {"at", "timestamp with time zone", false}},
+		},
+		{
+			name: "comments",
+			ddl: `-- CREATE TABLE commented (x int)
+				/* a block, with (parentheses */
+				CREATE TABLE t (
+					a int, -- the first, with a comma
+					/* b int, */
+					c text DEFAULT '-- not a comment', d text DEFAULT '/* nor this */'
+				)`,
+			want: []ddlColumn{{"a", "int", false}, {"c", "text", false}, {"d", "text", false}},
+		},
+		{
+			name: "generated and identity columns",
+			ddl: `CREATE TABLE t (
+				id bigint GENERATED ALWAYS AS IDENTITY,
+				n int generated by default as identity,
+				total numeric GENERATED ALWAYS AS (a * b) STORED,
+				note text DEFAULT 'GENERATED ALWAYS',
+				flag text CHECK (flag <> 'generated'),
+				kind text CHECK (kind <> generated),
+				generated text
+			)`,
+			want: []ddlColumn{
+				{"id", "bigint", true},
+				{"n", "int", true},
+				{"total", "numeric", true},
+				{"note", "text", false},
+				{"flag", "text", false},
+				{"kind", "text", false},
+				{"generated", "text", false},
+			},
+		},
+		{name: "no statement", ddl: "CREATE INDEX i ON t (a)", wantErr: true},
+		{name: "no column list", ddl: "CREATE TABLE t AS SELECT 1; (a int)", wantErr: true},
+		{name: "unterminated", ddl: "CREATE TABLE t (a int", wantErr: true},
+		{name: "no columns", ddl: "CREATE TABLE t (PRIMARY KEY (a))", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDDL(tt.ddl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	tests := []struct {
+		ddl  string
+		want string
+	}{
+		{"a -- comment\nb", "a \nb"},
+		{"a /* comment */b", "a  b"},
+		{"a /* multi\nline */ b", "a   b"},
+		{"a -- to the end", "a "},
+		{"a /* unterminated", "a "},
+		{`'--' "/*" b`, `'--' "/*" b`},
+		{`'it''s' -- x`, `'it''s' `},
+		{`"a""b" /* x */`, `"a""b"  `},
+	}
+
+	for _, tt := range tests {
+		if got := stripComments(tt.ddl); got != tt.want {
+			t.Errorf("stripComments(%q) = %q, want %q", tt.ddl, got, tt.want)
+		}
+	}
+}
+
+func TestDDLColumnNames(t *testing.T) {
+	columns := []ddlColumn{{"id", "bigint", true}, {"importId", "int", false}, {"loadedat", "timestamp", false}, {"a", "text", false}}
+
+	config := testConfig()
+	config.StampImportId = true
+	config.Exprs = columnValues{{"loadedat", "now()"}}
+	names, err := ddlColumnNames(columns, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"a"}) {
+		t.Errorf("got %q, want a", names)
+	}
+
+	if _, err := ddlColumnNames(columns[:1], config); err == nil {
+		t.Error("got no error with nothing left to load")
+	}
+}
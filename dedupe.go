@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Which of the records sharing a conflict key -dedupe keeps
+const (
+	dedupeFirst = "first"
+	dedupeLast  = "last"
+)
+
+// deduper drops the records whose conflict key has been seen in the input
+// before, or after in the last mode, so that workers never race over a key.
+type deduper struct {
+	last     bool
+	keyIndex int
+	// Applied to the key so that keys differing only in their Unicode normalization match
+	normalize func(string) string
+	// Keys seen so far and, in the last mode, the position of the held record
+	seen map[string]int
+	held []inputRecord
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func newDeduper(mode string, columns []string) (*deduper, error) {
+	if mode != dedupeFirst && mode != dedupeLast {
+		return nil, fmt.Errorf("Invalid dedupe mode '%s', expected %s or %s", mode, dedupeFirst, dedupeLast)
+	}
+
+	keyIndex := columnIndex(columns, conflictKey)
+	if keyIndex < 0 {
+		return nil, fmt.Errorf("Can't dedupe: column '%s' is not loaded", conflictKey)
+	}
+
+	return &deduper{last: mode == dedupeLast, keyIndex: keyIndex, seen: make(map[string]int)}, nil
+}
+
+// keep reports whether the record is to be loaded right away.
+// In the last mode records are held until the input is over.
+func (d *deduper) keep(record inputRecord) bool {
+	key := record.fields[d.keyIndex]
+	// NULLs never conflict
+	if key == nullValue {
+		if d.last {
+			d.held = append(d.held, record)
+			return false
+		}
+		return true
+	}
+
+	if d.normalize != nil {
+		key = d.normalize(key)
+	}
+
+	i, seen := d.seen[key]
+	if seen {
+		d.drop()
+	}
+
+	if !d.last {
+		if !seen {
+			d.seen[key] = 0
+		}
+		return !seen
+	}
+
+	// Keep the last occurrence at its own position in the input
+	if seen {
+		d.held[i] = inputRecord{}
+	}
+	d.seen[key] = len(d.held)
+	d.held = append(d.held, record)
+
+	return false
+}
+
+// release returns the held records in their input order.
+func (d *deduper) release() []inputRecord {
+	records := make([]inputRecord, 0, len(d.held))
+	for _, record := range d.held {
+		if record.fields != nil {
+			records = append(records, record)
+		}
+	}
+	d.held = nil
+
+	return records
+}
+
+func (d *deduper) drop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dropped++
+}
+
+// duplicates returns the number of records dropped so far.
+func (d *deduper) duplicates() int {
+	if d == nil {
+		return 0
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.dropped
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewDeduper(t *testing.T) {
+	if _, err := newDeduper("middle", []string{"marketoguid"}); err == nil {
+		t.Error("got no error for an invalid mode")
+	}
+	if _, err := newDeduper(dedupeFirst, []string{"leadid"}); err == nil {
+		t.Error("got no error without the conflict key")
+	}
+	// The conflict key is found whatever its case
+	if _, err := newDeduper(dedupeLast, []string{"leadid", "marketoGUID"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeduper(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		normalize func(string) string
+		keys      []string
+		// Lines of the records that are loaded, in the order they are loaded
+		want      []int
+		wantDupes int
+	}{
+		{"first", dedupeFirst, nil, []string{"a", "b", "a", "c", "b"}, []int{1, 2, 4}, 2},
+		// The last occurrence at its own position in the input
+		{"last", dedupeLast, nil, []string{"a", "b", "a", "c", "b"}, []int{3, 4, 5}, 2},
+		{"last, three times", dedupeLast, nil, []string{"a", "a", "b", "a"}, []int{3, 4}, 2},
+		{"no duplicates", dedupeLast, nil, []string{"a", "b", "c"}, []int{1, 2, 3}, 0},
+		{"nulls first", dedupeFirst, nil, []string{nullValue, "a", nullValue}, []int{1, 2, 3}, 0},
+		{"nulls last", dedupeLast, nil, []string{nullValue, "a", nullValue, "a"}, []int{1, 3, 4}, 1},
+		{"case", dedupeFirst, nil, []string{"a", "A"}, []int{1, 2}, 0},
+		{"normalized", dedupeLast, strings.ToLower, []string{"a", "A"}, []int{2}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newDeduper(tt.mode, []string{"leadid", "marketoguid"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.normalize = tt.normalize
+
+			var loaded []int
+			for i, key := range tt.keys {
+				record := inputRecord{line: i + 1, fields: []string{"1", key}}
+				if d.keep(record) {
+					loaded = append(loaded, record.line)
+				}
+			}
+			for _, record := range d.release() {
+				loaded = append(loaded, record.line)
+			}
+
+			if !reflect.DeepEqual(loaded, tt.want) {
+				t.Errorf("got lines %v loaded, want %v", loaded, tt.want)
+			}
+			if got := d.duplicates(); got != tt.wantDupes {
+				t.Errorf("got %d duplicates, want %d", got, tt.wantDupes)
+			}
+			if held := d.release(); len(held) > 0 {
+				t.Errorf("got %d records released twice", len(held))
+			}
+		})
+	}
+
+	// Without -dedupe nothing is dropped
+	var d *deduper
+	if got := d.duplicates(); got != 0 {
+		t.Errorf("got %d duplicates without a deduper, want 0", got)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+// keepaliveSettings are libpq connection parameters neither lib/pq nor pgx understand.
+// pload applies them to the TCP connections itself and strips them from the DSN
+// since both drivers pass unknown parameters on to the server.
+var keepaliveSettings = []string{"keepalives", "keepalives_idle", "keepalives_interval", "keepalives_count"}
+
+// connector connects to the database through a dialer with TCP keepalives configured.
+type connector struct {
+	dsn    string
+	dialer dialer
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return pq.DialOpen(c.dialer, c.dsn)
+}
+
+func (c connector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+type dialer struct {
+	keepalive net.KeepAliveConfig
+}
+
+func (d dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialTimeout(network, address, 0)
+}
+
+func (d dialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	return (&net.Dialer{Timeout: timeout, KeepAliveConfig: d.keepalive}).Dial(network, address)
+}
+
+// Database drivers -driver can pick
+const (
+	driverPq  = "postgres"
+	driverPgx = "pgx"
+)
+
+// openDB opens the database with the driver adding connect_timeout
+// and keepalives_idle to the DSN unless it has them already.
+// The search path and the time zone, if any, are sent along as startup
+// parameters so that every connection has them before it runs any query.
+func openDB(driverName, dsn string, connectTimeout, keepalivesIdle time.Duration, searchPath, timeZone string) (*sql.DB, error) {
+	if driverName != driverPq && driverName != driverPgx {
+		return nil, fmt.Errorf("Unknown driver '%s', expected %s or %s", driverName, driverPq, driverPgx)
+	}
+
+	params, keepalive, err := connectionParams(dsn, connectTimeout, keepalivesIdle, searchPath, timeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	if driverName == driverPgx {
+		config, err := pgx.ParseConfig(formatDSN(params))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid connection string: %w", err)
+		}
+		// pgx applies connect_timeout to the context it dials with
+		config.DialFunc = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{KeepAliveConfig: keepalive}).DialContext(ctx, network, address)
+		}
+
+		return stdlib.OpenDB(*config), nil
+	}
+
+	return sql.OpenDB(connector{formatDSN(params), dialer{keepalive}}), nil
+}
+
+// connectionParams parses the DSN, adds the parameters pload sets itself and
+// takes out the keepalive settings the drivers don't understand.
+func connectionParams(dsn string, connectTimeout, keepalivesIdle time.Duration, searchPath, timeZone string) (map[string]string, net.KeepAliveConfig, error) {
+	params, err := parseDSN(dsn)
+	if err != nil {
+		return nil, net.KeepAliveConfig{}, fmt.Errorf("Invalid connection string: %w", err)
+	}
+
+	if _, ok := params["connect_timeout"]; !ok && connectTimeout > 0 {
+		params["connect_timeout"] = strconv.Itoa(int(math.Ceil(connectTimeout.Seconds())))
+	}
+	if _, ok := params["keepalives_idle"]; !ok && keepalivesIdle > 0 {
+		params["keepalives_idle"] = strconv.Itoa(int(math.Ceil(keepalivesIdle.Seconds())))
+	}
+	if searchPath != "" {
+		if _, ok := params["search_path"]; ok {
+			return nil, net.KeepAliveConfig{}, fmt.Errorf("Can't use -search-path with search_path in the connection string")
+		}
+		params["search_path"] = searchPath
+	}
+	if timeZone != "" {
+		for key := range params {
+			// Postgres settings are case insensitive, TimeZone included
+			if strings.EqualFold(key, "timezone") {
+				return nil, net.KeepAliveConfig{}, fmt.Errorf("Can't use -timezone with %s in the connection string", key)
+			}
+		}
+		params["timezone"] = timeZone
+	}
+
+	keepalive, err := keepaliveConfig(params)
+	if err != nil {
+		return nil, net.KeepAliveConfig{}, fmt.Errorf("Invalid connection string: %w", err)
+	}
+	for _, key := range keepaliveSettings {
+		delete(params, key)
+	}
+
+	return params, keepalive, nil
+}
+
+// libpqParams are the connection parameters libpq defines. Any other key is
+// passed on to the server by both drivers as the value of a setting of the session.
+var libpqParams = map[string]bool{
+	"host": true, "hostaddr": true, "port": true, "dbname": true, "user": true, "password": true,
+	"passfile": true, "channel_binding": true, "connect_timeout": true, "client_encoding": true,
+	"options": true, "application_name": true, "fallback_application_name": true,
+	"keepalives": true, "keepalives_idle": true, "keepalives_interval": true, "keepalives_count": true,
+	"tcp_user_timeout": true, "replication": true, "gssencmode": true, "sslmode": true,
+	"requiressl": true, "sslcompression": true, "sslcert": true, "sslkey": true, "sslpassword": true,
+	"sslrootcert": true, "sslcrl": true, "sslcrldir": true, "sslsni": true, "requirepeer": true,
+	"ssl_min_protocol_version": true, "ssl_max_protocol_version": true, "krbsrvname": true,
+	"gsslib": true, "service": true, "target_session_attrs": true, "load_balance_hosts": true,
+}
+
+// pqUnsupportedParams are the libpq parameters lib/pq doesn't handle and would send to the server instead.
+var pqUnsupportedParams = []string{
+	"hostaddr", "passfile", "channel_binding", "tcp_user_timeout", "replication", "gssencmode",
+	"requiressl", "sslcompression", "sslpassword", "sslcrl", "sslcrldir", "sslsni", "requirepeer",
+	"ssl_min_protocol_version", "ssl_max_protocol_version", "krbsrvname", "gsslib", "service",
+	"target_session_attrs", "load_balance_hosts",
+}
+
+// sessionParams are settings of the session commonly given in the connection string
+// that aren't libpq parameters but are fine to send to the server.
+var sessionParams = map[string]bool{
+	"search_path": true, "statement_timeout": true, "lock_timeout": true,
+	"idle_in_transaction_session_timeout": true, "work_mem": true, "maintenance_work_mem": true,
+	"timezone": true, "datestyle": true, "extra_float_digits": true, "geqo": true,
+	"synchronous_commit": true, "role": true,
+}
+
+// environParams are the environment variables the connection parameters default to
+// the way lib/pq reads them.
+var environParams = map[string]string{
+	"PGHOST": "host", "PGPORT": "port", "PGDATABASE": "dbname", "PGUSER": "user",
+	"PGPASSWORD": "password", "PGOPTIONS": "options", "PGAPPNAME": "application_name",
+	"PGSSLMODE": "sslmode", "PGSSLCERT": "sslcert", "PGSSLKEY": "sslkey",
+	"PGSSLROOTCERT": "sslrootcert", "PGCONNECT_TIMEOUT": "connect_timeout",
+	"PGCLIENTENCODING": "client_encoding", "PGDATESTYLE": "datestyle", "PGTZ": "timezone",
+	"PGGEQO": "geqo",
+}
+
+// pqUnsupportedEnviron are the environment variables lib/pq refuses to connect with.
+var pqUnsupportedEnviron = []string{
+	"PGHOSTADDR", "PGSERVICE", "PGSERVICEFILE", "PGREALM", "PGREQUIRESSL", "PGSSLCRL",
+	"PGREQUIREPEER", "PGKRBSRVNAME", "PGGSSLIB", "PGSYSCONFDIR", "PGLOCALEDIR",
+}
+
+// validateDSN checks the connection string the way the driver would take it without connecting
+// and returns the resolved parameters, the environment given ones included, as key=value
+// lines with the password redacted.
+func validateDSN(driverName, dsn string, connectTimeout, keepalivesIdle time.Duration, searchPath, timeZone string) ([]string, error) {
+	if driverName != driverPq && driverName != driverPgx {
+		return nil, fmt.Errorf("Unknown driver '%s', expected %s or %s", driverName, driverPq, driverPgx)
+	}
+
+	given, err := parseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid connection string: %w", err)
+	}
+	var problems []string
+	for key := range given {
+		if !libpqParams[key] && !sessionParams[key] && !strings.Contains(key, ".") {
+			problems = append(problems, fmt.Sprintf("unknown parameter %s, a setting of the session goes into options='-c %s=...'", key, key))
+		}
+	}
+
+	params, _, err := connectionParams(dsn, connectTimeout, keepalivesIdle, searchPath, timeZone)
+	if err != nil {
+		return nil, err
+	}
+	for variable, key := range environParams {
+		if value, ok := os.LookupEnv(variable); ok {
+			if _, ok := params[key]; !ok {
+				params[key] = value
+			}
+		}
+	}
+
+	if (params["sslcert"] != "") != (params["sslkey"] != "") {
+		problems = append(problems, "sslcert and sslkey go together")
+	}
+	if value, ok := params["connect_timeout"]; ok {
+		if seconds, err := strconv.Atoi(value); err != nil || seconds < 0 {
+			problems = append(problems, fmt.Sprintf("invalid value for parameter connect_timeout: %s", value))
+		}
+	}
+
+	if driverName == driverPq {
+		for _, key := range pqUnsupportedParams {
+			if _, ok := params[key]; ok {
+				problems = append(problems, fmt.Sprintf("parameter %s isn't supported by lib/pq, try -driver pgx", key))
+			}
+		}
+		for _, variable := range pqUnsupportedEnviron {
+			if _, ok := os.LookupEnv(variable); ok {
+				problems = append(problems, fmt.Sprintf("environment variable %s isn't supported by lib/pq", variable))
+			}
+		}
+		if value, ok := params["port"]; ok {
+			if port, err := strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+				problems = append(problems, fmt.Sprintf("invalid value for parameter port: %s", value))
+			}
+		}
+		switch value := params["sslmode"]; value {
+		case "", "disable", "require", "verify-ca", "verify-full":
+		default:
+			problems = append(problems, fmt.Sprintf("sslmode %s isn't supported by lib/pq, expected disable, require, verify-ca or verify-full", value))
+		}
+		if value, ok := params["client_encoding"]; ok && !strings.EqualFold(strings.ReplaceAll(value, "-", ""), "utf8") {
+			problems = append(problems, "client_encoding must be absent or UTF8")
+		}
+		if value, ok := params["datestyle"]; ok && value != "ISO, MDY" {
+			problems = append(problems, "datestyle must be absent or 'ISO, MDY'")
+		}
+	} else if _, err := pgx.ParseConfig(formatDSN(params)); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("Invalid connection string: %s", strings.Join(problems, "; "))
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		value := params[key]
+		if key == "password" {
+			value = "********"
+		}
+		lines[i] = fmt.Sprintf("%s=%s", key, value)
+	}
+
+	return lines, nil
+}
+
+// formatSearchPath turns a comma separated list of schemas into a search_path value
+// with every schema quoted. Unquoted names are folded to lower case the same way
+// Postgres does it, quoted ones are taken as they are.
+func formatSearchPath(value string) (string, error) {
+	var names []string
+	start, quoted := 0, false
+	for i, r := range value + "," {
+		// The appended comma ends the last name
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			names = append(names, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+	if quoted {
+		return "", fmt.Errorf("Invalid search path '%s': unterminated quoted schema name", value)
+	}
+
+	schemas := make([]string, len(names))
+	for i, name := range names {
+		quotedName := len(name) > 2 && strings.HasPrefix(name, `"`) && strings.HasSuffix(name, `"`)
+		if name == "" || strings.ContainsRune(name, 0) || !quotedName && strings.Contains(name, `"`) {
+			return "", fmt.Errorf("Invalid schema name '%s' in search path '%s'", name, value)
+		}
+		schemas[i] = `"` + strings.ReplaceAll(unquoteIdentifier(name), `"`, `""`) + `"`
+	}
+
+	return strings.Join(schemas, ","), nil
+}
+
+// keepaliveConfig translates libpq keepalive parameters into the TCP keepalive configuration.
+// Zero values leave the defaults of the operating system in place.
+func keepaliveConfig(params map[string]string) (net.KeepAliveConfig, error) {
+	config := net.KeepAliveConfig{Enable: true}
+
+	if value, ok := params["keepalives"]; ok {
+		enable, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid value for parameter keepalives: %s", value)
+		}
+		config.Enable = enable != 0
+	}
+
+	settings := []struct {
+		key  string
+		dest *time.Duration
+	}{
+		{"keepalives_idle", &config.Idle},
+		{"keepalives_interval", &config.Interval},
+	}
+	for _, setting := range settings {
+		if value, ok := params[setting.key]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return config, fmt.Errorf("invalid value for parameter %s: %s", setting.key, value)
+			}
+			*setting.dest = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if value, ok := params["keepalives_count"]; ok {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return config, fmt.Errorf("invalid value for parameter keepalives_count: %s", value)
+		}
+		config.Count = count
+	}
+
+	return config, nil
+}
+
+// parseDSN parses a connection string given either as a URL or as space separated key=value pairs.
+func parseDSN(dsn string) (map[string]string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params := make(map[string]string)
+	s := []rune(dsn)
+	i := 0
+	skipSpaces := func() {
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+	}
+
+	for {
+		skipSpaces()
+		if i >= len(s) {
+			return params, nil
+		}
+
+		start := i
+		for i < len(s) && s[i] != '=' && !isSpace(s[i]) {
+			i++
+		}
+		key := string(s[start:i])
+		skipSpaces()
+		if i >= len(s) || s[i] != '=' || key == "" {
+			return nil, fmt.Errorf("missing \"=\" after \"%s\"", key)
+		}
+		i++
+		skipSpaces()
+
+		var value strings.Builder
+		if i < len(s) && s[i] == '\'' {
+			i++
+			for ; ; i++ {
+				if i >= len(s) {
+					return nil, fmt.Errorf("unterminated quoted string in value of \"%s\"", key)
+				}
+				if s[i] == '\'' {
+					i++
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteRune(s[i])
+			}
+		} else {
+			for ; i < len(s) && !isSpace(s[i]); i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteRune(s[i])
+			}
+		}
+
+		params[key] = value.String()
+	}
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' || r == '\v'
+}
+
+// formatDSN formats parameters as a key=value connection string.
+func formatDSN(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(params[key])
+		pairs[i] = fmt.Sprintf("%s='%s'", key, value)
+	}
+
+	return strings.Join(pairs, " ")
+}
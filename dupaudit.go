@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// returnsKeys tells whether the inserts return the conflict keys of the inserted records
+// to tell the skipped ones, for the skipped file or for the audit table.
+func returnsKeys(config config) bool {
+	return config.Skipped != nil || config.DupAuditTable != ""
+}
+
+// auditQuery builds the insert of n conflict keys into the -dup-audit-table
+// along with the import id if there is one.
+func auditQuery(config config, n int) string {
+	columns := []string{conflictKey}
+	if config.ImportId != 0 {
+		columns = append(columns, importIdColumn)
+	}
+
+	values := make([]string, n)
+	for i := range values {
+		if config.ImportId != 0 {
+			values[i] = fmt.Sprintf("($%d,%d)", i+1, config.ImportId)
+		} else {
+			values[i] = fmt.Sprintf("($%d)", i+1)
+		}
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", config.DupAuditTable, strings.Join(columns, ","), strings.Join(values, ","))
+}
+
+// auditDuplicates inserts the conflict keys of the skipped records into the -dup-audit-table
+// in the transaction of the batch and returns the number of keys inserted.
+func auditDuplicates(tx *sql.Tx, config config, skipped []inputRecord, keyIndex int) (int, error) {
+	for start := 0; start < len(skipped); start += maxParams {
+		chunk := skipped[start:min(start+maxParams, len(skipped))]
+
+		args := make([]interface{}, len(chunk))
+		for i, record := range chunk {
+			args[i] = nullify(record.fields[keyIndex], config.NullEscape)
+		}
+
+		if _, err := tx.Exec(auditQuery(config, len(chunk)), args...); err != nil {
+			return 0, fmt.Errorf("Can't write duplicates to audit table '%s': %w", config.DupAuditTable, err)
+		}
+	}
+
+	return len(skipped), nil
+}
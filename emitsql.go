@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// emitSQL writes the statements the load runs to a file for review: the insert of a full batch,
+// the insert of a single record, which stands for the smaller batches left over at the end,
+// and whatever runs before the load, after every batch and after the load, with the resolved
+// columns and the conflict target in comments.
+func emitSQL(path string, config config) error {
+	// Stands for the import id -import-id-from allocates in the statements it goes into as is
+	if config.ImportIdFrom != "" && config.ImportId == 0 {
+		config.ImportId = -1
+	}
+
+	var sql strings.Builder
+	fmt.Fprintf(&sql, "-- Table: %s\n", config.Table)
+	fmt.Fprintf(&sql, "-- Columns: %s\n", strings.Join(append(append([]string{}, loadColumns(config)...), config.Exprs.columns()...), ", "))
+	switch {
+	case config.View:
+		fmt.Fprintf(&sql, "-- Conflict target: none, the table is a view\n")
+	case config.Conflict == conflictError:
+		fmt.Fprintf(&sql, "-- Conflict target: none, -conflict %s\n", conflictError)
+	default:
+		fmt.Fprintf(&sql, "-- Conflict target: (%s), -conflict %s\n", conflictKey, config.Conflict)
+	}
+	if config.PartitionBy != "" {
+		fmt.Fprintf(&sql, "-- The records routed by %s go into their partitions with the same statements\n", config.PartitionBy)
+	}
+	if config.CreateTable {
+		fmt.Fprintf(&sql, "-- The table is created first from a sample of the input unless it exists\n")
+	}
+
+	if config.ImportIdFrom != "" || len(config.DroppedIndexes) > 0 {
+		fmt.Fprintf(&sql, "\n-- Before the load\n")
+		if config.ImportIdFrom != "" {
+			fmt.Fprintf(&sql, "%s;\n", config.ImportIdFrom)
+		}
+		for _, index := range config.DroppedIndexes {
+			fmt.Fprintf(&sql, "DROP INDEX %s;\n", index.Name)
+		}
+	}
+
+	fmt.Fprintf(&sql, "\n-- A batch of %d records\n%s;\n", config.InsertSize, buildQuery(config, config.Table, config.InsertSize))
+	if config.InsertSize > 1 {
+		fmt.Fprintf(&sql, "\n-- A single record, the last batches have as many rows of values as they have records\n%s;\n", buildQuery(config, config.Table, 1))
+	}
+
+	if config.DupAuditTable != "" {
+		fmt.Fprintf(&sql, "\n-- After a batch that skipped records, a row of values per skipped record\n%s;\n", auditQuery(config, 1))
+	}
+
+	if config.BatchHook != "" {
+		fmt.Fprintf(&sql, "\n-- After every batch\n%s;\n", config.BatchHook)
+	}
+
+	if len(config.DroppedIndexes) > 0 {
+		fmt.Fprintf(&sql, "\n-- After the load\n")
+		for _, index := range config.DroppedIndexes {
+			fmt.Fprintf(&sql, "%s;\n", index.Definition)
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(sql.String()), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("Can't write SQL file '%s': %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEmitSQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func(c *config)
+		want    []string
+		notWant []string
+	}{
+		{
+			"defaults",
+			func(c *config) {},
+			[]string{
+				"-- Table: t\n-- Columns: marketoguid, leadid\n-- Conflict target: (marketoguid), -conflict skip\n",
+				"\n-- A batch of 10 records\n",
+				"INSERT INTO t (marketoguid, leadid) VALUES ($1,$2),($3,$4),($5,$6),($7,$8),($9,$10),($11,$12),($13,$14),($15,$16),($17,$18),($19,$20)\n",
+				"ON CONFLICT (marketoguid) DO NOTHING",
+				"\n-- A single record, the last batches have as many rows of values as they have records\n",
+			},
+			[]string{"-- Before the load", "-- After every batch", "-- After the load", "importid"},
+		},
+		{
+			"single record batches",
+			func(c *config) { c.InsertSize = 1 },
+			[]string{"\n-- A batch of 1 records\n"},
+			[]string{"-- A single record"},
+		},
+		{
+			"conflict error",
+			func(c *config) { c.Conflict = conflictError },
+			[]string{"-- Conflict target: none, -conflict error\n"},
+			[]string{"ON CONFLICT"},
+		},
+		{
+			"view",
+			func(c *config) { c.View = true; c.Conflict = conflictError },
+			[]string{"-- Conflict target: none, the table is a view\n"},
+			nil,
+		},
+		{
+			"stamped import id from a query",
+			func(c *config) {
+				c.StampImportId = true
+				c.ImportIdFrom = "INSERT INTO imports DEFAULT VALUES RETURNING id"
+				c.Exprs = columnValues{{"loadedat", "now()"}}
+				c.DupAuditTable = "audit"
+			},
+			[]string{
+				"-- Columns: importid, marketoguid, leadid, loadedat\n",
+				"\n-- Before the load\nINSERT INTO imports DEFAULT VALUES RETURNING id;\n",
+				"\n-- After a batch that skipped records, a row of values per skipped record\nINSERT INTO audit (marketoguid,importid) VALUES ($1,-1);\n",
+			},
+			nil,
+		},
+		{
+			"hook and indexes",
+			func(c *config) {
+				c.BatchHook = "SELECT pg_sleep(0)"
+				c.DroppedIndexes = []droppedIndex{{Name: "public.t_leadid_idx", Definition: "CREATE INDEX t_leadid_idx ON public.t USING btree (leadid)"}}
+				c.PartitionBy = "leadid"
+				c.CreateTable = true
+			},
+			[]string{
+				"-- The records routed by leadid go into their partitions with the same statements\n",
+				"-- The table is created first from a sample of the input unless it exists\n",
+				"\n-- Before the load\nDROP INDEX public.t_leadid_idx;\n",
+				"\n-- After every batch\nSELECT pg_sleep(0);\n",
+				"\n-- After the load\nCREATE INDEX t_leadid_idx ON public.t USING btree (leadid);\n",
+			},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The directory is created if it doesn't exist
+			path := filepath.Join(t.TempDir(), "review", "load.sql")
+			config := testConfig()
+			tt.config(&config)
+
+			if err := emitSQL(path, config); err != nil {
+				t.Fatal(err)
+			}
+			sql, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(sql), want) {
+					t.Errorf("got\n%s\nwant it to contain %q", sql, want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(string(sql), notWant) {
+					t.Errorf("got\n%s\nwant it not to contain %q", sql, notWant)
+				}
+			}
+		})
+	}
+}
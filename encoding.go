@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/saintfish/chardet"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// encodingSample is how much of the input -detect-encoding looks at.
+const encodingSample = 64 * 1024
+
+// minEncodingConfidence is the confidence, out of 100, below which a detected encoding is
+// not trusted and the input is read as UTF-8.
+const minEncodingConfidence = 20
+
+// lookupEncoding finds the encoding by its IANA name or alias e.g. windows-1252 or latin1,
+// or by one of the labels web browsers know it by e.g. cp1252.
+// UTF-8 needs no transcoding and comes back as nil.
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		enc, err = htmlindex.Get(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unknown encoding '%s'", name)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("Unsupported encoding '%s'", name)
+	}
+	if enc == unicode.UTF8 {
+		return nil, nil
+	}
+
+	return enc, nil
+}
+
+// detectEncoding guesses the encoding of the input from its first bytes without consuming them.
+// Input that is valid UTF-8 so far, plain ASCII included, is taken for UTF-8 whatever
+// the detector makes of it since any single byte encoding would read ASCII just as well.
+func detectEncoding(r *bufio.Reader) (string, int, error) {
+	sample, err := r.Peek(encodingSample)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", 0, err
+	}
+
+	// The sample may end in the middle of a character
+	whole := sample
+	for i := len(sample) - 1; i >= 0 && i >= len(sample)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(sample[i]) {
+			if !utf8.FullRune(sample[i:]) {
+				whole = sample[:i]
+			}
+			break
+		}
+	}
+	if utf8.Valid(whole) {
+		return "UTF-8", 100, nil
+	}
+
+	result, err := chardet.NewTextDetector().DetectBest(sample)
+	if err != nil {
+		return "", 0, nil
+	}
+	// The detector has its own spelling of some of the names
+	name := strings.ReplaceAll(result.Charset, "GB-18030", "GB18030")
+
+	return name, result.Confidence, nil
+}
+
+// transcode converts the input from the encoding to UTF-8 as it is read.
+func transcode(r io.Reader, enc encoding.Encoding) io.Reader {
+	if enc == nil {
+		return r
+	}
+
+	return transform.NewReader(r, enc.NewDecoder())
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestLookupEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"windows-1252", "Windows 1252", false},
+		{"latin1", "ISO 8859-1", false},
+		{"ISO-8859-1", "ISO 8859-1", false},
+		{"cp1252", "Windows 1252", false},
+		{"Shift_JIS", "Shift JIS", false},
+		// No transcoding
+		{"UTF-8", "", false},
+		{"utf8", "", false},
+		{"klingon", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := lookupEncoding(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want an error %v", err, tt.wantErr)
+			}
+			got := ""
+			if enc != nil {
+				got = enc.(interface{ String() string }).String()
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectEncoding(t *testing.T) {
+	latin1, err := charmap.ISO8859_1.NewEncoder().String(strings.Repeat("Le café crème, déjà vu à Besançon.\n", 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A multibyte character cut off by the end of the sample
+	cut := strings.Repeat("a", encodingSample-1) + "é"
+
+	tests := []struct {
+		name     string
+		input    string
+		wantUTF8 bool
+	}{
+		{"ascii", "marketoguid,leadid\ng1,1\n", true},
+		{"utf-8", strings.Repeat("Le café crème\n", 50), true},
+		{"cut off", cut, true},
+		{"empty", "", true},
+		{"latin1", latin1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(tt.input), encodingSample)
+			name, confidence, err := detectEncoding(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (name == "UTF-8") != tt.wantUTF8 {
+				t.Fatalf("got %s with confidence %d, want UTF-8 %v", name, confidence, tt.wantUTF8)
+			}
+
+			// Nothing is consumed
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != tt.input {
+				t.Errorf("got %d bytes left to read, want all %d", len(rest), len(tt.input))
+			}
+
+			if tt.wantUTF8 {
+				return
+			}
+			if confidence < minEncodingConfidence {
+				t.Errorf("got %s with confidence %d, want at least %d", name, confidence, minEncodingConfidence)
+			}
+			// The name detected is one the encoding can be looked up by
+			enc, err := lookupEncoding(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, err := io.ReadAll(transcode(strings.NewReader(tt.input), enc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(text, []byte("Le café crème, déjà vu à Besançon.\n")) {
+				t.Errorf("got %.40q, want the text transcoded", text)
+			}
+		})
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	enc, err := lookupEncoding("windows-1252")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"ascii", []byte("g1,1\n"), "g1,1\n"},
+		{"accents", []byte("g1,caf\xe9\n"), "g1,café\n"},
+		{"euro and quotes", []byte("\x80 \x93quoted\x94"), "€ “quoted”"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(transcode(bytes.NewReader(tt.input), enc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Without an encoding the input is read as it is
+	r := strings.NewReader("café")
+	if transcode(r, nil) != io.Reader(r) {
+		t.Error("got the UTF-8 input transcoded")
+	}
+}
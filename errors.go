@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+var (
+	errCancelled   = errors.New("Cancelled")
+	errLocked      = errors.New("Advisory lock is held by another session")
+	errMemoryLimit = errors.New("Memory limit exceeded")
+)
+
+// Error categories reported in the totals
+const (
+	categoryConnection = "connection"
+	categoryConstraint = "constraint"
+	categoryParse      = "parse"
+	categoryCancelled  = "cancelled"
+	categoryTimeout    = "timeout"
+	categoryMemory     = "memory"
+	categorySchema     = "schema"
+	categoryLocked     = "locked"
+	categoryPermission = "permission"
+	categoryOther      = "other"
+)
+
+// loadError describes the reason a load failed in a machine readable form.
+type loadError struct {
+	Category string
+	Code     string `json:",omitempty"`
+	Message  string
+	// The role and the privilege on the table it lacks
+	Role      string `json:",omitempty"`
+	Privilege string `json:",omitempty"`
+}
+
+func (e *loadError) String() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s [%s]: %s", e.Category, e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Category, e.Message)
+}
+
+func newLoadError(err error) *loadError {
+	e := &loadError{
+		Category: categorize(err),
+		Message:  err.Error(),
+	}
+
+	e.Code = sqlState(err)
+
+	var privilegeErr *privilegeError
+	if errors.As(err, &privilegeErr) {
+		e.Role = privilegeErr.Role
+		e.Privilege = privilegeErr.Privilege
+	}
+
+	return e
+}
+
+// sqlState returns the SQLSTATE code of a server error reported by either driver.
+func sqlState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+
+	return ""
+}
+
+// transient tells whether an insert failed on something other than its data that
+// trying it again from a savepoint may get past: a deadlock, a lock or a statement timeout.
+// The transaction survives all of them, unlike a broken connection or a serialization
+// failure, which only replaying the whole transaction can overcome.
+func transient(err error) bool {
+	switch sqlState(err) {
+	case "40P01", "55P03", "57014":
+		return true
+	}
+
+	return false
+}
+
+// retryable tells whether loading the input all over again may succeed where the load failed,
+// i.e. the connection broke or the transaction lost a race with another one.
+func retryable(err error) bool {
+	switch sqlState(err) {
+	case "40001", "40P01":
+		return true
+	}
+
+	return categorize(err) == categoryConnection
+}
+
+// categorize tells what kind of failure the error represents.
+func categorize(err error) string {
+	if errors.Is(err, errCancelled) {
+		return categoryCancelled
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return categoryTimeout
+	}
+
+	if errors.Is(err, errMemoryLimit) {
+		return categoryMemory
+	}
+
+	if errors.Is(err, errLocked) {
+		return categoryLocked
+	}
+
+	if errors.Is(err, errSchemaMismatch) {
+		return categorySchema
+	}
+
+	var privilegeErr *privilegeError
+	if errors.As(err, &privilegeErr) {
+		return categoryPermission
+	}
+
+	// A required column is checked before the database enforces its constraint
+	var missingErr *missingError
+	if errors.As(err, &missingErr) {
+		return categoryConstraint
+	}
+
+	// A value -strict-types finds invalid for its column type is a data exception caught early
+	var typeErr *typeError
+	if errors.As(err, &typeErr) {
+		return categoryParse
+	}
+
+	// So is a value -as-int or -as-bool can't convert
+	var normalizeErr *normalizeError
+	if errors.As(err, &normalizeErr) {
+		return categoryParse
+	}
+
+	// So is a value -types can't convert
+	var coerceErr *coercionError
+	if errors.As(err, &coerceErr) {
+		return categoryParse
+	}
+
+	// So is a record over -max-row-bytes, most likely a quote left open
+	var sizeErr *rowSizeError
+	if errors.As(err, &sizeErr) {
+		return categoryParse
+	}
+
+	// So is a record that doesn't fit the columns
+	var countErr *fieldCountError
+	if errors.As(err, &countErr) {
+		return categoryParse
+	}
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return categoryParse
+	}
+
+	if code := sqlState(err); len(code) == 5 {
+		// A statement timeout is operator intervention too, but the connection is fine
+		if code == "57014" {
+			return categoryTimeout
+		}
+
+		switch code[:2] {
+		// Integrity constraint violation
+		case "23":
+			return categoryConstraint
+		// Data exception i.e. a value that can't be converted to the column type
+		case "22":
+			return categoryParse
+		// Connection exception, operator intervention (e.g. the server is shutting down)
+		case "08", "57":
+			return categoryConnection
+		// Insufficient privilege
+		case "42":
+			if code == "42501" {
+				return categoryPermission
+			}
+		}
+
+		return categoryOther
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return categoryConnection
+	}
+
+	return categoryOther
+}
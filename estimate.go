@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"time"
+)
+
+// maxParams is the number of bind parameters a single statement can have at most.
+const maxParams = 65535
+
+// estimateTable is the temporary table the -estimate benchmark loads the sample into.
+const estimateTable = "pg_temp.pload_estimate"
+
+// -m auto picks the largest insert size the bind parameters allow up to maxAutoInsertSize,
+// beyond which inserts hardly get any faster while workers hold ever more records.
+const (
+	autoInsertSize    = -1
+	maxAutoInsertSize = 10000
+)
+
+// maxInsertSize returns the largest number of records an insert can bind.
+func maxInsertSize(config config) int {
+	return maxParams / len(loadColumns(config))
+}
+
+// estimate suggests the insert size and, given a sample size, benchmarks
+// loading that many records of the input at a few insert sizes into a temporary
+// copy of the table. Nothing is loaded into the table itself.
+func estimate(db *sql.DB, reader *csv.Reader, config config, sampleSize int) error {
+	largest := maxInsertSize(config)
+	fmt.Printf("Columns %d, largest insert size %d\n", len(loadColumns(config)), largest)
+
+	if sampleSize <= 0 {
+		fmt.Printf("Recommended: -m %d\n", largest)
+		return nil
+	}
+
+	err := connect(db, config)
+	if err != nil {
+		return err
+	}
+
+	sample, err := readSample(reader, config, sampleSize)
+	if err != nil {
+		return err
+	}
+	if len(sample) == 0 {
+		return fmt.Errorf("Can't estimate: the input has no records")
+	}
+
+	// The temporary table lives as long as the session so stick to a single one
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(fmt.Sprintf(
+		"CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING INDEXES INCLUDING GENERATED INCLUDING IDENTITY)",
+		estimateTable,
+		config.Table,
+	))
+	if err != nil {
+		return fmt.Errorf("Can't create the estimate table: %w", err)
+	}
+	defer db.Exec("DROP TABLE IF EXISTS " + estimateTable)
+
+	// Load the sample with a single worker in a single transaction
+	// and leave out everything that touches other tables
+	config.Table = estimateTable
+	config.Workers = 1
+	config.TxSize = len(sample)
+	config.PartitionBy = ""
+	config.AdvisoryLock = nil
+	config.PrintSQL = nil
+	config.Rejects = nil
+	config.Skipped = nil
+	config.DupAuditTable = ""
+	config.Progress = nil
+	config.BatchHook = ""
+	// Without the reject file the values that don't convert are left out of the sample instead
+	if config.OnCoerceError == coerceReject {
+		config.OnCoerceError = coerceNull
+	}
+	if config.ImportIdFrom != "" && config.ImportId == 0 {
+		config.ImportId = 1
+	}
+
+	best, bestRate := 0, 0.0
+	for _, size := range estimateSizes(largest, len(sample)) {
+		_, err := db.Exec("TRUNCATE " + estimateTable)
+		if err != nil {
+			return err
+		}
+
+		records := make(chan inputRecord, len(sample))
+		for _, record := range sample {
+			records <- record
+		}
+		close(records)
+
+		config.InsertSize = size
+		start := time.Now()
+		_, err = ingest(db, config, 1, records)
+		if err != nil {
+			return fmt.Errorf("Can't estimate insert size %d: %w", size, err)
+		}
+		elapsed := time.Since(start)
+
+		rate := float64(len(sample)) / elapsed.Seconds()
+		fmt.Printf("-m %d: %d records in %v, %.0f records/s\n", size, len(sample), elapsed, rate)
+		if rate > bestRate {
+			best, bestRate = size, rate
+		}
+	}
+
+	fmt.Printf("Recommended: -m %d\n", best)
+
+	return nil
+}
+
+// readSample reads up to n records the way the load would.
+func readSample(reader *csv.Reader, config config, n int) ([]inputRecord, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	records, errc := read(done, reader, config)
+
+	var sample []inputRecord
+	for record := range records {
+		sample = append(sample, record)
+		if len(sample) == n {
+			return sample, nil
+		}
+	}
+
+	return sample, <-errc
+}
+
+// estimateSizes picks the insert sizes to benchmark halving
+// the largest one that makes sense down to a hundredth of it.
+func estimateSizes(largest, sampleSize int) []int {
+	// Sizes above the sample size would all run the same single insert
+	if largest > sampleSize {
+		largest = sampleSize
+	}
+
+	var sizes []int
+	for size := largest; size > 0 && size >= largest/100; size /= 2 {
+		sizes = append([]int{size}, sizes...)
+	}
+
+	return sizes
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEstimateSizes(t *testing.T) {
+	tests := []struct {
+		largest    int
+		sampleSize int
+		want       []int
+	}{
+		{1000, 10000, []int{15, 31, 62, 125, 250, 500, 1000}},
+		{32767, 100000, []int{511, 1023, 2047, 4095, 8191, 16383, 32767}},
+		// Capped by the sample
+		{32767, 1000, []int{15, 31, 62, 125, 250, 500, 1000}},
+		{32767, 100, []int{1, 3, 6, 12, 25, 50, 100}},
+		{32767, 3, []int{1, 3}},
+		{32767, 1, []int{1}},
+		{1, 1000, []int{1}},
+		{32767, 0, nil},
+	}
+
+	for _, tt := range tests {
+		if got := estimateSizes(tt.largest, tt.sampleSize); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("estimateSizes(%d, %d) = %v, want %v", tt.largest, tt.sampleSize, got, tt.want)
+		}
+	}
+}
+
+func TestMaxInsertSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		stamp   bool
+		want    int
+	}{
+		{"one column", []string{"marketoguid"}, false, 65535},
+		{"two columns", []string{"marketoguid", "leadid"}, false, 32767},
+		// The import id is bound as a column of its own
+		{"stamped", []string{"marketoguid", "leadid"}, true, 21845},
+		{"wide", make([]string, 100), false, 655},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.Columns = tt.columns
+			config.StampImportId = tt.stamp
+			if got := maxInsertSize(config); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+			// It never binds more than a statement takes
+			if params := maxInsertSize(config) * len(loadColumns(config)); params > maxParams {
+				t.Errorf("got %d parameters, more than %d", params, maxParams)
+			}
+		})
+	}
+}
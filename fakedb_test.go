@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDriver is a database/sql driver that records the statements it is given and
+// answers them the way the test tells it, so that loads run without a server.
+type fakeDriver struct{}
+
+var fakeDBs sync.Map
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+// fakeAnswer returns the columns and the rows of the result of a statement.
+// No columns leave the statement to the default answer.
+type fakeAnswer func(query string, args []driver.Value) ([]string, [][]driver.Value, error)
+
+// fakeStatement is a statement the fake database has been given.
+type fakeStatement struct {
+	Query string
+	Args  []driver.Value
+}
+
+// fakeDB is the state of a fake database shared by its connections.
+type fakeDB struct {
+	answer fakeAnswer
+
+	mu         sync.Mutex
+	statements []fakeStatement
+}
+
+// newFakeDB opens a fake database of the test answering with the answer, if any.
+// By default an insert affects all of its rows and a query returns none.
+func newFakeDB(t *testing.T, answer fakeAnswer) (*sql.DB, *fakeDB) {
+	t.Helper()
+
+	fake := &fakeDB{answer: answer}
+	fakeDBs.Store(t.Name(), fake)
+
+	db, err := sql.Open("fake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeDBs.Delete(t.Name())
+	})
+
+	return db, fake
+}
+
+// inserts returns the inserts the database has been given in the order it got them.
+func (f *fakeDB) inserts() []fakeStatement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var inserts []fakeStatement
+	for _, statement := range f.statements {
+		if isInsert(statement.Query) {
+			inserts = append(inserts, statement)
+		}
+	}
+
+	return inserts
+}
+
+func (f *fakeDB) record(query string, args []driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.statements = append(f.statements, fakeStatement{query, append([]driver.Value{}, args...)})
+}
+
+// isInsert tells whether the statement is the insert of a batch.
+func isInsert(query string) bool {
+	query = strings.TrimSpace(query)
+	return strings.HasPrefix(query, "INSERT INTO") || strings.HasPrefix(query, "WITH inserted AS")
+}
+
+// insertedRows returns the number of rows of the VALUES of the insert.
+func insertedRows(query string) int {
+	if !isInsert(query) {
+		return 0
+	}
+
+	return strings.Count(query, "),(") + 1
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fake, _ := fakeDBs.Load(name)
+	return &fakeConn{fake.(*fakeDB)}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c.db, query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.record("BEGIN", nil)
+	return &fakeTx{c.db}, nil
+}
+
+// Ping asks the answer about a PING statement that isn't recorded.
+func (c *fakeConn) Ping(ctx context.Context) error {
+	if c.db.answer == nil {
+		return nil
+	}
+	_, _, err := c.db.answer("PING", nil)
+
+	return err
+}
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (t *fakeTx) Commit() error {
+	t.db.record("COMMIT", nil)
+	return nil
+}
+
+func (t *fakeTx) Rollback() error {
+	t.db.record("ROLLBACK", nil)
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.record(s.query, args)
+	if s.db.answer != nil {
+		columns, rows, err := s.db.answer(s.query, args)
+		if err != nil {
+			return nil, err
+		}
+		if columns != nil {
+			return driver.RowsAffected(len(rows)), nil
+		}
+	}
+
+	return driver.RowsAffected(insertedRows(s.query)), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.record(s.query, args)
+	if s.db.answer != nil {
+		columns, rows, err := s.db.answer(s.query, args)
+		if err != nil {
+			return nil, err
+		}
+		if columns != nil {
+			return &fakeRows{columns: columns, rows: rows}, nil
+		}
+	}
+
+	// The count of the CTE wrapping the insert
+	if isInsert(s.query) {
+		return &fakeRows{columns: []string{"count"}, rows: [][]driver.Value{{int64(insertedRows(s.query))}}}, nil
+	}
+
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// fieldMapping maps a field of the header to the column it is loaded into.
+type fieldMapping struct {
+	Field  string
+	Column string
+}
+
+// readFieldMap reads the header,column pairs of a -map-file, a CSV file whose lines
+// starting with # are comments. Blank lines are skipped.
+func readFieldMap(path string) ([]fieldMapping, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open map file '%s'", path)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+
+	var (
+		mappings []fieldMapping
+		columns  []string
+	)
+	for {
+		pair, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Can't read map file '%s': %v, expected header,column pairs", path, err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		mapping := fieldMapping{Field: strings.TrimSpace(pair[0]), Column: strings.TrimSpace(pair[1])}
+		if mapping.Field == "" || mapping.Column == "" {
+			return nil, fmt.Errorf("Map file '%s' has an empty header field or column on line %d", path, line)
+		}
+		if columnIndex(columns, mapping.Column) >= 0 {
+			return nil, fmt.Errorf("Column '%s' is mapped more than once in map file '%s'", mapping.Column, path)
+		}
+		columns = append(columns, mapping.Column)
+		mappings = append(mappings, mapping)
+	}
+
+	if len(mappings) == 0 {
+		return nil, fmt.Errorf("Map file '%s' maps no columns", path)
+	}
+
+	return mappings, nil
+}
+
+// mapFields finds the mapped fields in the header returning the columns and the positions
+// of their fields the way -positional gives them, along with the fields of the header
+// that aren't mapped and therefore not loaded. Mapped fields missing from the header fail it.
+func mapFields(header []string, mappings []fieldMapping) ([]string, []int, []string, error) {
+	var (
+		columns   []string
+		positions []int
+		missing   []string
+	)
+	fields := make([]string, len(header))
+	for i, field := range header {
+		fields[i] = strings.TrimSpace(field)
+	}
+
+	for _, mapping := range mappings {
+		position := columnIndex(fields, mapping.Field)
+		if position < 0 {
+			missing = append(missing, mapping.Field)
+			continue
+		}
+		columns = append(columns, mapping.Column)
+		positions = append(positions, position)
+	}
+	if len(missing) > 0 {
+		return nil, nil, nil, errors.New("Mapped fields missing from the header: " + strings.Join(missing, ", "))
+	}
+
+	var unmapped []string
+	for i, field := range fields {
+		mapped := false
+		for _, position := range positions {
+			mapped = mapped || position == i
+		}
+		if !mapped {
+			unmapped = append(unmapped, field)
+		}
+	}
+
+	return columns, positions, unmapped, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadFieldMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []fieldMapping
+		wantErr string
+	}{
+		{
+			"pairs",
+			"# field,column\nMarketo GUID,marketoguid\n\n Lead Id , leadid \n",
+			[]fieldMapping{{"Marketo GUID", "marketoguid"}, {"Lead Id", "leadid"}},
+			"",
+		},
+		{"quoted", "\"Id, of the lead\",leadid\n", []fieldMapping{{"Id, of the lead", "leadid"}}, ""},
+		{"comments only", "# nothing\n", nil, "maps no columns"},
+		{"empty", "", nil, "maps no columns"},
+		{"one field", "marketoguid\n", nil, "expected header,column pairs"},
+		{"three fields", "a,b,c\n", nil, "expected header,column pairs"},
+		{"empty field", "a,b\n ,c\n", nil, "has an empty header field or column on line 2"},
+		{"empty column", "a,\n", nil, "has an empty header field or column on line 1"},
+		// A column is case insensitive the way Postgres folds it
+		{"column twice", "a,leadid\nb,LeadId\n", nil, "Column 'LeadId' is mapped more than once"},
+		// A field may go to several columns
+		{"field twice", "a,x\na,y\n", []fieldMapping{{"a", "x"}, {"a", "y"}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "map.csv")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readFieldMap(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readFieldMap(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("got no error for a missing map file")
+	}
+}
+
+func TestMapFields(t *testing.T) {
+	mappings := []fieldMapping{{"Lead Id", "leadid"}, {"Marketo GUID", "marketoguid"}}
+
+	tests := []struct {
+		name          string
+		header        []string
+		wantColumns   []string
+		wantPositions []int
+		wantUnmapped  []string
+		wantErr       string
+	}{
+		{
+			"in the order of the map",
+			[]string{"Marketo GUID", "Lead Id"},
+			[]string{"leadid", "marketoguid"}, []int{1, 0}, nil, "",
+		},
+		{
+			"unmapped",
+			[]string{"Campaign", " Marketo GUID ", "Date", "lead id"},
+			[]string{"leadid", "marketoguid"}, []int{3, 1}, []string{"Campaign", "Date"}, "",
+		},
+		{
+			"missing",
+			[]string{"Campaign"},
+			nil, nil, nil, "Mapped fields missing from the header: Lead Id, Marketo GUID",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns, positions, unmapped, err := mapFields(tt.header, mappings)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("got %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(columns, tt.wantColumns) || !reflect.DeepEqual(positions, tt.wantPositions) ||
+				!reflect.DeepEqual(unmapped, tt.wantUnmapped) {
+				t.Errorf("got %v %v %v, want %v %v %v", columns, positions, unmapped, tt.wantColumns, tt.wantPositions, tt.wantUnmapped)
+			}
+		})
+	}
+}
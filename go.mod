@@ -1,3 +1,19 @@
 module github.com/pmatseykanets/pload
 
-require github.com/lib/pq v1.0.0
+go 1.26.0
+
+require (
+	github.com/expr-lang/expr v1.17.8
+	github.com/jackc/pgx/v5 v5.11.0
+	github.com/lib/pq v1.0.0
+	github.com/saintfish/chardet v0.0.0-20230101081208-5e3ef4b5456d
+	golang.org/x/text v0.29.0
+	golang.org/x/time v0.16.0
+)
+
+require (
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
+	github.com/jackc/puddle/v2 v2.2.2 // indirect
+	golang.org/x/sync v0.17.0 // indirect
+)
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// droppedIndex is an index of the table -recreate-index drops for the load and creates again after it.
+type droppedIndex struct {
+	// Schema qualified and quoted
+	Name string
+	// The CREATE INDEX statement of pg_get_indexdef
+	Definition string
+}
+
+// describeIndexes looks up the definitions of the indexes of the table refusing the ones
+// the load can't do without: the unique index ON CONFLICT infers as the arbiter and
+// the indexes of constraints, which can only be dropped along with the constraint.
+func describeIndexes(db *sql.DB, config config, names []string) ([]droppedIndex, error) {
+	arbiter := !config.View && config.Conflict != conflictError
+
+	var indexes []droppedIndex
+	for _, name := range names {
+		var (
+			index   droppedIndex
+			unique  bool
+			backing bool
+			columns string
+		)
+		err := db.QueryRow(
+			`SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+				pg_get_indexdef(x.indexrelid),
+				x.indisunique,
+				EXISTS (SELECT 1 FROM pg_constraint WHERE conindid = x.indexrelid),
+				COALESCE((
+					SELECT string_agg(a.attname, ',' ORDER BY k.ord)
+					FROM unnest(x.indkey) WITH ORDINALITY AS k(attnum, ord)
+					JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = k.attnum
+				), '')
+			FROM pg_index x
+			JOIN pg_class c ON c.oid = x.indexrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE x.indrelid = to_regclass($1) AND c.relname = $2`,
+			config.Table,
+			unquoteIdentifier(name),
+		).Scan(&index.Name, &index.Definition, &unique, &backing, &columns)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("Can't recreate index '%s': table '%s' has no such index", name, config.Table)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case backing:
+			return nil, fmt.Errorf("Can't recreate index '%s': it belongs to a constraint of table '%s'", name, config.Table)
+		case unique && arbiter && strings.EqualFold(columns, conflictKey):
+			return nil, fmt.Errorf("Can't recreate index '%s': -conflict %s needs it on column %s", name, config.Conflict, conflictKey)
+		}
+		indexes = append(indexes, index)
+	}
+
+	return indexes, nil
+}
+
+// dropIndexes drops the indexes one by one. When one of them fails
+// those dropped before it are returned to be recreated.
+func dropIndexes(db *sql.DB, indexes []droppedIndex) ([]droppedIndex, error) {
+	for i, index := range indexes {
+		if _, err := db.Exec("DROP INDEX " + index.Name); err != nil {
+			return indexes[:i], fmt.Errorf("Can't drop index %s: %w", index.Name, err)
+		}
+	}
+
+	return indexes, nil
+}
+
+// recreateIndexes creates the dropped indexes again carrying on past failures
+// so that as few of them as possible are missing from the table.
+func recreateIndexes(db *sql.DB, indexes []droppedIndex) error {
+	var errs []error
+	for _, index := range indexes {
+		if _, err := db.Exec(index.Definition); err != nil {
+			logger.Printf("Index %s is MISSING from the table, recreate it with: %s", index.Name, index.Definition)
+			errs = append(errs, fmt.Errorf("Can't recreate index %s: %w", index.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
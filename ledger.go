@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ledgerEntry identifies an input file in the ledger of loaded files.
+type ledgerEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// Hex encoded SHA-256 of the file contents, only computed when asked to
+	Hash sql.NullString
+}
+
+// newLedgerEntry describes the file optionally hashing its contents.
+func newLedgerEntry(path string, hash bool) (*ledgerEntry, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &ledgerEntry{
+		Path: abs,
+		Size: info.Size(),
+		// Postgres keeps timestamps with a microsecond precision
+		ModTime: info.ModTime().UTC().Truncate(time.Microsecond),
+	}
+
+	if hash {
+		sum, err := hashFile(abs)
+		if err != nil {
+			return nil, err
+		}
+		entry.Hash = sql.NullString{String: sum, Valid: true}
+	}
+
+	return entry, nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// loaded checks whether the file has already been recorded in the ledger.
+// A hashed file is looked up by its contents wherever it is and whenever it was modified.
+func (e *ledgerEntry) loaded(db *sql.DB, table string) (bool, error) {
+	var (
+		query string
+		args  []interface{}
+	)
+	if e.Hash.Valid {
+		query = fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE hash = $1)", table)
+		args = []interface{}{e.Hash}
+	} else {
+		query = fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE path = $1 AND size = $2 AND mtime = $3)", table)
+		args = []interface{}{e.Path, e.Size, e.ModTime}
+	}
+
+	var loaded bool
+	err := db.QueryRow(query, args...).Scan(&loaded)
+	if err != nil {
+		return false, fmt.Errorf("Can't check the ledger: %w", err)
+	}
+
+	return loaded, nil
+}
+
+// record adds the file to the ledger.
+func (e *ledgerEntry) record(db *sql.DB, table string) error {
+	_, err := db.Exec(
+		fmt.Sprintf("INSERT INTO %s (path, size, mtime, hash) VALUES ($1, $2, $3, $4)", table),
+		e.Path,
+		e.Size,
+		e.ModTime,
+		e.Hash,
+	)
+	if err != nil {
+		return fmt.Errorf("Can't record the file in the ledger: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// manifest is the content of -manifest-file: what was loaded, where and when.
+type manifest struct {
+	Time  time.Time
+	Table string
+	Files []manifestFile
+	totals
+}
+
+// manifestFile describes an input file, or stdin as -, of the manifest.
+type manifestFile struct {
+	Path string
+	Size int64
+	// Hex encoded SHA-256 of the contents with -manifest-hash
+	SHA256 string `json:",omitempty"`
+}
+
+// digestReader measures, and optionally hashes, stdin as it is read since it can't be read again.
+type digestReader struct {
+	r    io.Reader
+	size int64
+	// nil unless hashing
+	hash hash.Hash
+}
+
+func newDigestReader(r io.Reader, hashing bool) *digestReader {
+	d := &digestReader{r: r}
+	if hashing {
+		d.hash = sha256.New()
+	}
+
+	return d
+}
+
+func (d *digestReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	d.size += int64(n)
+	if d.hash != nil {
+		d.hash.Write(b[:n])
+	}
+
+	return n, err
+}
+
+func (d *digestReader) file() manifestFile {
+	file := manifestFile{Path: "-", Size: d.size}
+	if d.hash != nil {
+		file.SHA256 = hex.EncodeToString(d.hash.Sum(nil))
+	}
+
+	return file
+}
+
+// describeFile stats the input file after it has been loaded and hashes it if asked to,
+// unless the ledger has hashed it already.
+func describeFile(path string, hashing bool, ledger *ledgerEntry) (manifestFile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return manifestFile{}, err
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return manifestFile{}, err
+	}
+
+	file := manifestFile{Path: abs, Size: info.Size()}
+	if hashing {
+		if ledger != nil && ledger.Path == abs && ledger.Hash.Valid {
+			file.SHA256 = ledger.Hash.String
+		} else if file.SHA256, err = hashFile(abs); err != nil {
+			return manifestFile{}, err
+		}
+	}
+
+	return file, nil
+}
+
+// readFiles returns the input files of the load that were read, leaving out the ones
+// the ledger skipped as loaded before, which it knows by their absolute paths.
+func readFiles(inputs []string, skipped []string) []string {
+	var read []string
+	for _, path := range inputs {
+		abs, err := filepath.Abs(path)
+		if err == nil && slices.Contains(skipped, abs) {
+			continue
+		}
+		read = append(read, path)
+	}
+
+	return read
+}
+
+// writeManifest saves the manifest in JSON to a file creating its parent directories if needed.
+func writeManifest(path string, manifest manifest) error {
+	json, _ := json.MarshalIndent(manifest, "", "   ")
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(json, '\n'), 0644)
+}
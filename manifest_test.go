@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadFiles(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.csv"), filepath.Join(dir, "b.csv")
+
+	tests := []struct {
+		name    string
+		inputs  []string
+		skipped []string
+		want    []string
+	}{
+		{"all read", []string{a, b}, nil, []string{a, b}},
+		{"skipped by the ledger", []string{a, b}, []string{a}, []string{b}},
+		{"all skipped", []string{a}, []string{a}, nil},
+		{"stdin", nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readFiles(tt.inputs, tt.skipped); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// A relative path is skipped by its absolute one
+	t.Chdir(dir)
+	if got := readFiles([]string{"a.csv", "b.csv"}, []string{a}); !reflect.DeepEqual(got, []string{"b.csv"}) {
+		t.Errorf("got %q, want b.csv", got)
+	}
+}
+
+func TestDescribeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.csv")
+	if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := describeFile(path, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := manifestFile{Path: path, Size: 3, SHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}
+	if file != want {
+		t.Errorf("got %+v, want %+v", file, want)
+	}
+
+	// The hash of the ledger is taken as it is
+	ledger := &ledgerEntry{Path: path}
+	ledger.Hash.String, ledger.Hash.Valid = "cached", true
+	if file, err := describeFile(path, true, ledger); err != nil || file.SHA256 != "cached" {
+		t.Errorf("got %+v, %v, want the hash of the ledger", file, err)
+	}
+}
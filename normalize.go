@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Unicode normalization forms of -normalize
+const (
+	normalizeNFC = "nfc"
+	normalizeNFD = "nfd"
+)
+
+// What an empty value of a json or jsonb column is loaded as with -json-empty-null or -json-empty-object
+const (
+	jsonEmptyNull   = "null"
+	jsonEmptyObject = "object"
+)
+
+// columnNames is a repeatable flag of column names. Each value may list several comma separated names.
+type columnNames []string
+
+func (c *columnNames) String() string {
+	if c == nil {
+		return ""
+	}
+
+	return strings.Join(*c, ",")
+}
+
+func (c *columnNames) Set(s string) error {
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("empty column name in '%s'", s)
+		}
+		*c = append(*c, name)
+	}
+
+	return nil
+}
+
+// normalizer fixes up a field value that Postgres can't cast to the column type as is.
+type normalizer struct {
+	Column    string
+	Index     int
+	Kind      string
+	Normalize func(string) (string, bool)
+}
+
+// buildNormalizers resolves the -normalize, -as-int and -as-bool columns and,
+// once the column types are known, the json columns of -json-empty-null to field positions.
+func buildNormalizers(config config) ([]normalizer, error) {
+	var normalizers []normalizer
+
+	// Unicode normalization comes first so that the fix-ups see the normalized text
+	if config.Normalize != "" {
+		form, err := normalizationForm(config.Normalize)
+		if err != nil {
+			return nil, err
+		}
+
+		columns := []string(config.NormalizeCols)
+		if len(columns) == 0 {
+			columns = config.Columns
+		}
+		kind := strings.ToUpper(config.Normalize)
+		for _, column := range columns {
+			index := columnIndex(config.Columns, column)
+			if index < 0 {
+				return nil, fmt.Errorf("Can't normalize column '%s' to %s: it is not loaded", column, kind)
+			}
+			normalizers = append(normalizers, normalizer{column, index, kind, func(value string) (string, bool) {
+				return form.String(value), true
+			}})
+		}
+	}
+
+	kinds := []struct {
+		kind      string
+		columns   columnNames
+		normalize func(string) (string, bool)
+	}{
+		{"integer", config.AsInt, normalizeInt},
+		{"boolean", config.AsBool, normalizeBool},
+	}
+	for _, kind := range kinds {
+		for _, column := range kind.columns {
+			index := columnIndex(config.Columns, column)
+			if index < 0 {
+				return nil, fmt.Errorf("Can't normalize column '%s' as %s: it is not loaded", column, kind.kind)
+			}
+			normalizers = append(normalizers, normalizer{column, index, kind.kind, kind.normalize})
+		}
+	}
+
+	if config.JSONEmpty != "" {
+		empty := nullValue
+		if config.JSONEmpty == jsonEmptyObject {
+			empty = "{}"
+		}
+		for i, column := range config.Columns {
+			switch config.ColumnTypes[strings.ToLower(column)] {
+			case "json", "jsonb":
+				normalizers = append(normalizers, normalizer{column, i, "json", func(value string) (string, bool) {
+					if strings.TrimSpace(value) == "" {
+						return empty, true
+					}
+					return value, true
+				}})
+			}
+		}
+	}
+
+	return normalizers, nil
+}
+
+// normalize applies normalizers to the record in place.
+func normalize(record []string, normalizers []normalizer, line int) error {
+	for _, n := range normalizers {
+		value := record[n.Index]
+		if value == nullValue {
+			continue
+		}
+
+		normalized, ok := n.Normalize(value)
+		if !ok {
+			return &normalizeError{Column: n.Column, Kind: n.Kind, Value: value, Line: line}
+		}
+		record[n.Index] = normalized
+	}
+
+	return nil
+}
+
+// normalizationForm maps the -normalize value to the Unicode normalization form.
+func normalizationForm(name string) (norm.Form, error) {
+	switch name {
+	case normalizeNFC:
+		return norm.NFC, nil
+	case normalizeNFD:
+		return norm.NFD, nil
+	}
+
+	return 0, fmt.Errorf("Invalid -normalize form '%s', expected %s or %s", name, normalizeNFC, normalizeNFD)
+}
+
+// unicodeNormalizer returns the function -normalize applies to the column
+// or nil if the column is left as it is.
+func unicodeNormalizer(config config, column string) func(string) string {
+	if config.Normalize == "" {
+		return nil
+	}
+	if len(config.NormalizeCols) > 0 && columnIndex(config.NormalizeCols, column) < 0 {
+		return nil
+	}
+
+	form, err := normalizationForm(config.Normalize)
+	if err != nil {
+		return nil
+	}
+
+	return form.String
+}
+
+// normalizeInt strips a zero fractional part e.g. 12.0 becomes 12.
+func normalizeInt(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		if strings.Trim(value[i+1:], "0") != "" {
+			return value, false
+		}
+		value = value[:i]
+	}
+
+	digits := strings.TrimPrefix(strings.TrimPrefix(value, "-"), "+")
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return value, false
+	}
+
+	return value, true
+}
+
+// normalizeBool maps the common spellings of booleans to true and false.
+func normalizeBool(value string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "t", "true", "y", "yes", "1":
+		return "true", true
+	case "f", "false", "n", "no", "0":
+		return "false", true
+	}
+
+	return value, false
+}
+
+// normalizeError reports a value -as-int or -as-bool can't convert.
+type normalizeError struct {
+	Column string
+	Kind   string
+	Value  string
+	Line   int
+}
+
+func (e *normalizeError) Error() string {
+	return fmt.Sprintf("Can't normalize value '%s' of column '%s' in the record on line %d to %s", e.Value, e.Column, e.Line, e.Kind)
+}
+
+// missingError reports a required column without a value.
+type missingError struct {
+	Column string
+	Line   int
+}
+
+func (e *missingError) Error() string {
+	return fmt.Sprintf("Required column '%s' is empty in the record on line %d", e.Column, e.Line)
+}
+
+// requiredIndexes resolves the -required columns to field positions.
+func requiredIndexes(config config) ([]int, error) {
+	indexes := make([]int, len(config.Required))
+	for i, column := range config.Required {
+		indexes[i] = columnIndex(config.Columns, column)
+		if indexes[i] < 0 {
+			return nil, fmt.Errorf("Can't require column '%s': it is not loaded", column)
+		}
+	}
+
+	return indexes, nil
+}
+
+// missing returns the first of the required fields that is empty or NULL.
+func missing(record []string, indexes []int) (int, bool) {
+	for _, index := range indexes {
+		if record[index] == "" || record[index] == nullValue {
+			return index, true
+		}
+	}
+
+	return 0, false
+}
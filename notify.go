@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// When -notify-url is notified
+const (
+	notifySuccess = "success"
+	notifyFailure = "failure"
+	notifyAlways  = "always"
+)
+
+// notifyTimeout caps how long posting the totals may delay the exit.
+const notifyTimeout = 10 * time.Second
+
+// notification is the payload posted to -notify-url: the totals along with the exit status.
+type notification struct {
+	totals
+	ExitStatus int
+}
+
+// notify posts the totals to the URL as JSON if the outcome of the load calls for it.
+// A load that affected nothing under -fail-if-zero-affected is a success with a non-zero exit status.
+func notify(url, on string, totals *totals, status int) error {
+	failed := totals.Error != nil
+	if (on == notifySuccess && failed) || (on == notifyFailure && !failed) {
+		return nil
+	}
+
+	payload := notification{totals: *totals, ExitStatus: status}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: notifyTimeout}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", response.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	succeeded := &totals{Records: ingestResult{Processed: 3, Affected: 2}}
+	failed := &totals{Error: newLoadError(&csv.ParseError{StartLine: 2, Line: 2, Err: csv.ErrFieldCount})}
+
+	tests := []struct {
+		name   string
+		on     string
+		totals *totals
+		status int
+		posted bool
+	}{
+		{"success on success", notifySuccess, succeeded, 0, true},
+		{"success on failure", notifySuccess, failed, 1, false},
+		{"failure on success", notifyFailure, succeeded, 0, false},
+		{"failure on failure", notifyFailure, failed, 1, true},
+		{"always on success", notifyAlways, succeeded, 0, true},
+		{"always on failure", notifyAlways, failed, 1, true},
+		// Nothing affected under -fail-if-zero-affected is still a success
+		{"success on zero affected", notifySuccess, &totals{}, 3, true},
+		{"failure on zero affected", notifyFailure, &totals{}, 3, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				posted  bool
+				payload map[string]any
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				posted = true
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("got %s with %s, want a POST of JSON", r.Method, r.Header.Get("Content-Type"))
+				}
+				body, _ := io.ReadAll(r.Body)
+				if err := json.Unmarshal(body, &payload); err != nil {
+					t.Errorf("got %s, want JSON: %v", body, err)
+				}
+			}))
+			defer server.Close()
+
+			if err := notify(server.URL, tt.on, tt.totals, tt.status); err != nil {
+				t.Fatal(err)
+			}
+			if posted != tt.posted {
+				t.Fatalf("got posted %v, want %v", posted, tt.posted)
+			}
+			if !posted {
+				return
+			}
+
+			if status := payload["ExitStatus"]; status != float64(tt.status) {
+				t.Errorf("got ExitStatus %v, want %d", status, tt.status)
+			}
+			// The totals are inlined next to the exit status
+			if _, ok := payload["Records"]; !ok {
+				t.Errorf("got %v, want the totals", payload)
+			}
+			loadErr, _ := payload["Error"].(map[string]any)
+			switch {
+			case tt.totals.Error == nil && loadErr != nil:
+				t.Errorf("got error %v, want none", loadErr)
+			case tt.totals.Error != nil && (loadErr == nil || loadErr["Category"] != categoryParse):
+				t.Errorf("got error %v, want one categorized as %s", loadErr, categoryParse)
+			}
+		})
+	}
+}
+
+func TestNotifyResponseStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	err := notify(server.URL, notifyAlways, &totals{}, 0)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, want the status of the response", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// createOutput creates the file gzip compressing what is written to it if its name ends in .gz.
+func createOutput(path string) (io.WriteCloser, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+
+	return &gzipFile{gzip.NewWriter(file), file}, nil
+}
+
+// gzipFile closes the file once the compressed stream has been finished.
+type gzipFile struct {
+	*gzip.Writer
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Writer.Close()
+	if closeErr := g.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// csvLog writes lines to a CSV file that is created, along with its header, on the first write.
+type csvLog struct {
+	// What the file is called in errors
+	name   string
+	path   string
+	header []string
+
+	mu     sync.Mutex
+	out    io.WriteCloser
+	w      *csv.Writer
+	closed bool
+}
+
+func (l *csvLog) write(line []string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	if l.out == nil {
+		out, err := createOutput(l.path)
+		if err != nil {
+			return fmt.Errorf("Can't create %s '%s': %w", l.name, l.path, err)
+		}
+		l.out = out
+		l.w = csv.NewWriter(out)
+		if err := l.w.Write(l.header); err != nil {
+			return err
+		}
+	}
+
+	return l.w.Write(line)
+}
+
+func (l *csvLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	if l.out == nil {
+		return nil
+	}
+	l.w.Flush()
+	if err := l.w.Error(); err != nil {
+		l.out.Close()
+		return err
+	}
+
+	return l.out.Close()
+}
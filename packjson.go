@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// What -pack-json makes of the NULL fields of a record
+const (
+	packNullsNull = "null"
+	packNullsOmit = "omit"
+)
+
+// jsonPacker packs the fields of a record into a single JSON object
+// keyed by the names of the columns of the header, all of the values strings.
+type jsonPacker struct {
+	// The keys in the order of the fields, already encoded
+	keys       []string
+	omitNulls  bool
+	nullEscape string
+}
+
+func newJSONPacker(columns []string, nulls string, nullEscape string) (*jsonPacker, error) {
+	if nulls != packNullsNull && nulls != packNullsOmit {
+		return nil, fmt.Errorf("Invalid -pack-json-nulls '%s', expected %s or %s", nulls, packNullsNull, packNullsOmit)
+	}
+
+	keys := make([]string, len(columns))
+	for i, column := range columns {
+		key, err := json.Marshal(unquoteIdentifier(column))
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = string(key)
+	}
+
+	return &jsonPacker{keys: keys, omitNulls: nulls == packNullsOmit, nullEscape: nullEscape}, nil
+}
+
+// pack returns the record as a single field holding the JSON object of its fields.
+// The null value is a JSON null or left out, an escaped one is the literal string.
+func (p *jsonPacker) pack(record []string) ([]string, error) {
+	// Without a header in the input the number of fields isn't checked by the reader
+	if len(record) != len(p.keys) {
+		return nil, fmt.Errorf("%d fields to pack, expected one for each of the %d keys of the header", len(record), len(p.keys))
+	}
+
+	var packed strings.Builder
+	packed.WriteByte('{')
+	for i, field := range record {
+		value, ok := nullify(field, p.nullEscape).(string)
+		if !ok && p.omitNulls {
+			continue
+		}
+		if packed.Len() > 1 {
+			packed.WriteByte(',')
+		}
+		packed.WriteString(p.keys[i])
+		packed.WriteByte(':')
+		if !ok {
+			packed.WriteString("null")
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		packed.Write(encoded)
+	}
+	packed.WriteByte('}')
+
+	return []string{packed.String()}, nil
+}
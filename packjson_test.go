@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSONPacker(t *testing.T) {
+	tests := []struct {
+		name   string
+		nulls  string
+		record []string
+		want   string
+	}{
+		{"values", packNullsNull, []string{"g1", `say "hi"`, ""}, `{"marketoguid":"g1","LeadId":"say \"hi\"","note":""}`},
+		{"null", packNullsNull, []string{"g1", "null", "x"}, `{"marketoguid":"g1","LeadId":null,"note":"x"}`},
+		{"omit", packNullsOmit, []string{"g1", "null", "x"}, `{"marketoguid":"g1","note":"x"}`},
+		{"omit first", packNullsOmit, []string{"null", "1", "null"}, `{"LeadId":"1"}`},
+		{"omit all", packNullsOmit, []string{"null", "null", "null"}, `{}`},
+		{"escaped null", packNullsOmit, []string{"g1", `\null`, `\\null`}, `{"marketoguid":"g1","LeadId":"null","note":"\\null"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packer, err := newJSONPacker([]string{"marketoGUID", `"LeadId"`, "note"}, tt.nulls, `\`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := packer.pack(tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, []string{tt.want}) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONPackerFieldCount(t *testing.T) {
+	packer, err := newJSONPacker([]string{"a", "b"}, packNullsNull, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, record := range [][]string{{"1"}, {"1", "2", "3"}} {
+		if _, err := packer.pack(record); err == nil {
+			t.Errorf("pack(%q) packed a record of %d fields for 2 keys", record, len(record))
+		}
+	}
+}
+
+func TestJSONPackerDuplicateKeys(t *testing.T) {
+	packer, err := newJSONPacker([]string{"a", "A", `"A"`}, packNullsNull, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed, err := packer.pack([]string{"1", "2", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"a":"1","a":"2","A":"3"}`
+	if packed[0] != want {
+		t.Errorf("got %s, want %s", packed[0], want)
+	}
+	// Like jsonb the key that is there twice keeps the last value
+	var object map[string]string
+	if err := json.Unmarshal([]byte(packed[0]), &object); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(object, map[string]string{"a": "2", "A": "3"}) {
+		t.Errorf("got %v, want the last value of a", object)
+	}
+}
+
+func TestNewJSONPackerNulls(t *testing.T) {
+	if _, err := newJSONPacker([]string{"a"}, "skip", ""); err == nil {
+		t.Error("newJSONPacker accepted -pack-json-nulls skip")
+	}
+}
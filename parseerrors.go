@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// lineRecorder keeps the raw lines the CSV reader consumes so that the lines
+// of a malformed record can be written out exactly as they were in the input.
+type lineRecorder struct {
+	r io.Reader
+	// Number of the first kept line
+	first   int
+	lines   [][]byte
+	partial []byte
+}
+
+func newLineRecorder(r io.Reader) *lineRecorder {
+	return &lineRecorder{r: r, first: 1}
+}
+
+func (l *lineRecorder) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+
+	data := p[:n]
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			l.partial = append(l.partial, data...)
+			break
+		}
+		line := append(l.partial, data[:i+1]...)
+		l.lines = append(l.lines, line)
+		l.partial = nil
+		data = data[i+1:]
+	}
+
+	// The last line doesn't have to end with a newline
+	if err == io.EOF && len(l.partial) > 0 {
+		l.lines = append(l.lines, l.partial)
+		l.partial = nil
+	}
+
+	return n, err
+}
+
+// discard forgets the lines before the given line.
+func (l *lineRecorder) discard(line int) {
+	n := line - l.first
+	if n <= 0 {
+		return
+	}
+	if n > len(l.lines) {
+		n = len(l.lines)
+	}
+
+	l.lines = l.lines[n:]
+	l.first += n
+}
+
+// raw returns the kept lines from start to end inclusive.
+func (l *lineRecorder) raw(start, end int) []byte {
+	var raw []byte
+	for line := start; line <= end; line++ {
+		i := line - l.first
+		if i < 0 || i >= len(l.lines) {
+			continue
+		}
+		raw = append(raw, l.lines[i]...)
+	}
+
+	return raw
+}
+
+// parseErrorLog writes the raw lines of the records that fail to parse
+// to a file and lets the load go on without them. The file is created
+// when the first record fails.
+type parseErrorLog struct {
+	recorder *lineRecorder
+	path     string
+
+	mu     sync.Mutex
+	out    io.WriteCloser
+	w      *bufio.Writer
+	count  int
+	closed bool
+}
+
+func newParseErrorLog(path string, recorder *lineRecorder) *parseErrorLog {
+	return &parseErrorLog{recorder: recorder, path: path}
+}
+
+// follow makes the log take the raw lines of the next input from the recorder.
+// The lines that fail to parse go on into the same file.
+func (p *parseErrorLog) follow(recorder *lineRecorder) *parseErrorLog {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.recorder = recorder
+
+	return p
+}
+
+// advance lets go of the lines that precede the record the reader has just returned.
+func (p *parseErrorLog) advance(reader *csv.Reader) {
+	if p == nil {
+		return
+	}
+
+	line, _ := reader.FieldPos(0)
+	p.recorder.discard(line)
+}
+
+// write writes out the lines of the record that failed to parse.
+func (p *parseErrorLog) write(err *csv.ParseError, record []string) error {
+	p.recorder.discard(err.StartLine)
+
+	// A record with a wrong number of fields is reported at the line it starts on
+	// even if it spans several lines, so count the lines its fields span.
+	end := err.Line
+	if err.Err == csv.ErrFieldCount {
+		end = err.StartLine
+		for _, field := range record {
+			end += strings.Count(field, "\n")
+		}
+	}
+
+	return p.writeLines(err.StartLine, end)
+}
+
+// reject writes out the lines of the record the reader has just returned
+// when it is parsed fine but can't be loaded.
+func (p *parseErrorLog) reject(reader *csv.Reader, record []string) error {
+	start, _ := reader.FieldPos(0)
+	end, _ := reader.FieldPos(len(record) - 1)
+	end += strings.Count(record[len(record)-1], "\n")
+
+	return p.writeLines(start, end)
+}
+
+func (p *parseErrorLog) writeLines(start, end int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.count++
+	if p.closed {
+		return nil
+	}
+
+	if p.out == nil {
+		out, err := createOutput(p.path)
+		if err != nil {
+			return fmt.Errorf("Can't create parse error file '%s': %w", p.path, err)
+		}
+		p.out = out
+		p.w = bufio.NewWriter(out)
+	}
+
+	_, err := p.w.Write(p.recorder.raw(start, end))
+
+	return err
+}
+
+// errors returns the number of records that failed to parse so far.
+func (p *parseErrorLog) errors() int {
+	if p == nil {
+		return 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.count
+}
+
+func (p *parseErrorLog) close() error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	if p.out == nil {
+		return nil
+	}
+	if err := p.w.Flush(); err != nil {
+		p.out.Close()
+		return err
+	}
+
+	return p.out.Close()
+}
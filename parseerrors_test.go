@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLineRecorder(t *testing.T) {
+	// Read a byte at a time so that every line arrives in pieces
+	recorder := newLineRecorder(iotest.OneByteReader(strings.NewReader("a,1\nb,2\r\n\nc,3")))
+	if _, err := io.ReadAll(recorder); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		start, end int
+		want       string
+	}{
+		{1, 1, "a,1\n"},
+		{2, 3, "b,2\r\n\n"},
+		// The last line without a newline
+		{4, 4, "c,3"},
+		{1, 4, "a,1\nb,2\r\n\nc,3"},
+		{3, 9, "\nc,3"},
+		{5, 6, ""},
+	}
+	for _, tt := range tests {
+		if got := string(recorder.raw(tt.start, tt.end)); got != tt.want {
+			t.Errorf("raw(%d, %d) = %q, want %q", tt.start, tt.end, got, tt.want)
+		}
+	}
+
+	// The lines before the given one are gone, the rest keep their numbers
+	recorder.discard(3)
+	recorder.discard(2)
+	if got := string(recorder.raw(1, 4)); got != "\nc,3" {
+		t.Errorf("got %q after discarding, want the lines from 3 on", got)
+	}
+	recorder.discard(10)
+	if got := string(recorder.raw(1, 10)); got != "" {
+		t.Errorf("got %q after discarding all, want none", got)
+	}
+}
+
+func TestParseErrorLog(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		count int
+	}{
+		{"stray quote", "g1,1\ng\"2,2\ng3,3\n", "g\"2,2\n", 1},
+		{"field count", "g1,1\ng2,2,x\ng3,3\n", "g2,2,x\n", 1},
+		{"multi-line field count", "g1,1\n\"g\n2\",2,\"x\ny\"\ng3,3\n", "\"g\n2\",2,\"x\ny\"\n", 1},
+		{"multi-line quote", "g1,1\n\"g\n2\"x,2\ng3,3\n", "\"g\n2\"x,2\n", 1},
+		{"without a newline", "g1,1\ng2", "g2", 1},
+		{"several", "g1,1\ng2\n\"g\n3\",3,3\ng4,4\ng\"5,5\n", "g2\n\"g\n3\",3,3\ng\"5,5\n", 3},
+		{"none", "g1,1\n\"g\n2\",2\n", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "parse-errors.csv")
+			// A buffer smaller than the records
+			reader, parseErrors, err := newReader(bufio.NewReader(strings.NewReader(tt.input)), readerOptions{BufferSize: 16, ParseErrorFile: path})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := testConfig()
+			config.ParseErrors = parseErrors
+			records := make(chan inputRecord, 10)
+			if err := forward(nil, reader, config, records); err != nil {
+				t.Fatal(err)
+			}
+			close(records)
+			if err := parseErrors.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(path)
+			if tt.count == 0 {
+				if !os.IsNotExist(err) {
+					t.Errorf("got parse error file %q, want none", got)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want || parseErrors.errors() != tt.count {
+				t.Errorf("got %d parse errors %q, want %d %q", parseErrors.errors(), got, tt.count, tt.want)
+			}
+			// The records around them are loaded
+			loaded := 0
+			for range records {
+				loaded++
+			}
+			if want := strings.Count(tt.input, "g") - strings.Count(tt.want, "g"); loaded != want {
+				t.Errorf("got %d records loaded, want %d", loaded, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// partitionLayouts are the timestamp formats a partition key value is parsed with.
+var partitionLayouts = []string{
+	"2006-01-02T15:04:05Z0700",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05Z07",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// partitionName formats the partition template with the value of the partition key.
+// %Y, %m, %d and %H are replaced with the year, month, day and hour of the value parsed
+// as a timestamp, %s with the value as is and %% with a percent sign. It reports false
+// if the value doesn't fit the template, so that the record goes to the parent table.
+func partitionName(template, value string) (string, bool) {
+	var (
+		timestamp time.Time
+		parsed    bool
+	)
+	if strings.Contains(template, "%Y") || strings.Contains(template, "%m") ||
+		strings.Contains(template, "%d") || strings.Contains(template, "%H") {
+		for _, layout := range partitionLayouts {
+			t, err := time.Parse(layout, value)
+			if err == nil {
+				// Keep the wall clock time as written, the same way a
+				// timestamp without time zone column would store it
+				timestamp, parsed = t, true
+				break
+			}
+		}
+	}
+
+	var name strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' || i == len(template)-1 {
+			name.WriteByte(template[i])
+			continue
+		}
+
+		i++
+		switch template[i] {
+		case 'Y', 'm', 'd', 'H':
+			if !parsed {
+				return "", false
+			}
+			name.WriteString(timestamp.Format(map[byte]string{'Y': "2006", 'm': "01", 'd': "02", 'H': "15"}[template[i]]))
+		case 's':
+			if value == "" || strings.Trim(strings.ToLower(value), "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+				return "", false
+			}
+			name.WriteString(value)
+		case '%':
+			name.WriteByte('%')
+		default:
+			name.WriteByte('%')
+			name.WriteByte(template[i])
+		}
+	}
+
+	return name.String(), true
+}
+
+// partitionExists tells whether the partition has been created.
+func partitionExists(tx *sql.Tx, partition string) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, partition).Scan(&exists)
+
+	return exists, err
+}
+
+// partitionTemplate qualifies the template with the schema of the table unless it has one.
+func partitionTemplate(table, template string) string {
+	if strings.Contains(template, ".") {
+		return template
+	}
+	if i := strings.Index(table, "."); i >= 0 {
+		return table[:i+1] + template
+	}
+
+	return template
+}
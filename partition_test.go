@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPartitionName(t *testing.T) {
+	tests := []struct {
+		template string
+		value    string
+		want     string
+		wantOk   bool
+	}{
+		{"activities_%Y%m", "2024-03-05", "activities_202403", true},
+		{"activities_%Y%m%d", "2024-03-05 10:20:30", "activities_20240305", true},
+		{"activities_%Y%m%d%H", "2024-03-05T10:20:30Z", "activities_2024030510", true},
+		{"activities_%Y%m%d%H", "2024-03-05T10:20:30.123456+02:00", "activities_2024030510", true},
+		{"activities_%Y%m%d%H", "2024-03-05T10:20:30+0200", "activities_2024030510", true},
+		{"activities_%Y%m%d%H", "2024-03-05 10:20:30+02", "activities_2024030510", true},
+		// The wall clock time as written, not the one in UTC
+		{"activities_%Y%m%d%H", "2024-03-05 23:30:00-05:00", "activities_2024030523", true},
+		{"activities_%Y%m", "03/05/2024", "", false},
+		{"activities_%Y%m", "", "", false},
+
+		{"activities_%s", "us_east", "activities_us_east", true},
+		{"activities_%s", "US1", "activities_US1", true},
+		{"activities_%s", "", "", false},
+		{"activities_%s", "us-east", "", false},
+		{"activities_%s", "x; DROP TABLE t", "", false},
+		{"activities_%s", "a.b", "", false},
+
+		{"activities_%%_%s", "a", "activities_%_a", true},
+		{"activities_%q", "a", "activities_%q", true},
+		{"activities_%", "a", "activities_%", true},
+		{"activities", "a", "activities", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template+" "+tt.value, func(t *testing.T) {
+			got, ok := partitionName(tt.template, tt.value)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("got %q %v, want %q %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestPartitionTemplate(t *testing.T) {
+	tests := []struct {
+		table    string
+		template string
+		want     string
+	}{
+		{"activities", "activities_%Y%m", "activities_%Y%m"},
+		{"marketo.activities", "activities_%Y%m", "marketo.activities_%Y%m"},
+		{"marketo.activities", "archive.activities_%Y%m", "archive.activities_%Y%m"},
+	}
+
+	for _, tt := range tests {
+		if got := partitionTemplate(tt.table, tt.template); got != tt.want {
+			t.Errorf("partitionTemplate(%q, %q) = %q, want %q", tt.table, tt.template, got, tt.want)
+		}
+	}
+}
+
+var insertTablePattern = regexp.MustCompile(`INSERT INTO (\S+)`)
+
+func TestIngestMissingPartition(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "to_regclass") {
+			return []string{"exists"}, [][]driver.Value{{args[0] == "t_1"}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	config := testConfig()
+	config.PartitionBy = "leadid"
+	config.PartitionTemplate = "t_%s"
+	config.InsertSize = 1
+
+	records := make(chan inputRecord, 5)
+	records <- inputRecord{line: 1, fields: []string{"g1", "1"}}
+	records <- inputRecord{line: 2, fields: []string{"g2", "2"}}
+	records <- inputRecord{line: 3, fields: []string{"g3", "1"}}
+	records <- inputRecord{line: 4, fields: []string{"g4", "2"}}
+	records <- inputRecord{line: 5, fields: []string{"g5", "-"}}
+	close(records)
+
+	result, err := ingest(db, config, 1, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tables []string
+	for _, insert := range fake.inserts() {
+		tables = append(tables, insertTablePattern.FindStringSubmatch(insert.Query)[1])
+	}
+	slices.Sort(tables)
+	// The missing partition and the value that isn't a name go to the table itself
+	if want := []string{"t", "t", "t", "t_1", "t_1"}; !slices.Equal(tables, want) {
+		t.Errorf("got inserts into %v, want %v", tables, want)
+	}
+	if result.Partitions["t_1"] != 2 || result.Partitions["t"] != 3 {
+		t.Errorf("got partitions %v, want 2 affected in t_1 and 3 in t", result.Partitions)
+	}
+
+	// Every partition is looked up once
+	var lookups []driver.Value
+	for _, statement := range fake.statements {
+		if strings.Contains(statement.Query, "to_regclass") {
+			lookups = append(lookups, statement.Args[0])
+		}
+	}
+	if want := []driver.Value{"t_1", "t_2"}; !slices.Equal(lookups, want) {
+		t.Errorf("got lookups %v, want %v", lookups, want)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"encoding/json"
@@ -12,358 +13,3670 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	_ "github.com/lib/pq"
+	"golang.org/x/text/encoding"
+	"golang.org/x/time/rate"
 )
 
-const fieldCount int = 8
+// defaultColumns lists the columns of the Marketo activities table
+// in the order they appear in the activity feed.
+var defaultColumns = []string{
+	"marketoguid",
+	"leadid",
+	"activitydate",
+	"activitytypeid",
+	"campaignid",
+	"primaryattributevalueid",
+	"primaryattributevalue",
+	"attributes",
+}
+
+// conflictKey is the column of the unique index that detects duplicate records.
+const conflictKey = "marketoguid"
+
+// importIdColumn is the column that stores the import id.
+const importIdColumn = "importid"
+
+// defaultReadBuffer is the size of the input read buffer unless -read-buffer sets it.
+const defaultReadBuffer = 64 * 1024
 
 var logger = log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
 
-func read(done <-chan struct{}, reader *csv.Reader, config config) (<-chan []string, <-chan error) {
-	records := make(chan []string, config.Workers)
-	errc := make(chan error, 1)
+// throttle is the value of the -rate flag. It holds either a number of
+// records or, when Bytes is set, a number of bytes per second.
+type throttle struct {
+	Limit int
+	Bytes bool
+}
 
-	go func() {
-		// Close records channel after reading is finished
-		defer close(records)
+var byteUnits = []struct {
+	suffix string
+	size   int
+}{
+	{"GB", 1024 * 1024 * 1024},
+	{"MB", 1024 * 1024},
+	{"KB", 1024},
+	{"B", 1},
+}
 
-		for {
-			record, err := reader.Read()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				errc <- err
-				break
-			}
+func (t *throttle) String() string {
+	if t.Bytes {
+		return fmt.Sprintf("%dB", t.Limit)
+	}
 
-			select {
-			case records <- record:
-			case <-done:
-				errc <- errors.New("Cancelled")
-			}
+	return strconv.Itoa(t.Limit)
+}
+
+func (t *throttle) Set(s string) error {
+	value := strings.ToUpper(strings.TrimSpace(s))
+
+	size := 1
+	bytes := false
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			size = unit.size
+			bytes = true
+			break
 		}
-		errc <- nil
-	}()
+	}
 
-	return records, errc
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return fmt.Errorf("invalid rate '%s'", s)
+	}
+
+	t.Limit = limit * size
+	t.Bytes = bytes
+
+	return nil
 }
 
-func nullify(value string) interface{} {
-	if value == "null" {
-		return sql.NullString{}
+// newLimiter returns a limiter for the configured rate
+// or nil if the rate is unlimited.
+func newLimiter(config config) *rate.Limiter {
+	if config.Rate.Limit <= 0 {
+		return nil
 	}
 
-	return value
+	// By default allow a burst of up to one second worth of records or bytes
+	burst := config.RateBurst
+	if burst <= 0 {
+		burst = config.Rate.Limit
+	}
+
+	return rate.NewLimiter(rate.Limit(config.Rate.Limit), burst)
 }
 
-func nullifyImportId(importId int) interface{} {
-	if importId == 0 {
-		return sql.NullString{}
+// recordSize approximates the number of bytes a record occupied in the input.
+func recordSize(record []string) int {
+	size := 0
+	for _, value := range record {
+		size += len(value) + 1
 	}
 
-	return importId
+	return size
 }
 
-type ingestResult struct {
-	Processed int
-	Affected  int
+// rowSizeError reports a record larger than -max-row-bytes.
+type rowSizeError struct {
+	Line int
+	Size int
+	Max  int
 }
 
-func buildQuery(table string, n int) string {
-	SQL :=
-		`WITH inserted AS (
-		INSERT INTO %s (
-			marketoguid, 
-			leadid, 
-			activitydate, 
-			activitytypeid,
-			campaignid, 
-			primaryattributevalueid, 
-			primaryattributevalue, 
-			attributes
-		) VALUES %s
-		ON CONFLICT (marketoguid) DO NOTHING
-		RETURNING 1
-	)
-	SELECT COUNT(*) FROM inserted`
+func (e *rowSizeError) Error() string {
+	return fmt.Sprintf("Record on line %d is %d bytes, more than the limit of %d", e.Line, e.Size, e.Max)
+}
 
-	v := make([]string, n)
-	p := make([]string, fieldCount)
-	m := 0
-	for i := 0; i < n; i++ {
-		for j := 0; j < fieldCount; j++ {
-			m++
-			p[j] = fmt.Sprintf("$%d", m)
+// fieldCountError reports a record with a different number of fields than the columns.
+type fieldCountError struct {
+	Line    int
+	Fields  int
+	Columns int
+}
+
+func (e *fieldCountError) Error() string {
+	return fmt.Sprintf("Record on line %d has %d fields for %d columns", e.Line, e.Fields, e.Columns)
+}
+
+// wait blocks until the limiter allows n more events to happen.
+// It returns false if the wait has been cancelled.
+func wait(done <-chan struct{}, limiter *rate.Limiter, n int) bool {
+	for n > 0 {
+		// A reservation can't exceed the burst size so take it in chunks
+		chunk := n
+		if chunk > limiter.Burst() {
+			chunk = limiter.Burst()
 		}
-		v[i] = fmt.Sprintf("(%s)", strings.Join(p, ","))
+
+		reservation := limiter.ReserveN(time.Now(), chunk)
+		if delay := reservation.Delay(); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-done:
+				timer.Stop()
+				reservation.Cancel()
+				return false
+			}
+		}
+		n -= chunk
 	}
 
-	return fmt.Sprintf(SQL, table, strings.Join(v, ","))
+	return true
 }
 
-func ingest(db *sql.DB, config config, done <-chan struct{}, records <-chan []string, results chan<- ingestResult) {
-	txCount := 0
-	inCount := 0
-	inAffected := 0
-	processed := 0
-	affected := 0
-	importId := nullifyImportId(config.ImportId)
+// inputRecord is a record along with the line of the input it starts on.
+type inputRecord struct {
+	line   int
+	fields []string
+	// Why the record is to be rejected instead of being loaded, if it is
+	reject error
+	// Number of the batch of the input -preserve-order dealt the record in
+	turn int
+}
 
-	bindings := make([]interface{}, config.InsertSize*fieldCount)
+func read(done <-chan struct{}, reader *csv.Reader, config config) (<-chan inputRecord, <-chan error) {
+	records := make(chan inputRecord, config.Workers)
+	errc := make(chan error, 1)
 
-	// Build the query that will be used in a loop
-	query := buildQuery(config.Table, config.InsertSize)
-	// Open a transaction and prepare the statement
-	tx, err := db.Begin()
-	stmt, err := tx.Prepare(query)
-	if err != nil {
-		logger.Fatal(err)
+	go func() {
+		// Close records channel after reading is finished
+		defer close(records)
+
+		// Every way out of the reading loop yields exactly one terminal value
+		if config.Benchmark != nil {
+			errc <- config.Benchmark.generate(done, config, records)
+			return
+		}
+		errc <- forward(done, reader, config, records)
+	}()
+
+	return records, errc
+}
+
+// forward reads records and sends them to the records channel until
+// the input is exhausted, reading fails or the pipeline is cancelled.
+func forward(done <-chan struct{}, reader *csv.Reader, config config, records chan<- inputRecord) error {
+	limiter := newLimiter(config)
+
+	send := func(record inputRecord) error {
+		// Throttle the whole pipeline before handing the record over to workers
+		if limiter != nil {
+			n := 1
+			if config.Rate.Bytes {
+				n = recordSize(record.fields)
+			}
+			if !wait(done, limiter, n) {
+				return errCancelled
+			}
+		}
+
+		if !config.Backpressure.send(done, records, record) {
+			return errCancelled
+		}
+		return nil
 	}
 
-	for record := range records {
-		// If we reached the TxSize number of affected records
-		// commit the transaction, reset the counter and immediately open a new one
-		if txCount >= config.TxSize {
-			stmt.Close()
-			err := tx.Commit()
-			if err != nil {
-				logger.Fatal(err)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			// Hand over the records -dedupe last has been holding
+			if config.Dedupe != nil {
+				for _, record := range config.Dedupe.release() {
+					if err := send(record); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			// A blank line has a single field however many the records have
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount && config.BlankLines.skip(reader, record) {
+				config.ParseErrors.advance(reader)
+				continue
+			}
+			config.BlankLines.lost()
+			// Set a malformed record aside if asked to
+			if config.ParseErrors == nil || !errors.As(err, &parseErr) {
+				return err
+			}
+			if err := config.ParseErrors.write(parseErr, record); err != nil {
+				return err
 			}
+			continue
+		}
+		config.ParseErrors.advance(reader)
+		if config.BlankLines.skip(reader, record) {
+			continue
+		}
+		line, _ := reader.FieldPos(0)
 
-			txCount = 0
-			tx, err = db.Begin()
-			stmt, err = tx.Prepare(query)
+		raw := record
+		if config.IgnoreCols != nil {
+			record, err = dropFields(record, config.IgnoreCols, len(config.Columns))
 			if err != nil {
-				logger.Fatal(err)
+				return fmt.Errorf("Record on line %d: %w", line, err)
 			}
 		}
-
-		// If we accumulated InsertSize number of records
-		// perform the multi-row insert and reset the counter
-		if inCount >= config.InsertSize {
-			err := stmt.QueryRow(bindings...).Scan(&inAffected)
+		if config.Positions != nil {
+			record, err = project(record, config.Positions)
 			if err != nil {
-				stmt.Close()
-				tx.Rollback()
-				// TODO: Revisit and communicate the error via an error channel
-				logger.Fatal(err)
+				return fmt.Errorf("Record on line %d: %w", line, err)
 			}
-			affected += inAffected
-			processed += config.InsertSize
-			inCount = 0
+		}
+		if config.PackJSON != nil {
+			record, err = config.PackJSON.pack(record)
+			if err != nil {
+				return fmt.Errorf("Record on line %d: %w", line, err)
+			}
+		}
+
+		// Keep a runaway record, e.g. an unterminated quote swallowing the rest
+		// of the file, from getting any further than the reject file
+		if size := recordSize(record); config.MaxRowBytes > 0 && size > config.MaxRowBytes {
+			sizeErr := &rowSizeError{Line: line, Size: size, Max: config.MaxRowBytes}
+			switch {
+			case config.ParseErrors != nil:
+				if err := config.ParseErrors.reject(reader, raw); err != nil {
+					return err
+				}
+				continue
+			case config.Rejects == nil:
+				return sizeErr
+			}
+			if err := send(inputRecord{line: line, fields: record, reject: sizeErr}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if config.Transform != nil {
+			if err := config.Transform.transform(record); err != nil {
+				transformErr := &transformError{Line: line, Err: err}
+				switch {
+				case config.ParseErrors != nil:
+					if err := config.ParseErrors.reject(reader, raw); err != nil {
+						return err
+					}
+					continue
+				case config.Rejects == nil:
+					return transformErr
+				}
+				if err := send(inputRecord{line: line, fields: record, reject: transformErr}); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		input := inputRecord{line: line, fields: record}
+		if config.Dedupe != nil && !config.Dedupe.keep(input) {
+			continue
 		}
 
-		// Accumulate bindings for the insert query
-		bindings[inCount*fieldCount] = importId
-		for i, value := range record {
-			bindings[inCount*fieldCount+i] = nullify(value)
+		if err := send(input); err != nil {
+			return err
 		}
-		inCount++
 	}
-	// Close the prepared statement
-	stmt.Close()
+}
 
-	// If there are left over records
-	// adjust the query accordingly and perform the insert
-	if inCount > 0 {
-		query = buildQuery(config.Table, inCount)
-		err := tx.QueryRow(query, bindings[0:inCount*fieldCount]...).Scan(&inAffected)
-		if err != nil {
-			tx.Rollback()
-			// TODO: Revisit and communicate the error via an error channel
-			logger.Fatal(err)
+// project picks the fields at the given positions out of a record.
+func project(record []string, positions []int) ([]string, error) {
+	projected := make([]string, len(positions))
+	for i, position := range positions {
+		if position >= len(record) {
+			return nil, fmt.Errorf("field %d is mapped but the record has only %d fields", position, len(record))
 		}
-		affected += inAffected
-		processed += inCount
+		projected[i] = record[position]
 	}
 
-	// Commit the very last transaction
-	err = tx.Commit()
-	if err != nil {
-		logger.Fatal(err)
+	return projected, nil
+}
+
+// dropFields removes the fields at the sorted positions from the record
+// checking that what is left has a field for each of the columns.
+func dropFields(record []string, positions []int, columns int) ([]string, error) {
+	if last := positions[len(positions)-1]; last >= len(record) {
+		return nil, fmt.Errorf("field %d is dropped but the record has only %d fields", last, len(record))
+	}
+	if len(record)-len(positions) != columns {
+		return nil, fmt.Errorf("%d fields are left out of %d after dropping -ignore-cols, expected one for each of the %d columns", len(record)-len(positions), len(record), columns)
 	}
 
-	select {
-	case results <- ingestResult{processed, affected}:
-	case <-done:
-		return
+	kept := make([]string, 0, columns)
+	for i, j := 0, 0; i < len(record); i++ {
+		if j < len(positions) && positions[j] == i {
+			j++
+			continue
+		}
+		kept = append(kept, record[i])
 	}
+
+	return kept, nil
 }
 
-func ingestAll(reader *csv.Reader, db *sql.DB, config config) (ingestResult, error) {
-	done := make(chan struct{})
-	defer close(done)
+// parseIgnoreCols resolves -ignore-cols to the sorted positions of the fields, taking
+// the names that aren't indices from the header of the input.
+func parseIgnoreCols(fields []string, header []string) ([]int, error) {
+	var positions []int
+	for _, field := range fields {
+		position, err := strconv.Atoi(field)
+		switch {
+		case err == nil && position < 0:
+			return nil, fmt.Errorf("Invalid field index '%s' in -ignore-cols", field)
+		case err != nil && header == nil:
+			return nil, fmt.Errorf("Can't drop field '%s': the input has no header to find it in, use its index instead", field)
+		case err != nil:
+			position = columnIndex(header, field)
+			if position < 0 {
+				return nil, fmt.Errorf("Can't drop field '%s': it is not in the header", field)
+			}
+		}
+		for _, dropped := range positions {
+			if dropped == position {
+				return nil, fmt.Errorf("Field '%s' is dropped more than once", field)
+			}
+		}
+		positions = append(positions, position)
+	}
+	sort.Ints(positions)
 
-	// Read and discard the header
-	reader.Read()
+	return positions, nil
+}
 
-	// Errors channel
-	records, errc := read(done, reader, config)
+// parsePositional parses a mapping of CSV field positions to columns e.g. 0:leadid,2:activitydate.
+func parsePositional(mapping string) ([]string, []int, error) {
+	var (
+		columns   []string
+		positions []int
+	)
 
-	// Start a fixed number of ingest workers
-	results := make(chan ingestResult)
+	for _, pair := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("Invalid positional mapping '%s', expected index:column", pair)
+		}
 
-	var wg sync.WaitGroup
+		position, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || position < 0 {
+			return nil, nil, fmt.Errorf("Invalid field index in positional mapping '%s'", pair)
+		}
 
-	wg.Add(config.Workers)
-	for i := 0; i < config.Workers; i++ {
-		go func() {
-			ingest(db, config, done, records, results)
-			wg.Done()
-		}()
+		column := strings.TrimSpace(parts[1])
+		if column == "" {
+			return nil, nil, fmt.Errorf("Missing column in positional mapping '%s'", pair)
+		}
+		if columnIndex(columns, column) >= 0 {
+			return nil, nil, fmt.Errorf("Column '%s' is mapped more than once", column)
+		}
+
+		columns = append(columns, column)
+		positions = append(positions, position)
 	}
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
 
-	// Receive all the results from results channel then check the error from errc channel
-	totals := ingestResult{0, 0}
+	return columns, positions, nil
+}
 
-	for result := range results {
-		totals.Processed += result.Processed
-		totals.Affected += result.Affected
+// nullValue is the field value that is loaded as NULL.
+const nullValue = "null"
+
+// nullify turns the null value into NULL. With an escape the null value
+// prefixed by it is loaded literally with one level of the escape stripped.
+func nullify(value string, escape string) interface{} {
+	if value == nullValue {
+		return sql.NullString{}
 	}
-	// Check whether the ingest failed
-	if err := <-errc; err != nil {
-		return ingestResult{0, 0}, err
+
+	if escape != "" && strings.HasPrefix(value, escape) {
+		rest := value
+		for strings.HasPrefix(rest, escape) {
+			rest = rest[len(escape):]
+		}
+		if rest == nullValue {
+			return value[len(escape):]
+		}
 	}
 
-	return totals, nil
+	return value
 }
 
-func memoryUsage() uint64 {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-
-	return m.Sys
+// columnValue is a column name paired with a value in the form of col=value.
+type columnValue struct {
+	Column string
+	Value  string
 }
 
-type config struct {
-	ImportId   int
-	Table      string
-	Workers    int
-	InsertSize int
-	TxSize     int
-}
+// columnValues is a repeatable flag of col=value pairs.
+type columnValues []columnValue
 
-type totals struct {
-	Records  ingestResult
-	Duration time.Duration
-	Memory   uint64
-}
+func (c *columnValues) String() string {
+	if c == nil {
+		return ""
+	}
 
-func printTotals(totals *totals) {
-	fmt.Printf(
-		"Total %d, affected %d, time %v, memory %.3fMb\n",
-		totals.Records.Processed,
-		totals.Records.Affected,
-		totals.Duration,
-		float64(totals.Memory)/1024/1024,
-	)
-}
+	pairs := make([]string, len(*c))
+	for i, pair := range *c {
+		pairs[i] = pair.Column + "=" + pair.Value
+	}
 
-func printTotalsJSON(totals *totals) {
-	json, _ := json.MarshalIndent(totals, "", "   ")
-	fmt.Printf("%s\n", json)
+	return strings.Join(pairs, ",")
 }
 
-func main() {
-	var (
-		dbConn     string
-		config     config
-		maxProcs   int
-		totals     totals
-		outputJSON bool
-		reader     *csv.Reader
-		baseReader *bufio.Reader
-	)
+// columns returns the names of the columns.
+func (c columnValues) columns() []string {
+	names := make([]string, len(c))
+	for i, pair := range c {
+		names[i] = pair.Column
+	}
 
-	flag.StringVar(&dbConn, "c", "", "Database connection string")
-	flag.IntVar(&config.Workers, "w", 4, "Number of workers")
-	flag.IntVar(&config.ImportId, "i", 0, "Import Id")
-	flag.StringVar(&config.Table, "t", "marketo.activities", "Database table to load data into")
-	flag.IntVar(&maxProcs, "p", 1, "Max logical processors")
-	flag.BoolVar(&outputJSON, "json", false, "Output results in JSON")
-	flag.IntVar(&config.InsertSize, "m", 2, "Number of records per insert")
-	flag.IntVar(&config.TxSize, "x", 25000, "Number of records per transaction")
+	return names
+}
 
-	flag.Usage = func() {
-		fmt.Printf("Usage: %s [options] [file]\n", filepath.Base(os.Args[0]))
-		fmt.Println("  file")
-		fmt.Println("    	A CSV file to load. If omitted read from stdin")
-		flag.PrintDefaults()
+func (c *columnValues) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("expected col=value, got '%s'", s)
 	}
-	flag.Parse()
 
-	// Set the number of logical processors to use
-	runtime.GOMAXPROCS(maxProcs)
+	*c = append(*c, columnValue{strings.TrimSpace(parts[0]), parts[1]})
 
-	// Start timing
-	start := time.Now()
+	return nil
+}
 
-	if flag.NArg() < 1 {
-		baseReader = bufio.NewReader(os.Stdin)
-	} else {
-		path := flag.Args()[0]
-		file, err := os.Open(path)
-		if err != nil {
-			logger.Fatalf("Can't open input file '%s'", path)
+type ingestResult struct {
+	Processed int
+	Affected  int
+	// Records skipped because of a conflict
+	Skipped int
+	// Records the database refused to load and their number per class of error
+	Rejected int
+	Rejects  map[string]int `json:",omitempty"`
+	// Committed transactions
+	Transactions int
+	// Batches inserted again after a transient failure and batches inserted record by record
+	RetriedBatches int `json:",omitempty"`
+	SplitBatches   int `json:",omitempty"`
+	// Conflict keys of the skipped records written to -dup-audit-table
+	AuditedDuplicates int `json:",omitempty"`
+	// Affected records per partition when records are routed to partitions
+	Partitions map[string]int `json:",omitempty"`
+	// The slowest batch inserts, slowest first
+	Slowest []batchTiming `json:",omitempty"`
+	// Values -types couldn't convert and -on-coerce-error null loaded as NULL per column
+	CoercionMisses map[string]int `json:",omitempty"`
+	// Ids of the transactions prepared with -2pc
+	Prepared []string `json:"-"`
+}
+
+func (r *ingestResult) add(other ingestResult) {
+	r.Processed += other.Processed
+	r.Affected += other.Affected
+	r.Skipped += other.Skipped
+	r.Transactions += other.Transactions
+	r.RetriedBatches += other.RetriedBatches
+	r.SplitBatches += other.SplitBatches
+	r.AuditedDuplicates += other.AuditedDuplicates
+	r.Rejected += other.Rejected
+	for class, rejected := range other.Rejects {
+		if r.Rejects == nil {
+			r.Rejects = make(map[string]int)
 		}
-		defer file.Close()
+		r.Rejects[class] += rejected
+	}
+	r.Slowest = mergeSlowest(r.Slowest, other.Slowest)
+	r.Prepared = append(r.Prepared, other.Prepared...)
+	for partition, affected := range other.Partitions {
+		r.addPartition(partition, affected)
+	}
+	for column, misses := range other.CoercionMisses {
+		if r.CoercionMisses == nil {
+			r.CoercionMisses = make(map[string]int)
+		}
+		r.CoercionMisses[column] += misses
+	}
+}
 
-		baseReader = bufio.NewReader(file)
+func (r *ingestResult) addReject(class string) {
+	if r.Rejects == nil {
+		r.Rejects = make(map[string]int)
 	}
+	r.Rejects[class]++
+}
 
-	// Read magic bytes in hope to detect gzip
-	bytes, err := baseReader.Peek(2)
-	if err != nil {
-		logger.Fatal(err)
+func (r *ingestResult) addCoercionMiss(column string) {
+	if r.CoercionMisses == nil {
+		r.CoercionMisses = make(map[string]int)
 	}
+	r.CoercionMisses[column]++
+}
 
-	// The RFC 1952: GZIP file format specification version 4.3
-	// states the first 2 bytes of the file are '\x1F' and '\x8B'.
-	if bytes[0] == 0x1f && bytes[1] == 0x8b {
-		gzipReader, err := gzip.NewReader(baseReader)
-		if err != nil {
-			logger.Fatal(err)
-		}
-		reader = csv.NewReader(gzipReader)
-	} else {
-		reader = csv.NewReader(baseReader)
+func (r *ingestResult) addPartition(partition string, affected int) {
+	if r.Partitions == nil {
+		r.Partitions = make(map[string]int)
 	}
+	r.Partitions[partition] += affected
+}
 
-	db, err := sql.Open("postgres", dbConn)
-	if err != nil {
-		logger.Fatal(err)
+func buildQuery(config config, table string, n int) string {
+	SQL :=
+		`WITH inserted AS (
+		INSERT INTO %s (%s) VALUES %s
+		%s
+		RETURNING 1
+	)
+	SELECT COUNT(*) FROM inserted`
+	// A custom count is computed over the inserted rows
+	if config.CountExpr != "" {
+		SQL = `WITH inserted AS (
+		INSERT INTO %s (%s) VALUES %s
+		%s
+		RETURNING *
+	)
+	SELECT COALESCE((` + config.CountExpr + `), 0)::bigint FROM inserted`
+	}
+	// The number of affected records comes from the command tag instead
+	if config.RowsAffected {
+		SQL = `INSERT INTO %s (%s) VALUES %s
+		%s`
+	}
+	// The keys of the inserted records tell which ones have been skipped
+	if returnsKeys(config) {
+		SQL = `INSERT INTO %s (%s) VALUES %s
+		%s
+		RETURNING ` + conflictKey
 	}
-	defer db.Close()
 
-	err = db.Ping()
-	if err != nil {
-		logger.Fatal(err)
+	columns := append([]string{}, loadColumns(config)...)
+	fieldCount := len(columns)
+	// Expressions are inlined after the placeholders so that
+	// the placeholder numbering matches the bindings
+	p := make([]string, fieldCount, fieldCount+len(config.Exprs))
+	columns = append(columns, config.Exprs.columns()...)
+	for _, expr := range config.Exprs {
+		p = append(p, expr.Value)
 	}
 
-	results, err := ingestAll(reader, db, config)
-	if err != nil {
-		logger.Fatal(err)
-		return
+	v := make([]string, n)
+	m := 0
+	for i := 0; i < n; i++ {
+		for j := 0; j < fieldCount; j++ {
+			m++
+			p[j] = fmt.Sprintf("$%d", m)
+		}
+		v[i] = fmt.Sprintf("(%s)", strings.Join(p, ","))
 	}
 
-	totals.Records = results
-	totals.Duration = time.Since(start)
-	totals.Memory = memoryUsage()
+	// Duplicates are skipped unless they are to fail the insert or update the rows in the table.
+	// A view leaves them to the trigger behind it.
+	onConflict := fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", conflictKey)
+	switch {
+	case config.View, config.Conflict == conflictError:
+		onConflict = ""
+	case config.Conflict == conflictUpdate:
+		onConflict = fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", conflictKey, updateSet(config, table, columns))
+	}
 
-	if outputJSON {
-		printTotalsJSON(&totals)
-	} else {
-		printTotals(&totals)
+	return fmt.Sprintf(SQL, table, strings.Join(columns, ", "), strings.Join(v, ","), onConflict)
+}
+
+// target accumulates records routed to one table, i.e. the table itself or one of its partitions.
+type target struct {
+	table string
+	// The full batch insert prepared once on the connection of the worker
+	stmt  *sql.Stmt
+	batch []inputRecord
+	// Number of the first record of the batch among the records the worker received
+	first int
+	// Batch of the input the records were dealt in with -preserve-order
+	turn int
+}
+
+func ingest(db *sql.DB, config config, worker int, records <-chan inputRecord) (committed ingestResult, err error) {
+	txCount := 0
+	received := 0
+	// Batch of the input dealt to the worker that is in progress with -preserve-order
+	turn := -1
+	// Totals of the transaction in progress, those of the records rejected
+	// before inserting them are kept apart as they are not replayed
+	pending := ingestResult{}
+	screened := ingestResult{}
+	var tx *sql.Tx
+	// With -isolation the records of the transaction in progress are kept to replay them
+	// after a serialization failure, the number of times it has been replayed so far
+	retain := config.Isolation >= sql.LevelRepeatableRead
+	var txRecords []inputRecord
+	replays := 0
+
+	// Every transaction of the worker runs on the same connection so that the statements
+	// prepared on it serve all of them. It is given back once the last one is over.
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return committed, err
+	}
+	defer conn.Close()
+
+	// The slowest batches are reported however the worker ends
+	var slow slowest
+	defer func() {
+		committed.Slowest = slow.sorted()
+	}()
+
+	// A malformed record shouldn't bring the whole program down
+	defer func() {
+		if r := recover(); r != nil {
+			if tx != nil {
+				tx.Rollback()
+			}
+			err = fmt.Errorf("Worker %d failed at about record %d it received: %v", worker, received, r)
+		}
+	}()
+	fieldCount := len(loadColumns(config))
+	keyIndex := columnIndex(config.Columns, conflictKey)
+	partitionIndex := columnIndex(config.Columns, config.PartitionBy)
+	// Columns are validated upfront
+	normalizers, _ := buildNormalizers(config)
+	coercions, _ := buildCoercions(config)
+	required, _ := requiredIndexes(config)
+	checks := buildTypeChecks(config)
+
+	bindings := make([]interface{}, config.InsertSize*fieldCount)
+	targets := make(map[string]*target)
+	// Tables the partitions computed so far go to, the table itself for those that don't exist
+	routes := make(map[string]string)
+
+	// The prepared statements are closed however the worker ends
+	defer func() {
+		for _, t := range targets {
+			if t.stmt != nil {
+				t.stmt.Close()
+			}
+		}
+	}()
+	fail := func(err error) (ingestResult, error) {
+		// Opening the next transaction may have failed
+		if tx != nil {
+			tx.Rollback()
+		}
+		return committed, err
+	}
+	// Defined once all the steps they take are
+	var (
+		replay         func(error) error
+		commitRetrying func() error
+	)
+	// Commit the transaction or, with -2pc, prepare it for ingestAll to commit
+	commit := func() error {
+		if config.TwoPhase == "" {
+			return tx.Commit()
+		}
+
+		id := fmt.Sprintf("%s_%d_%d", config.TwoPhase, worker, committed.Transactions+1)
+		if err := prepare(tx, id); err != nil {
+			return err
+		}
+		committed.Prepared = append(committed.Prepared, id)
+
+		return nil
+	}
+	// Commit the transaction in progress and open a new one
+	rotate := func() error {
+		if err := commitRetrying(); err != nil {
+			return err
+		}
+
+		var err error
+		tx, err = begin(conn, config)
+
+		return err
+	}
+	// Insert the records of a failed batch one at a time rejecting the ones the database refuses
+	insertRecords := func(t *target) (affected, rejected int, err error) {
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT pload_batch"); err != nil {
+			return 0, 0, err
+		}
+
+		query := buildQuery(config, t.table, 1)
+		for _, record := range t.batch {
+			if err := bind(bindings, []inputRecord{record}, fieldCount, config.StampImportId, config.ImportId, config.NullEscape, coercions); err != nil {
+				return 0, 0, err
+			}
+
+			if _, err := tx.Exec("SAVEPOINT pload_record"); err != nil {
+				return 0, 0, err
+			}
+			inAffected, _, err := execute(config, tx, nil, query, bindings[0:fieldCount])
+			if err != nil {
+				if !rejectable(err) {
+					return 0, 0, fmt.Errorf("Insert of the record on line %d: %w", record.line, err)
+				}
+				if _, err := tx.Exec("ROLLBACK TO SAVEPOINT pload_record"); err != nil {
+					return 0, 0, err
+				}
+
+				class, err := config.Rejects.write(record, err)
+				if err != nil {
+					return 0, 0, err
+				}
+				pending.addReject(class)
+				rejected++
+				continue
+			}
+			if _, err := tx.Exec("RELEASE SAVEPOINT pload_record"); err != nil {
+				return 0, 0, err
+			}
+			if inAffected == 0 && config.Skipped != nil {
+				if err := config.Skipped.write(record); err != nil {
+					return 0, 0, err
+				}
+			}
+			if inAffected == 0 && config.DupAuditTable != "" {
+				audited, err := auditDuplicates(tx, config, []inputRecord{record}, keyIndex)
+				if err != nil {
+					return 0, 0, err
+				}
+				pending.AuditedDuplicates += audited
+			}
+			affected += inAffected
+		}
+
+		return affected, rejected, nil
+	}
+	// Perform the multi-row insert of the target's batch and reset the batch
+	insert := func(t *target) error {
+		n := len(t.batch)
+		if config.SortBatch {
+			sortBatch(t.batch, keyIndex)
+		}
+		if err := bind(bindings, t.batch, fieldCount, config.StampImportId, config.ImportId, config.NullEscape, coercions); err != nil {
+			return err
+		}
+
+		var (
+			stmt  *sql.Stmt
+			query string
+		)
+		if n == config.InsertSize {
+			// Prepare the statement that will be used in a loop once per worker. It runs in the
+			// transaction in progress on the connection and outlives commits and rollbacks.
+			if t.stmt == nil {
+				stmt, err := conn.PrepareContext(context.Background(), buildQuery(config, t.table, n))
+				if err != nil {
+					return err
+				}
+				t.stmt = stmt
+			}
+			stmt = t.stmt
+		} else {
+			// Adjust the query to the number of left over records
+			query = buildQuery(config, t.table, n)
+		}
+
+		// With -sort-batch it is the lowest key of the batch
+		var key string
+		if keyIndex >= 0 {
+			key = t.batch[0].fields[keyIndex]
+		}
+
+		if config.PrintSQL != nil {
+			if query == "" {
+				config.PrintSQL.print(buildQuery(config, t.table, n), bindings[0:n*fieldCount])
+			} else {
+				config.PrintSQL.print(query, bindings[0:n*fieldCount])
+			}
+		}
+
+		// Wait for the batches that precede this one in the input to be committed
+		if config.Sequence != nil {
+			if !config.Sequence.wait(t.turn) {
+				return errCancelled
+			}
+		}
+
+		started := time.Now()
+		// A batch with rejected records is retried record by record from the savepoint
+		// and so is a batch that failed for a transient reason
+		savepoint := config.Rejects != nil || config.MaxBatchRetries > 0
+		if savepoint {
+			if _, err := tx.Exec("SAVEPOINT pload_batch"); err != nil {
+				return err
+			}
+		}
+		inAffected, keys, err := execute(config, tx, stmt, query, bindings[0:n*fieldCount])
+		for attempt := 1; err != nil && transient(err) && attempt <= config.MaxBatchRetries; attempt++ {
+			if attempt == 1 {
+				pending.RetriedBatches++
+			}
+			logger.Printf("Worker %d: %v, retrying the insert of %d records from %s (attempt %d of %d)", worker, err, n, lineRange(t.batch), attempt, config.MaxBatchRetries)
+			time.Sleep(time.Duration(attempt) * batchRetryInterval)
+
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT pload_batch"); err != nil {
+				return err
+			}
+			inAffected, keys, err = execute(config, tx, stmt, query, bindings[0:n*fieldCount])
+		}
+		rejected := 0
+		if err != nil && config.Rejects != nil && (rejectable(err) || config.MaxBatchRetries > 0 && transient(err)) {
+			pending.SplitBatches++
+			inAffected, rejected, err = insertRecords(t)
+		} else if err != nil {
+			err = fmt.Errorf("Insert of %d records from %s: %w", n, lineRange(t.batch), err)
+		} else if returnsKeys(config) && inAffected < n {
+			sent, err := batchKeys(tx, config, t.batch, keyIndex)
+			if err != nil {
+				return fmt.Errorf("Can't tell the skipped records from %s: %w", lineRange(t.batch), err)
+			}
+			skipped := skippedRecords(t.batch, sent, keys)
+			for _, record := range skipped {
+				if config.Skipped == nil {
+					break
+				}
+				if err := config.Skipped.write(record); err != nil {
+					return err
+				}
+			}
+			// The keys go with the batch, if they can't be written the batch fails
+			if config.DupAuditTable != "" {
+				audited, err := auditDuplicates(tx, config, skipped, keyIndex)
+				if err != nil {
+					return err
+				}
+				pending.AuditedDuplicates += audited
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if savepoint {
+			if _, err := tx.Exec("RELEASE SAVEPOINT pload_batch"); err != nil {
+				return err
+			}
+		}
+		slow.add(batchTiming{
+			Worker:   worker,
+			Record:   t.first,
+			Records:  n,
+			Table:    t.table,
+			Key:      key,
+			Duration: time.Since(started),
+		})
+		// The hook goes with the batch, its failure fails the transaction
+		if config.BatchHook != "" {
+			if _, err := tx.Exec(config.BatchHook); err != nil {
+				return fmt.Errorf("Batch hook after %d records from %s: %w", n, lineRange(t.batch), err)
+			}
+		}
+		pending.Affected += inAffected
+		pending.Processed += n
+		pending.Skipped += n - inAffected - rejected
+		pending.Rejected += rejected
+		if partitionIndex >= 0 {
+			pending.addPartition(t.table, inAffected)
+		}
+		config.Progress.add(n, inAffected)
+		t.batch = t.batch[:0]
+		txCount += n
+
+		// Every batch is committed on its own before the next one in the input goes
+		if config.Sequence != nil {
+			if err := rotate(); err != nil {
+				return err
+			}
+			config.Sequence.next()
+		}
+
+		return nil
+	}
+
+	// Route the record to its batch and insert the batch once it is full
+	add := func(input inputRecord) error {
+		// Route the record to its partition falling back to the table itself
+		table := config.Table
+		if partitionIndex >= 0 {
+			if partition, ok := partitionName(config.PartitionTemplate, input.fields[partitionIndex]); ok {
+				routed, seen := routes[partition]
+				if !seen {
+					exists, err := partitionExists(tx, partition)
+					if err != nil {
+						return err
+					}
+					routed = config.Table
+					if exists {
+						routed = partition
+					}
+					routes[partition] = routed
+				}
+				table = routed
+			}
+		}
+		t := targets[table]
+		if t == nil {
+			t = &target{table: table, batch: make([]inputRecord, 0, config.InsertSize)}
+			targets[table] = t
+		}
+
+		// If we accumulated InsertSize number of records perform the insert
+		if len(t.batch) >= config.InsertSize {
+			if err := insert(t); err != nil {
+				return err
+			}
+		}
+
+		// Accumulate records for the insert query
+		if len(t.batch) == 0 {
+			t.first = received
+			t.turn = input.turn
+		}
+		t.batch = append(t.batch, input)
+
+		return nil
+	}
+	// If there are left over records perform the inserts
+	// in the same order in every worker
+	flush := func() error {
+		tables := make([]string, 0, len(targets))
+		for table := range targets {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			if len(targets[table].batch) > 0 {
+				if err := insert(targets[table]); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+	// Insert the batch of the dealt turn in progress, or pass the turn on if
+	// every record of it has been screened out, so that the next one can go
+	endTurn := func() error {
+		if turn < 0 {
+			return nil
+		}
+		if t := targets[config.Table]; t != nil && len(t.batch) > 0 {
+			return insert(t)
+		}
+		if !config.Sequence.wait(turn) {
+			return errCancelled
+		}
+		config.Sequence.next()
+
+		return nil
+	}
+	// Roll back the transaction after a serialization failure and insert its records
+	// anew in another one, as long as -max-retries allows. It returns the error that
+	// can't be overcome by replaying the transaction.
+	replay = func(err error) error {
+		for retain && sqlState(err) == "40001" && replays < config.MaxRetries {
+			replays++
+			logger.Printf("Worker %d: %v, replaying %d records (attempt %d of %d)", worker, err, len(txRecords), replays, config.MaxRetries)
+
+			tx.Rollback()
+			pending = ingestResult{}
+			txCount = 0
+			for _, t := range targets {
+				t.batch = t.batch[:0]
+			}
+
+			tx, err = begin(conn, config)
+			if err != nil {
+				return err
+			}
+			err = func() error {
+				for _, input := range txRecords {
+					if err := add(input); err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+			if err == nil {
+				return nil
+			}
+		}
+
+		return err
+	}
+	// Commit the transaction replaying it as long as committing it fails on a serialization failure
+	// The records still waiting in the batches go with the transaction
+	commitRetrying = func() error {
+		err := flush()
+		if err == nil {
+			err = commit()
+		}
+		for err != nil {
+			if err = replay(err); err != nil {
+				return err
+			}
+			if err = flush(); err == nil {
+				err = commit()
+			}
+		}
+
+		committed.add(pending)
+		committed.add(screened)
+		committed.Transactions++
+		pending = ingestResult{}
+		screened = ingestResult{}
+		txCount = 0
+		txRecords = txRecords[:0]
+		replays = 0
+
+		return nil
+	}
+
+	// Open a transaction
+	tx, err = begin(conn, config)
+	if err != nil {
+		return committed, err
+	}
+
+	for {
+		input, ok := config.Backpressure.receive(records)
+		if !ok {
+			break
+		}
+		record := input.fields
+		received++
+
+		// The batches go by the turn they were dealt in, even if records of it are screened out
+		if config.Sequence != nil && input.turn != turn {
+			if err := endTurn(); err != nil {
+				return fail(err)
+			}
+			turn = input.turn
+		}
+
+		// The reader has already found the record can't be loaded
+		if input.reject != nil {
+			class, err := config.Rejects.write(input, input.reject)
+			if err != nil {
+				return fail(err)
+			}
+			screened.addReject(class)
+			screened.Rejected++
+			screened.Processed++
+			config.Progress.add(1, 0)
+			continue
+		}
+
+		// A record that doesn't fit the columns would take the values of another one
+		if len(record) != len(config.Columns) {
+			countErr := &fieldCountError{Line: input.line, Fields: len(record), Columns: len(config.Columns)}
+			if config.Rejects == nil {
+				return fail(countErr)
+			}
+			class, err := config.Rejects.write(input, countErr)
+			if err != nil {
+				return fail(err)
+			}
+			screened.addReject(class)
+			screened.Rejected++
+			screened.Processed++
+			config.Progress.add(1, 0)
+			continue
+		}
+
+		if err := normalize(record, normalizers, input.line); err != nil {
+			if config.Rejects == nil {
+				return fail(err)
+			}
+			class, err := config.Rejects.write(input, err)
+			if err != nil {
+				return fail(err)
+			}
+			screened.addReject(class)
+			screened.Rejected++
+			screened.Processed++
+			config.Progress.add(1, 0)
+			continue
+		}
+
+		// Catch a missing value before the database does without telling which record it was
+		if index, ok := missing(record, required); ok {
+			missingErr := &missingError{Column: config.Columns[index], Line: input.line}
+			if config.Rejects == nil {
+				return fail(missingErr)
+			}
+			class, err := config.Rejects.write(input, missingErr)
+			if err != nil {
+				return fail(err)
+			}
+			screened.addReject(class)
+			screened.Rejected++
+			screened.Processed++
+			config.Progress.add(1, 0)
+			continue
+		}
+
+		// Catch a value that would be cast or fail to cast on the server
+		if check, ok := mistyped(record, checks); ok {
+			typeErr := &typeError{Column: check.Column, Type: check.Type, Value: record[check.Index], Line: input.line}
+			if config.Rejects == nil {
+				return fail(typeErr)
+			}
+			class, err := config.Rejects.write(input, typeErr)
+			if err != nil {
+				return fail(err)
+			}
+			screened.addReject(class)
+			screened.Rejected++
+			screened.Processed++
+			config.Progress.add(1, 0)
+			continue
+		}
+
+		// Deal with the values -types can't convert before they fail the insert
+		if config.OnCoerceError == coerceNull || config.OnCoerceError == coerceReject {
+			if errs := uncoercible(input, coercions, config.NullEscape); len(errs) > 0 {
+				if config.OnCoerceError == coerceReject {
+					class, err := config.Rejects.write(input, errs[0])
+					if err != nil {
+						return fail(err)
+					}
+					screened.addReject(class)
+					screened.Rejected++
+					screened.Processed++
+					config.Progress.add(1, 0)
+					continue
+				}
+				for _, coerceErr := range errs {
+					record[coerceErr.index] = nullValue
+					screened.addCoercionMiss(coerceErr.Column)
+				}
+			}
+		}
+
+		// If we reached the TxSize number of inserted records commit the transaction
+		// and immediately open a new one. With -2pc every worker prepares a single one.
+		if txCount >= config.TxSize && config.TwoPhase == "" {
+			if err := rotate(); err != nil {
+				return fail(err)
+			}
+		}
+
+		if retain {
+			txRecords = append(txRecords, input)
+		}
+		if err := add(input); err != nil {
+			if err = replay(err); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	// Every batch has been committed already
+	if config.Sequence != nil {
+		if err := endTurn(); err != nil {
+			return fail(err)
+		}
+		tx.Rollback()
+		committed.add(screened)
+		return committed, nil
+	}
+
+	err = flush()
+	for err != nil {
+		if err = replay(err); err != nil {
+			return fail(err)
+		}
+		err = flush()
+	}
+
+	// Commit the very last transaction
+	if err := commitRetrying(); err != nil {
+		return fail(err)
+	}
+
+	return committed, nil
+}
+
+// isolationLevels maps the values of -isolation to the transaction isolation levels.
+var isolationLevels = map[string]sql.IsolationLevel{
+	"read-committed":  sql.LevelReadCommitted,
+	"repeatable-read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
+
+// begin opens a transaction on the connection taking the advisory lock first if requested.
+func begin(conn *sql.Conn, config config) (*sql.Tx, error) {
+	tx, err := conn.BeginTx(context.Background(), &sql.TxOptions{Isolation: config.Isolation})
+	if err != nil {
+		return nil, err
+	}
+
+	if config.AdvisoryLock == nil {
+		return tx, nil
+	}
+
+	// Transaction level locks are released on commit or rollback
+	if !config.AdvisoryLockTry {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", *config.AdvisoryLock)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		return tx, nil
+	}
+
+	locked := false
+	err = tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", *config.AdvisoryLock).Scan(&locked)
+	if err == nil && !locked {
+		err = errLocked
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// execute runs the insert either with the prepared statement or, if there is none, with the query
+// and returns the number of affected records.
+func execute(config config, tx *sql.Tx, stmt *sql.Stmt, query string, args []interface{}) (int, []sql.NullString, error) {
+	if returnsKeys(config) {
+		return executeReturning(tx, stmt, query, args)
+	}
+
+	if config.RowsAffected {
+		var (
+			result sql.Result
+			err    error
+		)
+		if stmt != nil {
+			result, err = stmt.Exec(args...)
+		} else {
+			result, err = tx.Exec(query, args...)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		affected, err := result.RowsAffected()
+
+		return int(affected), nil, err
+	}
+
+	var row *sql.Row
+	if stmt != nil {
+		row = stmt.QueryRow(args...)
+	} else {
+		row = tx.QueryRow(query, args...)
+	}
+
+	affected := 0
+	err := row.Scan(&affected)
+
+	return affected, nil, err
+}
+
+// executeReturning runs the insert returning the conflict keys of the inserted records.
+func executeReturning(tx *sql.Tx, stmt *sql.Stmt, query string, args []interface{}) (int, []sql.NullString, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if stmt != nil {
+		rows, err = stmt.Query(args...)
+	} else {
+		rows, err = tx.Query(query, args...)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var keys []sql.NullString
+	for rows.Next() {
+		var key sql.NullString
+		if err := rows.Scan(&key); err != nil {
+			return 0, nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	return len(keys), keys, nil
+}
+
+// bind fills in the bindings for the insert query from a batch of records,
+// with stamp the import id first in every row.
+func bind(bindings []interface{}, batch []inputRecord, fieldCount int, stamp bool, importId int, nullEscape string, coercions []coercion) error {
+	for n, record := range batch {
+		row := bindings[n*fieldCount : (n+1)*fieldCount]
+		// The import id goes in front whenever the insert has its column, even if it is 0
+		if stamp {
+			row[0] = importId
+			row = row[1:]
+		}
+		for i, value := range record.fields {
+			row[i] = nullify(value, nullEscape)
+		}
+		if err := coerce(row, coercions); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sortBatch orders records by the value of the conflict key
+// so that all workers acquire row locks in the same order.
+func sortBatch(batch []inputRecord, keyIndex int) {
+	sort.SliceStable(batch, func(i, j int) bool {
+		return batch[i].fields[keyIndex] < batch[j].fields[keyIndex]
+	})
+}
+
+// lineRange describes the lines of the input the records of the batch come from.
+func lineRange(batch []inputRecord) string {
+	first, last := batch[0].line, batch[0].line
+	for _, record := range batch[1:] {
+		first = min(first, record.line)
+		last = max(last, record.line)
+	}
+	if first == last {
+		return fmt.Sprintf("line %d", first)
+	}
+
+	return fmt.Sprintf("lines %d to %d", first, last)
+}
+
+// loadColumns lists the columns records are bound to.
+// With -stamp-import-id the import id goes in front of the record's values.
+func loadColumns(config config) []string {
+	if !config.StampImportId {
+		return config.Columns
+	}
+
+	return append([]string{importIdColumn}, config.Columns...)
+}
+
+// columnIndex returns the position of the column
+// in the list of columns or -1 if it is not there.
+func columnIndex(columns []string, column string) int {
+	for i, name := range columns {
+		if strings.EqualFold(name, column) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// batchRetryInterval is how much longer every retry of a batch after a transient failure waits.
+const batchRetryInterval = 100 * time.Millisecond
+
+// How soon after the first interrupt with -tail-summary-on-signal the second one has to come to stop the load
+const interruptWindow = 5 * time.Second
+
+func ingestAll(reader *csv.Reader, db *sql.DB, config config) (ingestResult, error) {
+	done := make(chan struct{})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { close(done) })
+	}
+	defer cancel()
+
+	// Stop reading when the time is up and let workers commit what they have got
+	var expired atomic.Bool
+	if !config.Deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(config.Deadline), func() {
+			expired.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	// Or when the memory use goes over -max-memory, before the OS kills the load
+	var exhausted atomic.Bool
+	if config.MaxMemory > 0 {
+		go func() {
+			ticker := time.NewTicker(memorySampleInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if memoryUsage() > config.MaxMemory {
+						exhausted.Store(true)
+						cancel()
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	// The indexes are dropped before anything is loaded and created again
+	// once the workers are done whatever the outcome
+	dropped, dropErr := dropIndexes(db, config.DroppedIndexes)
+	if dropErr != nil {
+		return ingestResult{}, errors.Join(dropErr, recreateIndexes(db, dropped))
+	}
+
+	// Let an interrupt stop reading the same way so that the output files get
+	// closed properly. The default handling is restored for a second interrupt.
+	// With -tail-summary-on-signal it takes a second one in quick succession to stop
+	// reading and a third one to terminate.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+	go func() {
+		var last time.Time
+		for {
+			select {
+			case sig := <-interrupts:
+				if config.Status != nil && sig == os.Interrupt && time.Since(last) > interruptWindow {
+					last = time.Now()
+					config.Status()
+					logger.Printf("Interrupt again within %v to stop the load", interruptWindow)
+					continue
+				}
+				signal.Stop(interrupts)
+				cancel()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Errors channel
+	records, errc := read(done, reader, config)
+
+	stopProgress := config.Progress.report()
+	defer stopProgress()
+
+	// Create the table before any of the workers needs it
+	if config.CreateTable {
+		var err error
+		records, err = sampleAndCreate(done, db, config, records)
+		if err != nil {
+			return ingestResult{}, err
+		}
+	}
+
+	// Give every worker whole batches in turns and make them insert in the same order
+	var dealt []<-chan inputRecord
+	if config.PreserveOrder {
+		config.Sequence = newSequencer()
+		dealt = deal(done, records, config.Workers, config.InsertSize)
+	}
+	// Or give every worker the records of its own share of the key space
+	if config.ShardBy != "" {
+		dealt = shard(done, records, config.Workers, columnIndex(config.Columns, config.ShardBy), config.InsertSize)
+	}
+
+	// Start a fixed number of ingest workers. Every worker sends a single result, the buffer
+	// only lets a worker that is done return without waiting for it to be received.
+	// It makes no difference to the speed of the load, see BenchmarkResults. The counts of
+	// every batch go to the atomic counters of the progress instead, see BenchmarkProgress.
+	results := make(chan ingestResult, config.Workers)
+	errs := make(chan error, config.Workers)
+
+	var wg sync.WaitGroup
+
+	wg.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go func(worker int) {
+			defer wg.Done()
+
+			input := records
+			if dealt != nil {
+				input = dealt[worker-1]
+			}
+
+			result, err := ingest(db, config, worker, input)
+			if err != nil {
+				errs <- err
+				// Stop reading so that the rest of the workers wind down
+				cancel()
+				if config.Sequence != nil {
+					config.Sequence.stop()
+				}
+			}
+			results <- result
+		}(i + 1)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Receive all the results from results channel then check the error from errc channel
+	totals := ingestResult{}
+
+	for result := range results {
+		totals.add(result)
+	}
+	// A worker failure takes precedence over the cancellation it caused
+	var err error
+	select {
+	case err = <-errs:
+	default:
+		// Check whether the ingest failed
+		err = <-errc
+		if errors.Is(err, errCancelled) && expired.Load() {
+			err = fmt.Errorf("Load stopped at the -max-duration deadline: %w", context.DeadlineExceeded)
+		}
+		if errors.Is(err, errCancelled) && exhausted.Load() {
+			err = fmt.Errorf("Load stopped at the -max-memory limit of %d bytes: %w", config.MaxMemory, errMemoryLimit)
+		}
+	}
+
+	// With -2pc the prepared transactions are committed only if the whole load succeeded
+	if config.TwoPhase != "" {
+		commit := err == nil
+		if settleErr := settle(db, totals.Prepared, commit); settleErr != nil {
+			err = errors.Join(err, settleErr)
+		}
+		if !commit {
+			// Everything the workers have done is rolled back
+			totals = ingestResult{Slowest: totals.Slowest}
+		}
+	}
+
+	if len(dropped) > 0 {
+		err = errors.Join(err, recreateIndexes(db, dropped))
+	}
+
+	return totals, err
+}
+
+// decompress detects whether the input is gzip compressed
+// and if so wraps it with a gzip reader.
+func decompress(baseReader *bufio.Reader) (io.Reader, error) {
+	// Read magic bytes in hope to detect gzip. Peek blocks until both bytes
+	// arrive, however slow the writer of a pipe is, or the input ends.
+	bytes, err := baseReader.Peek(2)
+	if err == io.EOF {
+		// An input that short, e.g. a pipe closed without writing anything, can't be gzip
+		return baseReader, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The RFC 1952: GZIP file format specification version 4.3
+	// states the first 2 bytes of the file are '\x1F' and '\x8B'.
+	if bytes[0] == 0x1f && bytes[1] == 0x8b {
+		return gunzip(baseReader)
+	}
+
+	return baseReader, nil
+}
+
+// uncompress decompresses the input if told it is gzipped or, unless told
+// it isn't, if it looks like it is.
+func uncompress(baseReader *bufio.Reader, forceGzip, noGzip bool) (io.Reader, error) {
+	switch {
+	case forceGzip:
+		return gunzip(baseReader)
+	case noGzip:
+		return baseReader, nil
+	}
+
+	return decompress(baseReader)
+}
+
+// readerOptions tell newReader how to read the input.
+type readerOptions struct {
+	// Whether the input is gzipped, detected unless either is set, or decompressed already e.g. by -concat
+	ForceGzip    bool
+	NoGzip       bool
+	Decompressed bool
+	// Size of the buffers of the readers stacked on top of the input
+	BufferSize int
+	// Encoding the input is transcoded from to UTF-8 and whether to guess it if there is none
+	Encoding       encoding.Encoding
+	DetectEncoding bool
+	Verbose        bool
+	// Separator of the records that go on lines of their own instead, if any
+	RecordSep bool
+	Separator byte
+	// Substring of the lines to keep and the number of header lines kept regardless
+	Prefilter     string
+	PrefilterKeep int
+	// File the lines that fail to parse are written to, or the log of the input
+	// read before to go on writing them to
+	ParseErrorFile string
+	ParseErrors    *parseErrorLog
+	BlankLines     *blankLines
+}
+
+// newReader builds the CSV reader on top of the input: decompressed, transcoded to UTF-8,
+// split into records and filtered as told. It returns the parse error log too if there is one
+// since it needs the raw lines of the reader.
+func newReader(baseReader *bufio.Reader, options readerOptions) (*csv.Reader, *parseErrorLog, error) {
+	// Detect compression unless told whether the input is gzipped
+	var input io.Reader = baseReader
+	if !options.Decompressed {
+		var err error
+		input, err = uncompress(baseReader, options.ForceGzip, options.NoGzip)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// Decompressed data needs its own buffer of the same size,
+	// otherwise csv.Reader would wrap it with a default sized one
+	if input != io.Reader(baseReader) {
+		input = bufio.NewReaderSize(input, options.BufferSize)
+	}
+	// Transcode the input to UTF-8, an explicit -encoding wins over a guess
+	enc := options.Encoding
+	if options.DetectEncoding {
+		name, confidence, err := detectEncoding(input.(*bufio.Reader))
+		if err != nil {
+			return nil, nil, err
+		}
+		if confidence >= minEncodingConfidence {
+			if options.Verbose {
+				logger.Printf("Detected encoding %s with confidence %d%%", name, confidence)
+			}
+			if enc, err = lookupEncoding(name); err != nil {
+				logger.Printf("%v, reading as UTF-8", err)
+			}
+		} else if options.Verbose {
+			logger.Printf("No encoding detected with a confidence of at least %d%%, reading as UTF-8", minEncodingConfidence)
+		}
+	}
+	if enc != nil {
+		input = bufio.NewReaderSize(transcode(input, enc), options.BufferSize)
+	}
+	// Put every record on a line of its own
+	if options.RecordSep {
+		input = bufio.NewReaderSize(newRecordSplitter(input, options.Separator, options.BufferSize), options.BufferSize)
+	}
+	// Drop the lines without the substring before they are parsed
+	if options.Prefilter != "" {
+		input = bufio.NewReaderSize(newPrefilter(input, options.Prefilter, options.PrefilterKeep, options.BufferSize), options.BufferSize)
+	}
+
+	// Keep the raw lines around to write out the ones that fail to parse
+	var parseErrors *parseErrorLog
+	if options.ParseErrorFile != "" {
+		recorder := newLineRecorder(input)
+		parseErrors = options.ParseErrors.follow(recorder)
+		if parseErrors == nil {
+			parseErrors = newParseErrorLog(options.ParseErrorFile, recorder)
+		}
+		input = bufio.NewReaderSize(recorder, options.BufferSize)
+	}
+	// Count the empty lines the input ends with
+	if options.BlankLines != nil {
+		input = bufio.NewReaderSize(options.BlankLines.reader(input), options.BufferSize)
+	}
+
+	return csv.NewReader(input), parseErrors, nil
+}
+
+// gunzip decompresses the input without looking at it first.
+func gunzip(baseReader *bufio.Reader) (io.Reader, error) {
+	gzipReader, err := gzip.NewReader(baseReader)
+	if err != nil {
+		return nil, err
+	}
+	// Read through all members of files concatenated with e.g. cat a.gz b.gz.
+	// It is the default but the load relies on it so make it explicit.
+	gzipReader.Multistream(true)
+
+	return gzipReader, nil
+}
+
+// readHeader reads column names from the first line of a (possibly gzipped) CSV file.
+func readHeader(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open header file '%s'", path)
+	}
+	defer file.Close()
+
+	input, err := decompress(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := csv.NewReader(input).Read()
+	if err != nil {
+		return nil, fmt.Errorf("Can't read header from '%s': %v", path, err)
+	}
+
+	columns := make([]string, len(header))
+	for i, name := range header {
+		columns[i] = strings.TrimSpace(name)
+	}
+
+	return columns, nil
+}
+
+// renameColumns returns the header with the columns renamed by -rename, matching the old names
+// case insensitively. Names that aren't in the header are left out and returned apart.
+func renameColumns(header []string, renames columnValues) ([]string, []string, error) {
+	renamed := append([]string{}, header...)
+	var missing []string
+	for _, rename := range renames {
+		i := columnIndex(header, rename.Column)
+		if i < 0 {
+			missing = append(missing, rename.Column)
+			continue
+		}
+		renamed[i] = strings.TrimSpace(rename.Value)
+	}
+
+	for i, name := range renamed {
+		if name == "" {
+			return nil, nil, fmt.Errorf("Can't rename column '%s' to an empty name", header[i])
+		}
+		if j := columnIndex(renamed, name); j != i {
+			return nil, nil, fmt.Errorf("Column '%s' occurs in the header more than once after -rename", name)
+		}
+	}
+
+	return renamed, missing, nil
+}
+
+// load checks the connection and the schema, allocates the import id if requested
+// and ingests the input recording the results in totals.
+func load(db *sql.DB, reader *csv.Reader, header []string, config config, totals *totals) error {
+	// A file whose columns shifted is stopped before anything else
+	if len(config.ExpectHeader) > 0 {
+		err := checkHeader(header, config.ExpectHeader, config.HeaderFold)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := connect(db, config)
+	if err != nil {
+		return err
+	}
+
+	// Don't load the same file twice, there is no harm in writing its statements again
+	if config.Ledger != nil && (config.EmitSQL == "" || config.EmitAndRun) {
+		loaded, err := config.Ledger.loaded(db, config.LedgerTable)
+		if err != nil {
+			return err
+		}
+		if loaded {
+			totals.SkippedFiles = append(totals.SkippedFiles, config.Ledger.Path)
+			return nil
+		}
+	}
+
+	// Fail on missing grants before anything is loaded
+	err = checkPrivileges(db, config)
+	if err != nil {
+		return err
+	}
+
+	// A view gets plain inserts counted by their command tags
+	config.View, err = isView(db, config.Table)
+	if err != nil {
+		return err
+	}
+	if config.View {
+		err = checkView(config)
+		if err != nil {
+			return err
+		}
+		config.RowsAffected = true
+	}
+
+	if config.StrictSchema {
+		diff, err := checkSchema(db, config, header)
+		if err != nil {
+			return err
+		}
+		if !diff.empty() {
+			printSchemaDiff(diff)
+			return errSchemaMismatch
+		}
+	}
+
+	// A table that is yet to be created has nothing to require
+	if config.Positions != nil && !config.CreateTable {
+		err = checkRequired(db, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(config.JSONMerge) > 0 {
+		err = checkJSONMerge(db, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.StrictTypes || config.JSONEmpty != "" {
+		config.ColumnTypes, err = describeColumnTypes(db, config.Table)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The skipped records are told by comparing their keys with the returned ones as the server writes them
+	if returnsKeys(config) {
+		config.KeyType, err = describeKeyType(db, config.Table)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.TwoPhase != "" {
+		err = checkPreparedTransactions(db, config.Workers)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(config.RecreateIndex) > 0 {
+		config.DroppedIndexes, err = describeIndexes(db, config, config.RecreateIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The statements are written for review before anything changes in the database
+	if config.EmitSQL != "" {
+		err = emitSQL(config.EmitSQL, config)
+		if err != nil || !config.EmitAndRun {
+			return err
+		}
+	}
+
+	if config.ImportIdFrom != "" {
+		config.ImportId, err = allocateImportId(db, config.ImportIdFrom)
+		if err != nil {
+			return err
+		}
+	}
+	totals.ImportId = config.ImportId
+
+	if config.Benchmark != nil {
+		err = config.Benchmark.describe(db, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.WarmPool {
+		totals.WarmUp, err = warmPool(db, config.Workers)
+		if err != nil {
+			return err
+		}
+	}
+
+	started := time.Now()
+	totals.Records, err = ingestAll(reader, db, config)
+	if config.Benchmark != nil {
+		totals.Throughput = float64(totals.Records.Processed) / time.Since(started).Seconds()
+	}
+	totals.ParseErrors = config.ParseErrors.errors()
+	totals.Duplicates = config.Dedupe.duplicates()
+	totals.BlankLines = config.BlankLines.lines()
+	totals.Backpressure = config.Backpressure.totals()
+	if err != nil {
+		return err
+	}
+
+	if config.Ledger != nil {
+		return config.Ledger.record(db, config.LedgerTable)
+	}
+
+	return nil
+}
+
+// loadFile loads the next of several input files adding its totals to the ones of the files before it.
+func loadFile(db *sql.DB, reader *csv.Reader, header []string, config config, path string, all *totals) error {
+	var totals totals
+	err := load(db, reader, header, config, &totals)
+	all.addFile(path, &totals)
+
+	return err
+}
+
+// maxRetryInterval caps the exponential backoff between connection attempts.
+const maxRetryInterval = time.Minute
+
+// connect pings the database retrying with an exponential backoff
+// until it succeeds, runs out of retries or gets interrupted.
+func connect(db *sql.DB, config config) error {
+	// Let an interrupt cancel waiting for the database. The default
+	// handling of signals is restored as soon as the wait is over.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	interval := config.ConnectRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if ctx.Err() != nil {
+			return errCancelled
+		}
+		// The server refuses the time zone on every attempt alike
+		if config.TimeZone != "" && sqlState(err) == "22023" {
+			return fmt.Errorf("Invalid -timezone '%s': %w", config.TimeZone, err)
+		}
+		if err == nil || attempt > config.ConnectRetries {
+			return err
+		}
+
+		logger.Printf("Can't connect to the database (attempt %d of %d), retrying in %v: %v", attempt, config.ConnectRetries+1, interval, err)
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errCancelled
+		}
+
+		interval *= 2
+		if interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+// importIdFromName extracts the import id from the first capture group
+// of the pattern matched against the base name of the file.
+func importIdFromName(pattern *regexp.Regexp, path string) (int, bool, error) {
+	match := pattern.FindStringSubmatch(filepath.Base(path))
+	if match == nil {
+		return 0, false, nil
+	}
+
+	importId, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid import id '%s' in file name '%s'", match[1], path)
+	}
+
+	return importId, true, nil
+}
+
+// allocateImportId runs the query in its own transaction and returns the integer it yields.
+// The transaction is committed before the load starts so that the import is registered
+// even if the load fails.
+func allocateImportId(db *sql.DB, query string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var importId int
+	err = tx.QueryRow(query).Scan(&importId)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("Can't allocate import id: %w", err)
+	}
+
+	return importId, tx.Commit()
+}
+
+// How often -max-memory checks the memory use
+const memorySampleInterval = time.Second
+
+// memoryUsage returns the memory obtained from the OS, which stays put
+// when the garbage collector frees the heap until the runtime gives it back.
+func memoryUsage() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return m.Sys
+}
+
+type config struct {
+	ImportId int
+	// Whether every row gets the import id in its importid column
+	StampImportId bool
+	ImportIdFrom  string
+	Table         string
+	Columns       []string
+	Positions     []int
+	Exprs         columnValues
+	HeaderFile    string
+	Workers       int
+	InsertSize    int
+	TxSize        int
+	Rate          throttle
+	RateBurst     int
+	Ordered       bool
+	SortBatch     bool
+	StrictSchema  bool
+	RowsAffected  bool
+	CountExpr     string
+	PrintSQL      *sqlPrinter
+	AsInt         columnNames
+	AsBool        columnNames
+	Types         columnValues
+	ByteaEncoding string
+	// Column to route records to partitions by and the template of partition names
+	PartitionBy       string
+	PartitionTemplate string
+	// Number of times to retry connecting to the database and the initial interval between attempts
+	ConnectRetries       int
+	ConnectRetryInterval time.Duration
+	// Key of the advisory lock every transaction takes and whether to give up instead of waiting for it
+	AdvisoryLock    *int64
+	AdvisoryLockTry bool
+	// Where to write the records that fail to parse instead of stopping the load
+	ParseErrors *parseErrorLog
+	// Table of the files loaded so far and the entry of the input file in it
+	LedgerTable string
+	Ledger      *ledgerEntry
+	// Expression that changes the fields of every record before it is handed over to workers
+	Transform *transformer
+	// Drops the records whose conflict key occurs in the input more than once
+	Dedupe *deduper
+	// Skips the blank lines of the input, nil with -keep-blank-lines
+	BlankLines *blankLines
+	// Packs the fields of every record into the JSON object loaded into a single column
+	PackJSON *jsonPacker
+	// Times the reader and the workers wait for each other, nil unless -verbose
+	Backpressure *backpressure
+	// Whether to open the connections of the workers before reading the input
+	WarmPool bool
+	// What to do with a record whose key is already in the table
+	// and where to write the records the database refuses to load
+	Conflict string
+	Rejects  *rejectLog
+	// Where the records skipped because of a conflict are written, if anywhere
+	Skipped *skippedLog
+	// Table the conflict keys of the skipped records are inserted into along with the batch
+	DupAuditTable string
+	// Prefix that makes the null value load as a literal string
+	NullEscape string
+	// Whether batches are committed in the order of the input and the sequencer that orders them
+	PreserveOrder bool
+	Sequence      *sequencer
+	// Whether to create the table if it doesn't exist, how many records to infer
+	// the column types from and whether to infer them at all
+	CreateTable       bool
+	CreateTableSample int
+	CreateTableTypes  string
+	// When to stop reading the input and commit what has been loaded
+	Deadline time.Time
+	// Columns that must have a value
+	Required columnNames
+	// Unicode normalization form of the text and the columns it is applied to, all if none
+	Normalize     string
+	NormalizeCols columnNames
+	// Prefix of the ids of the transactions workers prepare with -2pc, empty without it
+	TwoPhase string
+	// Generator of the synthetic records loaded instead of the input
+	Benchmark *benchmark
+	// Isolation level of the transactions and how many times a transaction
+	// is replayed after a serialization failure
+	Isolation  sql.IsolationLevel
+	MaxRetries int
+	// How many times a batch is inserted again after a transient failure before giving up
+	// on it or, with Rejects, inserting its records one at a time
+	MaxBatchRetries int
+	// Whether values are checked against the column types and the types of the columns by name
+	StrictTypes bool
+	ColumnTypes map[string]string
+	// Type of the conflict key column the keys of the batches are cast to, to tell the skipped records
+	KeyType string
+	// What the empty values of json and jsonb columns are loaded as, as they are if empty
+	JSONEmpty string
+	// Whether the columns are matched to the table columns with Unicode case folding
+	// and with the accents stripped as well
+	FoldCase    bool
+	FoldAccents bool
+	// Records larger than this many bytes are rejected instead of loaded, no limit if zero
+	MaxRowBytes int
+	// What to do with a value -types can't convert
+	OnCoerceError string
+	// jsonb columns -conflict update merges into the row in the table
+	JSONMerge columnNames
+	// Column whose value picks the worker a record goes to
+	ShardBy string
+	// Stop loading once the memory obtained from the OS exceeds this many bytes, no limit if zero
+	MaxMemory uint64
+	// Reports the progress while the load runs, nil without -progress-format
+	Progress *progress
+	// Prints the totals so far on the first interrupt instead of stopping the load
+	Status func()
+	// SQL run in the transaction after every batch insert
+	BatchHook string
+	// Whether -conflict is given rather than left to its default
+	ConflictSet bool
+	// The table is a view inserted into without ON CONFLICT
+	View bool
+	// A file to write the statements of the load to, without loading unless EmitAndRun
+	EmitSQL    string
+	EmitAndRun bool
+	// The TimeZone setting of every connection
+	TimeZone string
+	// Indexes dropped before the load and recreated after it, described by load
+	RecreateIndex  columnNames
+	DroppedIndexes []droppedIndex
+	// Sorted positions of the CSV fields dropped before the rest are bound to the columns
+	IgnoreCols []int
+	// The header the input has to start with, the case of the names aside with HeaderFold
+	ExpectHeader columnNames
+	HeaderFold   bool
+}
+
+type totals struct {
+	ImportId int `json:",omitempty"`
+	Records  ingestResult
+	// Records set aside because they failed to parse
+	ParseErrors int `json:",omitempty"`
+	// Records dropped by -dedupe because their key occurs in the input more than once
+	Duplicates int `json:",omitempty"`
+	// Blank lines of the input that were skipped
+	BlankLines int `json:",omitempty"`
+	// Files that have been loaded before according to the ledger
+	SkippedFiles []string `json:",omitempty"`
+	// Each of several input files loaded one after another
+	Files []fileTotals `json:",omitempty"`
+	// Records per second the workers loaded with -benchmark
+	Throughput float64 `json:",omitempty"`
+	// Times the input has been loaded with -retry-file
+	Attempts int `json:",omitempty"`
+	// How long reading and the workers waited for each other with -verbose
+	Backpressure *backpressureTotals `json:",omitempty"`
+	// How long opening the connections of the workers took with -warm-pool
+	WarmUp   time.Duration `json:",omitempty"`
+	Duration time.Duration
+	Memory   uint64
+	Error    *loadError `json:",omitempty"`
+}
+
+// fileTotals are the totals of one of several input files loaded one after another.
+type fileTotals struct {
+	Path      string
+	ImportId  int `json:",omitempty"`
+	Processed int
+	Affected  int
+	Skipped   int
+	Rejected  int `json:",omitempty"`
+}
+
+func newFileTotals(path string, totals *totals) fileTotals {
+	return fileTotals{
+		Path:      path,
+		ImportId:  totals.ImportId,
+		Processed: totals.Records.Processed,
+		Affected:  totals.Records.Affected,
+		Skipped:   totals.Records.Skipped,
+		Rejected:  totals.Records.Rejected,
+	}
+}
+
+// addFile adds the totals of the next of several input files to the ones of the files
+// before it, which list the first file in Files already. The import id is only
+// reported for the whole load when all of the files share it. The parse error, dedupe
+// and backpressure totals go on from one file to the next and are taken as they are.
+func (t *totals) addFile(path string, file *totals) {
+	t.Files = append(t.Files, newFileTotals(path, file))
+	if file.ImportId != t.ImportId {
+		t.ImportId = 0
+	}
+
+	t.Records.add(file.Records)
+	t.SkippedFiles = append(t.SkippedFiles, file.SkippedFiles...)
+	t.BlankLines += file.BlankLines
+	t.WarmUp += file.WarmUp
+	t.ParseErrors = file.ParseErrors
+	t.Duplicates = file.Duplicates
+	t.Backpressure = file.Backpressure
+}
+
+// summaryFields maps the names accepted by -summary-fields to their formatting.
+var summaryFields = map[string]func(totals *totals) string{
+	"processed": func(totals *totals) string { return fmt.Sprintf("processed %d", totals.Records.Processed) },
+	"affected":  func(totals *totals) string { return fmt.Sprintf("affected %d", totals.Records.Affected) },
+	"skipped":   func(totals *totals) string { return fmt.Sprintf("skipped %d", totals.Records.Skipped) },
+	"rejected":  func(totals *totals) string { return fmt.Sprintf("rejected %d", totals.Records.Rejected) },
+	"duration":  func(totals *totals) string { return fmt.Sprintf("time %v", totals.Duration) },
+	"rps": func(totals *totals) string {
+		rps := 0.0
+		if seconds := totals.Duration.Seconds(); seconds > 0 {
+			rps = float64(totals.Records.Processed) / seconds
+		}
+		return fmt.Sprintf("rps %.1f", rps)
+	},
+	"memory":       func(totals *totals) string { return fmt.Sprintf("memory %.3fMb", float64(totals.Memory)/1024/1024) },
+	"transactions": func(totals *totals) string { return fmt.Sprintf("transactions %d", totals.Records.Transactions) },
+}
+
+// parseSummaryFields parses a comma separated list of summary field names.
+func parseSummaryFields(list string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(list, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if _, ok := summaryFields[field]; !ok {
+			return nil, fmt.Errorf("Unknown summary field '%s'", field)
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+func printTotals(totals *totals, fields []string, verbose bool) {
+	if totals.ImportId != 0 {
+		fmt.Printf("Import id %d\n", totals.ImportId)
+	}
+	if fields == nil {
+		fmt.Printf(
+			"Total %d, affected %d, skipped %d, time %v, memory %.3fMb\n",
+			totals.Records.Processed,
+			totals.Records.Affected,
+			totals.Records.Skipped,
+			totals.Duration,
+			float64(totals.Memory)/1024/1024,
+		)
+	} else {
+		values := make([]string, len(fields))
+		for i, field := range fields {
+			values[i] = summaryFields[field](totals)
+		}
+		fmt.Println(strings.Join(values, ", "))
+	}
+	partitions := make([]string, 0, len(totals.Records.Partitions))
+	for partition := range totals.Records.Partitions {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+	for _, partition := range partitions {
+		fmt.Printf("  %s affected %d\n", partition, totals.Records.Partitions[partition])
+	}
+	for _, file := range totals.Files {
+		importId := ""
+		if file.ImportId != 0 {
+			importId = fmt.Sprintf(" import id %d,", file.ImportId)
+		}
+		fmt.Printf("  %s%s total %d, affected %d, skipped %d\n", file.Path, importId, file.Processed, file.Affected, file.Skipped)
+	}
+	if totals.Records.Rejected != 0 {
+		fmt.Printf("Rejected %d\n", totals.Records.Rejected)
+		classes := make([]string, 0, len(totals.Records.Rejects))
+		for class := range totals.Records.Rejects {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Printf("  %s %d\n", class, totals.Records.Rejects[class])
+		}
+	}
+	if totals.Records.AuditedDuplicates != 0 {
+		fmt.Printf("Duplicates audited %d\n", totals.Records.AuditedDuplicates)
+	}
+	if totals.Records.RetriedBatches != 0 || totals.Records.SplitBatches != 0 {
+		fmt.Printf("Batches retried %d, split into records %d\n", totals.Records.RetriedBatches, totals.Records.SplitBatches)
+	}
+	if len(totals.Records.CoercionMisses) > 0 {
+		fmt.Println("Loaded as NULL")
+		columns := make([]string, 0, len(totals.Records.CoercionMisses))
+		for column := range totals.Records.CoercionMisses {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		for _, column := range columns {
+			fmt.Printf("  %s %d\n", column, totals.Records.CoercionMisses[column])
+		}
+	}
+	if totals.ParseErrors != 0 {
+		fmt.Printf("Parse errors %d\n", totals.ParseErrors)
+	}
+	if totals.Duplicates != 0 {
+		fmt.Printf("Duplicates dropped %d\n", totals.Duplicates)
+	}
+	if totals.BlankLines != 0 {
+		fmt.Printf("Blank lines skipped %d\n", totals.BlankLines)
+	}
+	if totals.Attempts > 1 {
+		fmt.Printf("Attempts %d\n", totals.Attempts)
+	}
+	if totals.Throughput != 0 {
+		fmt.Printf("Throughput %.0f records/s\n", totals.Throughput)
+	}
+	if verbose && totals.WarmUp != 0 {
+		fmt.Printf("Connections warmed up in %v\n", totals.WarmUp)
+	}
+	if verbose && totals.Backpressure != nil {
+		fmt.Printf("Reading blocked on the workers %v, workers waited for input %v\n", totals.Backpressure.ReadBlocked, totals.Backpressure.WorkersStarved)
+	}
+	if verbose && len(totals.Records.Slowest) > 0 {
+		fmt.Println("Slowest batches:")
+		for _, timing := range totals.Records.Slowest {
+			fmt.Printf("  %v worker %d record %d, %d records into %s", timing.Duration, timing.Worker, timing.Record, timing.Records, timing.Table)
+			if timing.Key != "" {
+				fmt.Printf(" from %s %s", conflictKey, timing.Key)
+			}
+			fmt.Println()
+		}
+	}
+	for _, path := range totals.SkippedFiles {
+		fmt.Printf("Skipped %s: already loaded\n", path)
+	}
+	if totals.Error != nil {
+		fmt.Printf("Error: %s\n", totals.Error)
+	}
+}
+
+func printTotalsJSON(totals *totals) {
+	json, _ := json.MarshalIndent(totals, "", "   ")
+	fmt.Printf("%s\n", json)
+}
+
+// writeTotalsJSON saves the totals in JSON to a file creating its parent directories if needed.
+func writeTotalsJSON(path string, totals *totals) error {
+	json, _ := json.MarshalIndent(totals, "", "   ")
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(json, '\n'), 0644)
+}
+
+// exitNothingAffected is the exit status of a successful load that affected no records with -fail-if-zero-affected.
+// 1 is taken by failures and 2 by invalid flags.
+const exitNothingAffected = 3
+
+// historyEntry is a line of -history-file: the totals of a run along with what was loaded where and when.
+type historyEntry struct {
+	Time  time.Time
+	Table string
+	// The input files or - for stdin
+	Files []string
+	totals
+}
+
+// appendHistory appends the entry to the file as a line of JSON creating the file if needed.
+// The line goes to the end of the file in a single write so that runs sharing the file
+// don't interleave their lines, on a local file system at least.
+func appendHistory(path string, entry historyEntry) error {
+	line, _ := json.Marshal(entry)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// validate checks the settings of the load against each other and the loaded columns.
+func validate(config config) error {
+	if config.EmitAndRun && config.EmitSQL == "" {
+		return errors.New("-emit-and-run requires -emit-sql")
+	}
+	if config.MaxBatchRetries < 0 {
+		return errors.New("-max-batch-retries can't be negative")
+	}
+	if config.StampImportId && config.ImportId == 0 && config.ImportIdFrom == "" {
+		return errors.New("-stamp-import-id needs an import id, from -i, -import-id-from or -import-id-regex")
+	}
+
+	if config.SortBatch && columnIndex(config.Columns, conflictKey) < 0 {
+		return fmt.Errorf("Can't sort batches: column '%s' is not loaded", conflictKey)
+	}
+
+	if config.CreateTable {
+		if config.CreateTableTypes != createTypesInfer && config.CreateTableTypes != createTypesText {
+			return fmt.Errorf("Invalid table types '%s', expected %s or %s", config.CreateTableTypes, createTypesInfer, createTypesText)
+		}
+		if len(config.RecreateIndex) > 0 {
+			return errors.New("Can't use -recreate-index with -create-table, a new table has no indexes")
+		}
+		switch {
+		case config.StrictTypes:
+			return errors.New("Can't use -strict-types with -create-table")
+		case config.JSONEmpty != "":
+			return errors.New("Can't use -json-empty-null or -json-empty-object with -create-table")
+		}
+	}
+
+	if config.Isolation >= sql.LevelRepeatableRead && config.PreserveOrder {
+		return errors.New("Can't use -isolation with -preserve-order")
+	}
+	if config.ShardBy != "" {
+		if config.PreserveOrder {
+			return errors.New("Can't use -shard-by with -preserve-order")
+		}
+		if columnIndex(config.Columns, config.ShardBy) < 0 {
+			return fmt.Errorf("Can't shard by column '%s': it is not loaded", config.ShardBy)
+		}
+	}
+	if config.PreserveOrder && config.PartitionBy != "" {
+		return errors.New("Can't use -preserve-order with -partition-by")
+	}
+
+	if config.CountExpr != "" && config.RowsAffected {
+		return errors.New("Can't use -count-expr with -rows-affected")
+	}
+
+	switch config.Conflict {
+	case conflictSkip, conflictError:
+	case conflictUpdate:
+		if columnIndex(config.Columns, conflictKey) < 0 {
+			return fmt.Errorf("Can't update on conflict: column '%s' is not loaded", conflictKey)
+		}
+	default:
+		return fmt.Errorf("Invalid conflict mode '%s', expected %s, %s or %s", config.Conflict, conflictSkip, conflictError, conflictUpdate)
+	}
+	if len(config.JSONMerge) > 0 {
+		if config.Conflict != conflictUpdate {
+			return errors.New("-json-merge-cols requires -conflict update")
+		}
+		if config.CreateTable {
+			return errors.New("Can't use -json-merge-cols with -create-table")
+		}
+		for _, column := range config.JSONMerge {
+			if columnIndex(config.Columns, column) < 0 {
+				return fmt.Errorf("Can't merge column '%s': it is not loaded", column)
+			}
+		}
+	}
+	if config.DupAuditTable != "" {
+		switch {
+		case config.Conflict != conflictSkip:
+			return fmt.Errorf("Nothing is skipped with -conflict %s, -dup-audit-table can't be used", config.Conflict)
+		case config.CountExpr != "" || config.RowsAffected:
+			return errors.New("Can't use -dup-audit-table with -count-expr or -rows-affected")
+		case columnIndex(config.Columns, conflictKey) < 0:
+			return fmt.Errorf("Can't tell skipped records: column '%s' is not loaded", conflictKey)
+		}
+	}
+
+	if len(config.NormalizeCols) > 0 && config.Normalize == "" {
+		return errors.New("-normalize-cols requires -normalize")
+	}
+	if _, err := buildNormalizers(config); err != nil {
+		return err
+	}
+	if _, err := buildCoercions(config); err != nil {
+		return err
+	}
+	switch config.OnCoerceError {
+	case coerceFail, coerceNull:
+	case coerceReject:
+		if config.Rejects == nil {
+			return errors.New("-on-coerce-error reject needs -reject-file")
+		}
+	default:
+		return fmt.Errorf("Invalid coerce error policy '%s', expected %s, %s or %s", config.OnCoerceError, coerceFail, coerceNull, coerceReject)
+	}
+	if _, err := requiredIndexes(config); err != nil {
+		return err
+	}
+
+	if (config.PartitionBy == "") != (config.PartitionTemplate == "") {
+		return errors.New("-partition-by and -partition-template go together")
+	}
+	if config.PartitionBy != "" && columnIndex(config.Columns, config.PartitionBy) < 0 {
+		return fmt.Errorf("Can't partition by column '%s': it is not loaded", config.PartitionBy)
+	}
+
+	return nil
+}
+
+func main() {
+	var (
+		dbConn             string
+		config             config
+		maxProcs           int
+		totals             totals
+		outputJSON         bool
+		quiet              bool
+		summary            string
+		historyFile        string
+		textfileOut        string
+		manifestFile       string
+		manifestHash       bool
+		stdinDigest        *digestReader
+		validateSchema     bool
+		positional         string
+		ignoreCols         columnNames
+		renames            columnValues
+		colsFromTable      bool
+		excludeCols        columnNames
+		ddlFile            string
+		mapFile            string
+		recordSep          string
+		encodingName       string
+		inputEncoding      encoding.Encoding
+		detectEncodings    bool
+		separator          byte
+		ddlTypes           bool
+		connectTimeout     time.Duration
+		validateConn       bool
+		searchPath         string
+		keepalivesIdle     time.Duration
+		printSQL           int
+		importIdRegex      string
+		importIdStrict     bool
+		twoPhase           bool
+		benchmarkRows      int
+		benchmarkSeed      int64
+		benchmarkDupeRate  float64
+		progressFormat     string
+		tailSummary        bool
+		failIfZeroAffected bool
+		emptyJSONNull      bool
+		emptyJSONObject    bool
+		progressInterval   time.Duration
+		progressEveryRows  int64
+		maxDuration        time.Duration
+		notifyURL          string
+		notifyOn           string
+		rejectFile         string
+		skippedFile        string
+		prefilterValue     string
+		estimateMode       bool
+		estimateSample     int
+		driverName         string
+		dedupe             string
+		verbose            bool
+		transform          string
+		ledgerHash         bool
+		summaryList        string
+		forceGzip          bool
+		noGzip             bool
+		parseErrorFile     string
+		keepBlankLines     bool
+		packJSON           string
+		packJSONNulls      string
+		strictColumns      bool
+		readBuffer         int
+		reader             *csv.Reader
+		baseReader         *bufio.Reader
+		concat             bool
+		inputGlob          string
+		concatenated       *concatReader
+		inputFile          *os.File
+		retryFile          int
+	)
+
+	flag.StringVar(&dbConn, "c", "", "Database connection string")
+	flag.BoolVar(&validateConn, "validate-dsn", false, "Check the connection string without connecting, print its parameters with the password redacted and exit")
+	flag.StringVar(&driverName, "driver", driverPq, "Database `driver` to connect with: postgres (lib/pq) or pgx")
+	flag.StringVar(&searchPath, "search-path", "", "Comma separated `schemas` to set as the search_path of every connection so that an unqualified -t resolves in them")
+	flag.StringVar(&config.TimeZone, "timezone", "", "Time `zone` to set as the TimeZone of every connection, e.g. UTC or America/New_York, to interpret timestamps without an offset in")
+	flag.DurationVar(&connectTimeout, "connect-timeout", 0, "Max time to wait for a connection unless connect_timeout is in the connection string")
+	flag.DurationVar(&keepalivesIdle, "keepalives-idle", 0, "Idle time before sending TCP keepalives unless keepalives_idle is in the connection string")
+	flag.IntVar(&retryFile, "retry-file", 0, "Reload the input file from the start up to `N` times after losing the connection, relying on -conflict to skip what has been loaded")
+	flag.IntVar(&config.ConnectRetries, "connect-retries", 0, "Number of times to retry connecting to the database")
+	flag.DurationVar(&config.ConnectRetryInterval, "connect-retry-interval", time.Second, "Interval before the first connection retry, doubled with every attempt")
+	flag.IntVar(&config.Workers, "w", 4, "Number of workers")
+	flag.BoolVar(&config.WarmPool, "warm-pool", false, "Open a connection for every worker before reading the input")
+	flag.IntVar(&config.ImportId, "i", 0, "Import Id")
+	flag.BoolVar(&config.StampImportId, "stamp-import-id", false, "Write the import id into the importid column of every loaded row")
+	flag.StringVar(&importIdRegex, "import-id-regex", "", "A `regex` whose first capture group extracts the import id from the input file name e.g. _imp(\\d+)")
+	flag.BoolVar(&importIdStrict, "import-id-strict", false, "Fail if the input file name doesn't match -import-id-regex instead of falling back to -i")
+	flag.StringVar(&config.ImportIdFrom, "import-id-from", "", "SQL query returning the import id to use e.g. INSERT INTO imports DEFAULT VALUES RETURNING id")
+	flag.StringVar(&config.Table, "t", "marketo.activities", "Database table to load data into")
+	flag.BoolVar(&estimateMode, "estimate", false, "Suggest the number of records per insert and exit without loading")
+	flag.IntVar(&estimateSample, "estimate-sample", 0, "Benchmark a few insert sizes loading this many records of the input into a temporary table with -estimate")
+	flag.BoolVar(&validateSchema, "validate-schema", false, "Compare the CSV header to the table columns and exit without loading")
+	flag.BoolVar(&config.StrictSchema, "strict-schema", false, "Fail if the CSV header doesn't match the table columns")
+	flag.BoolVar(&config.FoldCase, "columns-case-insensitive", false, "Match the columns to the table columns with Unicode case folding and load them under the names of the table")
+	flag.BoolVar(&config.FoldAccents, "fold-accents", false, "Strip the accents when matching the columns to the table columns. Implies -columns-case-insensitive")
+	flag.Var(&config.Required, "required", "Comma separated `columns` that must not be empty or NULL. Can be repeated")
+	flag.BoolVar(&emptyJSONNull, "json-empty-null", false, "Load empty and whitespace only values of json and jsonb columns as NULL")
+	flag.BoolVar(&emptyJSONObject, "json-empty-object", false, "Load empty and whitespace only values of json and jsonb columns as {}")
+	flag.BoolVar(&config.StrictTypes, "strict-types", false, "Check that values parse as the types of their columns in the table before inserting them")
+	flag.Var(&config.AsInt, "as-int", "Column whose values like 12.0 are loaded as integers. Can be repeated")
+	flag.Var(&config.AsBool, "as-bool", "Column whose values like t/f, yes/no or 1/0 are loaded as booleans. Can be repeated")
+	flag.StringVar(&config.Normalize, "normalize", "", "Unicode normalization `form` of the text: nfc or nfd")
+	flag.Var(&config.NormalizeCols, "normalize-cols", "Comma separated `columns` -normalize is applied to instead of all. Can be repeated")
+	flag.StringVar(&config.PartitionBy, "partition-by", "", "Column to route records to partitions of the table by")
+	flag.StringVar(&config.PartitionTemplate, "partition-template", "", "Partition name template e.g. activities_%Y%m. %Y, %m, %d and %H stand for parts of the partition key timestamp, %s for the key itself")
+	flag.StringVar(&config.OnCoerceError, "on-coerce-error", coerceFail, "What to do with a value -types can't convert: fail the load, load null instead or reject the record")
+	flag.Var(&config.Types, "types", "Column `col=type` converted before loading: bytea, smallint, integer or bigint. Can be repeated")
+	flag.StringVar(&config.ByteaEncoding, "bytea-encoding", byteaHex, "Encoding of bytea values: hex or base64")
+	flag.Var(&config.Exprs, "expr", "Additional `col=EXPR` column whose value is computed by a raw SQL expression. Can be repeated")
+	flag.StringVar(&positional, "positional", "", "Comma separated `index:column` pairs mapping CSV fields of a headerless file to columns e.g. 0:leadid,2:activitydate")
+	flag.BoolVar(&colsFromTable, "cols-from-table", false, "Load headerless files into the columns of the table in their table order, leaving out generated and identity columns")
+	flag.StringVar(&config.EmitSQL, "emit-sql", "", "Write the statements the load would run to a `file` for review and exit without loading")
+	flag.BoolVar(&config.EmitAndRun, "emit-and-run", false, "Load the input after writing -emit-sql")
+	flag.Var(&renames, "rename", "Rename a column of the header as `old=new` before the columns are mapped by name. Can be repeated")
+	flag.Var(&ignoreCols, "ignore-cols", "Comma separated zero based indices or header names of CSV `fields` to drop before binding the rest to the columns")
+	flag.Var(&excludeCols, "exclude-cols", "Comma separated `columns` to leave out with -cols-from-table. Can be repeated")
+	flag.StringVar(&prefilterValue, "prefilter", "", "Skip the lines of the input that don't contain this `substring` before parsing them")
+	flag.StringVar(&config.NullEscape, "null-escape", "", "A `prefix` that makes a null field load as the literal string, e.g. \\null loads null. One level of the prefix is stripped")
+	flag.StringVar(&dedupe, "dedupe", "", "Of the records sharing a conflict key in the input load only the first or the last one as the `mode` says")
+	flag.StringVar(&transform, "transform", "", "An `expression` evaluated for every record with the fields as variables that returns a map of columns to their new values")
+	flag.StringVar(&encodingName, "encoding", "", "Character `encoding` of the input e.g. windows-1252 or latin1, transcoded to UTF-8 before parsing (default UTF-8)")
+	flag.BoolVar(&detectEncodings, "detect-encoding", false, "Guess the character encoding of the input from its first 64KB unless -encoding is given")
+	flag.StringVar(&recordSep, "record-sep", "", "Split the input into records on this `character` instead of newlines e.g. \\0 or \\x1e")
+	flag.StringVar(&mapFile, "map-file", "", "A CSV `file` of header,column pairs mapping the fields of the header by name to the columns they are loaded into")
+	flag.StringVar(&ddlFile, "ddl-file", "", "A `file` with a CREATE TABLE statement whose columns are loaded in their order instead of the default columns")
+	flag.BoolVar(&ddlTypes, "ddl-types", false, "Convert the columns -ddl-file defines as bytea, smallint, integer or bigint as with -types")
+	flag.Var(&config.ExpectHeader, "expect-header", "Comma separated `columns` the header of the input has to list in this order for the file to be loaded")
+	flag.BoolVar(&config.HeaderFold, "header-fold", false, "Ignore the case of the column names comparing the header to -expect-header")
+	flag.StringVar(&config.HeaderFile, "header-file", "", "A CSV file whose first line holds the column names. Input files are then treated as headerless")
+	flag.IntVar(&maxProcs, "p", 1, "Max logical processors")
+	flag.BoolVar(&outputJSON, "json", false, "Output results in JSON")
+	flag.BoolVar(&quiet, "quiet", false, "Don't output results to stdout")
+	flag.StringVar(&config.LedgerTable, "ledger-table", "", "`table` of loaded files to skip the input file if it has been loaded before and record it after loading")
+	flag.BoolVar(&ledgerHash, "ledger-hash", false, "Identify files in the ledger by a SHA-256 of their contents instead of the path, size and modification time")
+	flag.BoolVar(&verbose, "verbose", false, "Print the slowest batch inserts, the time warming up the pool and the backpressure along with the totals, and log the -m auto insert size, the detected encoding, the -glob matches, the columns matched regardless of case and the -rename columns missing from the header")
+	flag.DurationVar(&maxDuration, "max-duration", 0, "Stop loading and commit what has been loaded once this `duration` has passed since the start e.g. 30m")
+	flag.Uint64Var(&config.MaxMemory, "max-memory", 0, "Stop loading and commit what has been loaded once the memory use exceeds this many `bytes` (default unlimited)")
+	flag.StringVar(&summaryList, "summary-fields", "", "Comma separated `fields` of the totals to print in this order: processed,affected,skipped,rejected,duration,rps,memory,transactions")
+	flag.BoolVar(&failIfZeroAffected, "fail-if-zero-affected", false, "Exit with status 3 when the load succeeds but affects no records")
+	flag.StringVar(&notifyURL, "notify-url", "", "A `URL` to POST results in JSON to when the load is over")
+	flag.StringVar(&notifyOn, "notify-on", notifyAlways, "When to notify -notify-url: success, failure or always")
+	flag.StringVar(&summary, "summary-file", "", "A file to write results in JSON to")
+	flag.Var(&config.RecreateIndex, "recreate-index", "Comma separated `indexes` of the table to drop before the load and create again after it")
+	flag.StringVar(&historyFile, "history-file", "", "A `file` to append the results of every run to as a line of JSON")
+	flag.StringVar(&textfileOut, "textfile-out", "", "A `file` to write the totals of the run to in the Prometheus text format for the textfile collector of node_exporter")
+	flag.StringVar(&manifestFile, "manifest-file", "", "A `file` to write the input files, their sizes and the totals of a successful load to in JSON")
+	flag.BoolVar(&manifestHash, "manifest-hash", false, "Add a SHA-256 of the contents of every input file to -manifest-file, reading the files again after the load")
+	flag.Var(&config.JSONMerge, "json-merge-cols", "Comma separated jsonb `columns` -conflict update merges with || instead of overwriting. Can be repeated")
+	flag.StringVar(&config.Conflict, "conflict", conflictSkip, "What to do with a record whose conflict key is already in the table: skip it, error or update the row")
+	flag.StringVar(&rejectFile, "reject-file", "", "Write the records the database refuses to load to this CSV `file` along with the error and go on loading the rest")
+	flag.StringVar(&skippedFile, "skipped-file", "", "Write the records skipped because of a conflict to this CSV `file`")
+	flag.StringVar(&config.DupAuditTable, "dup-audit-table", "", "Insert the conflict keys of the records skipped because of a conflict into this `table` in the transaction of their batch")
+	flag.StringVar(&parseErrorFile, "parse-error-file", "", "Write the lines that fail to parse as CSV to this `file` and go on loading the rest")
+	flag.BoolVar(&keepBlankLines, "keep-blank-lines", false, "Load the blank lines of the input as records instead of skipping them")
+	flag.StringVar(&packJSON, "pack-json", "", "Load every record as a JSON object keyed by the names of the header into this jsonb `column`")
+	flag.StringVar(&packJSONNulls, "pack-json-nulls", packNullsNull, "What -pack-json makes of a null field, null or omit")
+	flag.BoolVar(&strictColumns, "strict-columns", false, "Fail if the input has more columns than are loaded instead of leaving the extra ones out")
+	flag.BoolVar(&forceGzip, "gzip", false, "Decompress the input as gzip without detecting it")
+	flag.BoolVar(&noGzip, "no-gzip", false, "Read the input as is without detecting gzip")
+	flag.IntVar(&readBuffer, "read-buffer", defaultReadBuffer, "Input read buffer size in bytes")
+	flag.IntVar(&config.MaxRowBytes, "max-row-bytes", 0, "Reject records larger than `N` bytes to the parse error or the reject file instead of loading them (default unlimited)")
+	config.InsertSize = 2
+	flag.Func("m", "Number of records per insert or auto for as many as the bind parameters allow (default 2)", func(value string) error {
+		if value == "auto" {
+			config.InsertSize = autoInsertSize
+			return nil
+		}
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return fmt.Errorf("invalid insert size '%s'", value)
+		}
+		config.InsertSize = size
+		return nil
+	})
+	flag.IntVar(&config.TxSize, "x", 25000, "Number of records per transaction")
+	flag.BoolVar(&config.Ordered, "ordered", false, "Load with a single worker so that the outcome of conflicting records is deterministic")
+	flag.BoolVar(&config.RowsAffected, "rows-affected", false, "Count affected records from the result of a plain INSERT instead of wrapping it into a counting query")
+	flag.StringVar(&config.BatchHook, "batch-hook", "", "`SQL` to run in the transaction of every batch right after inserting it e.g. \"SELECT pg_sleep(0.1)\"")
+	flag.StringVar(&config.CountExpr, "count-expr", "", "Raw SQL aggregate over the inserted rows to count as affected instead of COUNT(*)")
+	flag.IntVar(&printSQL, "print-sql", 0, fmt.Sprintf("Print the first `N` inserts with their values to stderr, up to %d", maxPrintSQL))
+	flag.Func("advisory-lock", "Take the advisory lock with this `key` at the start of every transaction", func(value string) error {
+		key, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid advisory lock key '%s'", value)
+		}
+		config.AdvisoryLock = &key
+		return nil
+	})
+	flag.Func("isolation", "Isolation `level` of the transactions: read-committed, repeatable-read or serializable", func(value string) error {
+		level, ok := isolationLevels[value]
+		if !ok {
+			return fmt.Errorf("invalid isolation level '%s'", value)
+		}
+		config.Isolation = level
+		return nil
+	})
+	flag.IntVar(&config.MaxBatchRetries, "max-batch-retries", 0, "Number of times to insert a batch again after a deadlock, a lock or a statement timeout before failing it or, with -reject-file, inserting its records one by one")
+	flag.IntVar(&config.MaxRetries, "max-retries", 3, "Number of times to replay a transaction after a serialization failure under -isolation")
+	flag.BoolVar(&config.AdvisoryLockTry, "advisory-lock-try", false, "Stop the load instead of waiting when the advisory lock is held by another session")
+	flag.BoolVar(&config.CreateTable, "create-table", false, "Create the table if it doesn't exist with the column types inferred from the first records")
+	flag.IntVar(&config.CreateTableSample, "create-table-sample", 1000, "Number of records to infer the column types from with -create-table")
+	flag.StringVar(&config.CreateTableTypes, "create-table-types", createTypesInfer, "How -create-table picks the column types: infer or text")
+	flag.StringVar(&config.ShardBy, "shard-by", "", "Route every record to a worker by the hash of its value of this `column` so that workers never share a value")
+	flag.BoolVar(&config.PreserveOrder, "preserve-order", false, "Insert and commit batches in the order of the input while still preparing them in parallel")
+	flag.BoolVar(&twoPhase, "2pc", false, "Prepare the transactions of all workers and commit them together only if the whole load succeeds")
+	flag.StringVar(&inputGlob, "glob", "", "A `pattern` of the input files to load in their sorted order, one after another or as one input with -concat")
+	flag.BoolVar(&concat, "concat", false, "Read the input files one after another as one CSV file with the header in the first one")
+	flag.IntVar(&benchmarkRows, "benchmark", 0, "Load `N` synthetic records instead of the input to measure the insert throughput")
+	flag.Int64Var(&benchmarkSeed, "benchmark-seed", 1, "Seed of the synthetic records of -benchmark")
+	flag.Float64Var(&benchmarkDupeRate, "benchmark-dupe-rate", 0, "Fraction of the synthetic records of -benchmark that reuse an earlier conflict key")
+	flag.BoolVar(&tailSummary, "tail-summary-on-signal", false, "Print the totals so far on Ctrl-C and stop the load only on a second Ctrl-C within 5s")
+	flag.StringVar(&progressFormat, "progress-format", progressNone, "Report the progress to stderr as plain text, json lines or none")
+	flag.DurationVar(&progressInterval, "progress-interval", 10*time.Second, "How often -progress-format reports the progress, 0 to report by -progress-every-rows only")
+	flag.Int64Var(&progressEveryRows, "progress-every-rows", 0, "Report the progress every `N` processed records as well (default never)")
+	flag.BoolVar(&config.SortBatch, "sort-batch", false, "Sort records of every insert by the conflict key to reduce deadlocks between workers")
+	flag.Var(&config.Rate, "rate", "Max `N` records per second, or bytes per second with a KB, MB or GB suffix (default unlimited)")
+	flag.IntVar(&config.RateBurst, "rate-burst", 0, "Max burst of records or bytes for -rate (default one second worth)")
+
+	flag.Usage = func() {
+		fmt.Printf("Usage: %s [options] [file...]\n", filepath.Base(os.Args[0]))
+		fmt.Println("  file")
+		fmt.Println("    	A CSV file to load. If omitted read from stdin")
+		flag.PrintDefaults()
+		fmt.Println()
+		fmt.Println("Ctrl-C or SIGTERM stops reading the input, commits what has been read and ends the load,")
+		fmt.Println("a second Ctrl-C terminates pload at once. With -tail-summary-on-signal the first Ctrl-C")
+		fmt.Println("prints the totals so far instead and the load goes on, a second one within 5s stops it.")
+	}
+	flag.Parse()
+
+	// A view takes no ON CONFLICT so it matters whether skipping duplicates was asked for
+	flag.Visit(func(f *flag.Flag) {
+		config.ConflictSet = config.ConflictSet || f.Name == "conflict"
+	})
+
+	if searchPath != "" {
+		var err error
+		searchPath, err = formatSearchPath(searchPath)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	// Only check the connection string and exit
+	if validateConn {
+		params, err := validateDSN(driverName, dbConn, connectTimeout, keepalivesIdle, searchPath, config.TimeZone)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		fmt.Println("Connection string is valid")
+		for _, param := range params {
+			fmt.Printf("  %s\n", param)
+		}
+		return
+	}
+
+	// The first record in file order wins a conflict only if there
+	// is no other worker to race with
+	if config.Ordered {
+		config.Workers = 1
+	}
+
+	config.PrintSQL = newSQLPrinter(os.Stderr, printSQL)
+
+	if err := checkTableName(config.Table); err != nil {
+		logger.Fatal(err)
+	}
+
+	if notifyOn != notifySuccess && notifyOn != notifyFailure && notifyOn != notifyAlways {
+		logger.Fatalf("Invalid notify mode '%s', expected %s, %s or %s", notifyOn, notifySuccess, notifyFailure, notifyAlways)
+	}
+
+	var fields []string
+	if summaryList != "" {
+		var err error
+		fields, err = parseSummaryFields(summaryList)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	// Set the number of logical processors to use
+	runtime.GOMAXPROCS(maxProcs)
+
+	// Start timing
+	start := time.Now()
+	if maxDuration > 0 {
+		config.Deadline = start.Add(maxDuration)
+	}
+
+	var idPattern *regexp.Regexp
+	if importIdRegex != "" {
+		if config.ImportIdFrom != "" {
+			logger.Fatal("Can't use -import-id-regex and -import-id-from together")
+		}
+		var err error
+		idPattern, err = regexp.Compile(importIdRegex)
+		if err != nil {
+			logger.Fatalf("Invalid import id regex: %v", err)
+		}
+		if idPattern.NumSubexp() < 1 {
+			logger.Fatal("The import id regex needs a capture group")
+		}
+	}
+
+	if encodingName != "" {
+		var err error
+		inputEncoding, err = lookupEncoding(encodingName)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	if recordSep != "" {
+		var err error
+		separator, err = parseRecordSeparator(recordSep)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		// The lines the parse error file is made of are no longer those of the input
+		if parseErrorFile != "" {
+			logger.Fatal("Can't use -record-sep with -parse-error-file")
+		}
+	}
+
+	switch progressFormat {
+	case progressNone:
+	case progressPlain, progressJSON:
+		if progressInterval < 0 || progressEveryRows < 0 {
+			logger.Fatal("-progress-interval and -progress-every-rows can't be negative")
+		}
+		if progressInterval == 0 && progressEveryRows == 0 {
+			logger.Fatal("-progress-format needs -progress-interval or -progress-every-rows")
+		}
+		config.Progress = newProgress(progressFormat, progressInterval, progressEveryRows)
+	default:
+		logger.Fatalf("Invalid progress format '%s'", progressFormat)
+	}
+	if verbose {
+		config.Backpressure = &backpressure{}
+	}
+	// The totals so far come from the counters of the progress, which then reports nothing
+	if tailSummary && config.Progress == nil {
+		progressInterval, progressEveryRows = 0, 0
+		config.Progress = newProgress(progressNone, progressInterval, progressEveryRows)
+	}
+	if tailSummary {
+		config.Status = func() {
+			// The import id is in place once the records are being loaded
+			status := totals
+			status.Records = ingestResult{
+				Processed: int(config.Progress.processed.Load()),
+				Affected:  int(config.Progress.affected.Load()),
+			}
+			status.Duration = time.Since(start)
+			status.Memory = memoryUsage()
+			if outputJSON {
+				printTotalsJSON(&status)
+			} else {
+				printTotals(&status, fields, verbose)
+			}
+		}
+	}
+
+	// The input files, either given or matched by -glob the same way on any platform
+	inputs := flag.Args()
+	if inputGlob != "" {
+		if len(inputs) > 0 {
+			logger.Fatal("Can't use -glob with input files, the pattern selects them")
+		}
+		matches, err := filepath.Glob(inputGlob)
+		if err != nil {
+			logger.Fatalf("Invalid -glob pattern '%s': %v", inputGlob, err)
+		}
+		if len(matches) == 0 {
+			logger.Fatalf("-glob pattern '%s' matches no files", inputGlob)
+		}
+		sort.Strings(matches)
+		if verbose {
+			logger.Printf("-glob matches %s", strings.Join(matches, ", "))
+		}
+		inputs = matches
+	}
+
+	if benchmarkRows < 0 {
+		logger.Fatal("The number of -benchmark records can't be negative")
+	}
+	if benchmarkRows > 0 {
+		if len(inputs) > 0 {
+			logger.Fatal("-benchmark generates its records, it can't load an input file")
+		}
+		if benchmarkDupeRate < 0 || benchmarkDupeRate > 1 {
+			logger.Fatal("-benchmark-dupe-rate must be between 0 and 1")
+		}
+		config.Benchmark = &benchmark{Rows: benchmarkRows, Seed: benchmarkSeed, DupeRate: benchmarkDupeRate}
+	}
+	if manifestHash && manifestFile == "" {
+		logger.Fatal("-manifest-hash requires -manifest-file")
+	}
+	if manifestFile != "" && config.Benchmark != nil {
+		logger.Fatal("-benchmark has no input to write a manifest of")
+	}
+
+	// Without -concat several files are loaded one after another, each with the import id of its name
+	multiFile := len(inputs) > 1 && !concat
+	defaultImportId := config.ImportId
+	// The file name overrides -i unless it doesn't match
+	importIdOf := func(path string) (int, error) {
+		importId, ok, err := importIdFromName(idPattern, path)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return importId, nil
+		}
+		if importIdStrict {
+			return 0, fmt.Errorf("File name '%s' doesn't match the import id regex", path)
+		}
+		return defaultImportId, nil
+	}
+
+	switch {
+	case config.Benchmark != nil:
+		// Nothing is read, the columns come from -header-file, -positional, -cols-from-table or the defaults
+		baseReader = bufio.NewReader(strings.NewReader(""))
+	case concat:
+		if len(inputs) < 1 {
+			logger.Fatal("-concat needs input files")
+		}
+		if idPattern != nil || config.LedgerTable != "" {
+			logger.Fatal("Can't use -import-id-regex or -ledger-table with -concat, leave it out to load the files one after another")
+		}
+		if config.Progress != nil {
+			for _, path := range inputs {
+				if info, err := os.Stat(path); err == nil {
+					config.Progress.size += info.Size()
+				}
+			}
+		}
+		concatenated = newConcatReader(inputs, readBuffer, func(r *bufio.Reader) (io.Reader, error) {
+			return uncompress(r, forceGzip, noGzip)
+		}, config.Progress.count)
+		defer concatenated.Close()
+		baseReader = bufio.NewReaderSize(concatenated, readBuffer)
+	case len(inputs) < 1:
+		if idPattern != nil && importIdStrict {
+			logger.Fatal("-import-id-regex needs an input file to take the import id from")
+		}
+		if config.LedgerTable != "" {
+			logger.Fatal("-ledger-table needs an input file")
+		}
+		// Stdin can't be read again to be described after the load
+		var stdin io.Reader = os.Stdin
+		if manifestFile != "" {
+			stdinDigest = newDigestReader(os.Stdin, manifestHash)
+			stdin = stdinDigest
+		}
+		baseReader = bufio.NewReaderSize(stdin, readBuffer)
+	default:
+		path := inputs[0]
+		file, err := os.Open(path)
+		if err != nil {
+			logger.Fatalf("Can't open input file '%s'", path)
+		}
+		defer file.Close()
+		inputFile = file
+
+		if idPattern != nil {
+			config.ImportId, err = importIdOf(path)
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+
+		if config.LedgerTable != "" {
+			config.Ledger, err = newLedgerEntry(path, ledgerHash)
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+
+		// Compressed input counts by the compressed bytes read out of the size of all the files
+		if config.Progress != nil {
+			if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+				config.Progress.size = info.Size()
+			}
+			for _, path := range inputs[1:] {
+				if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+					config.Progress.size += info.Size()
+				}
+			}
+		}
+		baseReader = bufio.NewReaderSize(config.Progress.count(file), readBuffer)
+	}
+
+	if forceGzip && noGzip {
+		logger.Fatal("Can't use -gzip and -no-gzip together")
+	}
+
+	if !keepBlankLines {
+		config.BlankLines = &blankLines{}
+	}
+
+	// Build the CSV reader on top of the input, again for every retry of -retry-file
+	options := readerOptions{
+		ForceGzip:      forceGzip,
+		NoGzip:         noGzip,
+		Decompressed:   concatenated != nil,
+		BufferSize:     readBuffer,
+		Encoding:       inputEncoding,
+		DetectEncoding: detectEncodings && encodingName == "",
+		Verbose:        verbose,
+		RecordSep:      recordSep != "",
+		Separator:      separator,
+		Prefilter:      prefilterValue,
+		PrefilterKeep:  1,
+		ParseErrorFile: parseErrorFile,
+		BlankLines:     config.BlankLines,
+	}
+	if config.HeaderFile != "" || positional != "" || colsFromTable {
+		options.PrefilterKeep = 0
+	}
+	var err error
+	reader, config.ParseErrors, err = newReader(baseReader, options)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	db, err := openDB(driverName, dbConn, connectTimeout, keepalivesIdle, searchPath, config.TimeZone)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer db.Close()
+
+	config.Columns = defaultColumns
+	exclusive := 0
+	for _, set := range []bool{config.HeaderFile != "", positional != "", colsFromTable, ddlFile != ""} {
+		if set {
+			exclusive++
+		}
+	}
+	if exclusive > 1 {
+		logger.Fatal("Only one of -header-file, -positional, -cols-from-table and -ddl-file can be used")
+	}
+	if mapFile != "" {
+		switch {
+		case positional != "" || colsFromTable || ddlFile != "":
+			logger.Fatal("-map-file maps the fields of a header, it can't be used with -positional, -cols-from-table or -ddl-file")
+		case config.FoldCase || config.FoldAccents:
+			logger.Fatal("Can't use -map-file with -columns-case-insensitive or -fold-accents, the map names the columns")
+		case config.Benchmark != nil:
+			logger.Fatal("-benchmark has no header to map")
+		case len(ignoreCols) > 0:
+			logger.Fatal("Can't use -ignore-cols with -map-file, leave the fields out of the map instead")
+		}
+	}
+	if len(config.ExpectHeader) > 0 && (positional != "" || colsFromTable || config.Benchmark != nil) {
+		logger.Fatal("-expect-header needs a header, either in the input or in -header-file")
+	}
+	if config.HeaderFold && len(config.ExpectHeader) == 0 {
+		logger.Fatal("-header-fold requires -expect-header")
+	}
+	if ddlTypes && ddlFile == "" {
+		logger.Fatal("-ddl-types requires -ddl-file")
+	}
+	if len(excludeCols) > 0 && !colsFromTable {
+		logger.Fatal("-exclude-cols requires -cols-from-table")
+	}
+	// A DDL that can't be parsed leaves the default columns in place
+	if ddlFile != "" {
+		columns, err := readDDL(ddlFile)
+		var names []string
+		if err == nil {
+			names, err = ddlColumnNames(columns, config)
+		}
+		if err != nil {
+			logger.Printf("%v, loading the default columns", err)
+		} else {
+			config.Columns = names
+			if ddlTypes {
+				config.Types = append(config.Types, ddlColumnTypes(columns, config)...)
+			}
+		}
+	}
+	// Adapt the header to upstream renames before anything goes by its names
+	rename := func(header []string) []string {
+		renamed, missing, err := renameColumns(header, renames)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if verbose {
+			for _, name := range missing {
+				logger.Printf("Column %s is not in the header, nothing to rename", name)
+			}
+			logger.Printf("Header %s", strings.Join(renamed, ","))
+		}
+		return renamed
+	}
+	if len(renames) > 0 && (positional != "" || colsFromTable || ddlFile != "") {
+		logger.Fatal("-rename renames the columns of a header, it can't be used with -positional, -cols-from-table or -ddl-file")
+	}
+	if config.HeaderFile != "" {
+		config.Columns, err = readHeader(config.HeaderFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if len(renames) > 0 {
+			config.Columns = rename(config.Columns)
+		}
+	}
+	if positional != "" {
+		config.Columns, config.Positions, err = parsePositional(positional)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if colsFromTable {
+		err = connect(db, config)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		config.Columns, err = insertableColumns(db, config, excludeCols)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		// Every record has to provide a field for each of the columns
+		reader.FieldsPerRecord = len(config.Columns)
+	}
+	if (config.FoldCase || config.FoldAccents) && !colsFromTable {
+		if config.CreateTable {
+			logger.Fatal("Can't match the columns of a table that is yet to be created, -columns-case-insensitive and -fold-accents can't be used with -create-table")
+		}
+		err = connect(db, config)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		var mapping []string
+		config.Columns, mapping, err = resolveColumns(db, config)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if verbose {
+			for _, line := range mapping {
+				logger.Printf("Column %s", line)
+			}
+		}
+	}
+
+	// Read the header unless it comes from a separate file, the file
+	// is headerless and mapped by positions or follows the table
+	header := config.Columns
+	if config.HeaderFile == "" && config.Positions == nil && !colsFromTable && config.Benchmark == nil {
+		header, err = reader.Read()
+		if err != nil && err != io.EOF {
+			logger.Fatal(err)
+		}
+		if len(renames) > 0 {
+			header = rename(header)
+		}
+	}
+
+	// Load the fields of the header the map names into their columns the way -positional does
+	if mapFile != "" {
+		mappings, err := readFieldMap(mapFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		var unmapped []string
+		config.Columns, config.Positions, unmapped, err = mapFields(header, mappings)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		// With -strict-columns they fail the load instead
+		if len(unmapped) > 0 && !strictColumns {
+			logger.Printf("Fields of the header not in -map-file are not loaded: %s", strings.Join(unmapped, ", "))
+		}
+	}
+
+	if len(ignoreCols) > 0 {
+		if positional != "" {
+			logger.Fatal("Can't use -ignore-cols with -positional, leave the fields out of the mapping instead")
+		}
+		var inputHeader []string
+		if config.HeaderFile == "" && !colsFromTable && config.Benchmark == nil {
+			inputHeader = header
+		}
+		config.IgnoreCols, err = parseIgnoreCols(ignoreCols, inputHeader)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if inputHeader != nil && len(inputHeader)-len(config.IgnoreCols) != len(config.Columns) {
+			logger.Fatalf("The header has %d fields left after dropping -ignore-cols for %d columns", len(inputHeader)-len(config.IgnoreCols), len(config.Columns))
+		}
+		if colsFromTable {
+			reader.FieldsPerRecord = len(config.Columns) + len(config.IgnoreCols)
+		}
+	}
+
+	// Fail on fields the load would leave out instead of dropping them
+	if strictColumns {
+		switch {
+		case positional != "":
+			// The fields are known by their positions only, every one up to the last mapped one has to be mapped
+			width := 0
+			for _, position := range config.Positions {
+				width = max(width, position+1)
+			}
+			fields := make([]string, width)
+			for i := range fields {
+				fields[i] = fmt.Sprintf("field %d", i)
+			}
+			if err := checkExtraColumns(fields, config); err != nil {
+				logger.Fatal(err)
+			}
+			reader.FieldsPerRecord = width
+		case config.HeaderFile != "":
+			reader.FieldsPerRecord = len(config.Columns) + len(config.IgnoreCols)
+		case !colsFromTable && config.Benchmark == nil:
+			if err := checkExtraColumns(header, config); err != nil {
+				logger.Fatal(err)
+			}
+		}
+	}
+
+	// From here on the record is the single field of the packed column
+	if packJSON != "" {
+		switch {
+		case colsFromTable || ddlFile != "":
+			logger.Fatal("Can't use -pack-json with -cols-from-table or -ddl-file, the keys come from the header")
+		case config.CreateTable || config.Benchmark != nil:
+			logger.Fatal("Can't use -pack-json with -create-table or -benchmark")
+		case transform != "":
+			logger.Fatal("Can't use -pack-json with -transform")
+		case config.StrictSchema:
+			logger.Fatal("Can't use -pack-json with -strict-schema, the fields of the header aren't columns of the table")
+		}
+		config.PackJSON, err = newJSONPacker(config.Columns, packJSONNulls, config.NullEscape)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		config.Columns = []string{packJSON}
+	}
+
+	if config.CreateTable {
+		if config.StrictSchema || colsFromTable {
+			logger.Fatal("Can't use -create-table with -strict-schema or -cols-from-table")
+		}
+		if config.CreateTableSample < 1 {
+			config.CreateTableSample = 1
+		}
+	}
+
+	switch {
+	case emptyJSONNull && emptyJSONObject:
+		logger.Fatal("Can't use -json-empty-null with -json-empty-object")
+	case emptyJSONNull:
+		config.JSONEmpty = jsonEmptyNull
+	case emptyJSONObject:
+		config.JSONEmpty = jsonEmptyObject
+	}
+	if rejectFile != "" {
+		config.Rejects = newRejectLog(rejectFile, config.Columns)
+	}
+
+	if err := validate(config); err != nil {
+		logger.Fatal(err)
+	}
+
+	if config.Benchmark != nil && (config.CreateTable || estimateMode) {
+		logger.Fatal("Can't use -benchmark with -create-table or -estimate")
+	}
+
+	if twoPhase {
+		if config.PreserveOrder {
+			logger.Fatal("-2pc can't be combined with -preserve-order")
+		}
+		if multiFile {
+			logger.Fatal("-2pc commits a single input as a whole, load several files as one with -concat")
+		}
+		config.TwoPhase = fmt.Sprintf("pload_%d_%d", os.Getpid(), time.Now().Unix())
+	}
+
+	if config.InsertSize == autoInsertSize {
+		config.InsertSize = maxInsertSize(config)
+		if config.InsertSize > maxAutoInsertSize {
+			config.InsertSize = maxAutoInsertSize
+		}
+		if verbose {
+			logger.Printf("Insert size %d", config.InsertSize)
+		}
+	}
+
+	if dedupe != "" {
+		config.Dedupe, err = newDeduper(dedupe, config.Columns)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		config.Dedupe.normalize = unicodeNormalizer(config, conflictKey)
+	}
+
+	if skippedFile != "" {
+		switch {
+		case config.Conflict != conflictSkip:
+			logger.Fatalf("Nothing is skipped with -conflict %s, -skipped-file can't be used", config.Conflict)
+		case config.CountExpr != "" || config.RowsAffected:
+			logger.Fatal("Can't use -skipped-file with -count-expr or -rows-affected")
+		case columnIndex(config.Columns, conflictKey) < 0:
+			logger.Fatalf("Can't tell skipped records: column '%s' is not loaded", conflictKey)
+		}
+		config.Skipped = newSkippedLog(skippedFile, config.Columns)
+	}
+
+	if transform != "" {
+		config.Transform, err = newTransformer(transform, config.Columns)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	if config.PartitionBy != "" {
+		config.PartitionTemplate = partitionTemplate(config.Table, config.PartitionTemplate)
+	}
+
+	// Read another input file, or the same one again, the way the first one is read
+	// and return its header, unless it comes from elsewhere, along with the reader
+	readFile := func(file *os.File, options readerOptions) (*csv.Reader, []string, error) {
+		// The records have as many fields as the ones read before
+		fieldsPerRecord := reader.FieldsPerRecord
+		reader, parseErrors, err := newReader(bufio.NewReaderSize(config.Progress.count(file), readBuffer), options)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.ParseErrors = parseErrors
+		reader.FieldsPerRecord = fieldsPerRecord
+
+		header := header
+		if config.HeaderFile == "" && positional == "" && !colsFromTable {
+			header, err = reader.Read()
+			if err != nil && err != io.EOF {
+				return nil, nil, err
+			}
+			if len(renames) > 0 {
+				header = rename(header)
+			}
+		}
+
+		return reader, header, nil
+	}
+
+	// Open the next of several input files to go on with the outputs of the ones before
+	openFile := func(path string) (*os.File, *csv.Reader, []string, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Can't open input file '%s'", path)
+		}
+
+		if idPattern != nil {
+			config.ImportId, err = importIdOf(path)
+			if err != nil {
+				file.Close()
+				return nil, nil, nil, err
+			}
+		}
+		// Every file is looked up in the ledger and recorded on its own
+		if config.LedgerTable != "" {
+			config.Ledger, err = newLedgerEntry(path, ledgerHash)
+			if err != nil {
+				file.Close()
+				return nil, nil, nil, err
+			}
+		}
+
+		next := options
+		next.ParseErrors = config.ParseErrors
+		reader, fileHeader, err := readFile(file, next)
+		if err != nil {
+			file.Close()
+			return nil, nil, nil, fmt.Errorf("Can't read input file '%s': %w", path, err)
+		}
+		// The fields are bound to the columns by the header of the first file
+		if !slices.Equal(fileHeader, header) {
+			file.Close()
+			return nil, nil, nil, fmt.Errorf("The header of '%s' differs from the one of '%s': %s", path, inputs[0], strings.Join(fileHeader, ","))
+		}
+
+		return file, reader, fileHeader, nil
+	}
+
+	// Start over from the beginning of the input with fresh outputs since
+	// the records that failed before fail again
+	reopen := func() (*csv.Reader, error) {
+		if _, err := inputFile.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("Can't reopen input file: %w", err)
+		}
+		if err := config.ParseErrors.close(); err != nil {
+			return nil, err
+		}
+		if err := config.Rejects.close(); err != nil {
+			return nil, err
+		}
+		if rejectFile != "" {
+			config.Rejects = newRejectLog(rejectFile, config.Columns)
+		}
+		if config.Dedupe != nil {
+			normalize := config.Dedupe.normalize
+			config.Dedupe, _ = newDeduper(dedupe, config.Columns)
+			config.Dedupe.normalize = normalize
+		}
+		if config.Progress != nil {
+			size := config.Progress.size
+			config.Progress = newProgress(progressFormat, progressInterval, progressEveryRows)
+			config.Progress.size = size
+		}
+
+		reader, _, err := readFile(inputFile, options)
+
+		return reader, err
+	}
+	if retryFile > 0 {
+		switch {
+		case inputFile == nil:
+			logger.Fatal("-retry-file needs an input file to reopen")
+		case multiFile:
+			logger.Fatal("-retry-file reloads a single input file, it can't be used with several")
+		case config.Conflict == conflictError || len(config.JSONMerge) > 0:
+			logger.Fatal("-retry-file needs a load that can be repeated, i.e. -conflict skip or update without -json-merge-cols")
+		case config.Skipped != nil:
+			logger.Fatal("Can't use -retry-file with -skipped-file, the records loaded by a failed attempt would be skipped by the next one")
+		case config.DupAuditTable != "":
+			logger.Fatal("Can't use -retry-file with -dup-audit-table, the records loaded by a failed attempt would be audited as duplicates by the next one")
+		}
+		if info, err := inputFile.Stat(); err != nil || !info.Mode().IsRegular() {
+			logger.Fatal("-retry-file needs a regular file to reopen")
+		}
+	}
+
+	// Only suggest the insert size and exit
+	if estimateMode {
+		err = estimate(db, reader, config, estimateSample)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	// Only compare the header to the table and exit
+	if validateSchema {
+		err = connect(db, config)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		diff, err := checkSchema(db, config, header)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		printSchemaDiff(diff)
+
+		if config.StrictSchema && !diff.empty() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Only write the statements for review and exit
+	if config.EmitSQL != "" && !config.EmitAndRun {
+		err = load(db, reader, header, config, &totals)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	// Report a failure along with whatever has been loaded before it
+	err = load(db, reader, header, config, &totals)
+	for attempt := 1; retryFile > 0; attempt++ {
+		totals.Attempts = attempt
+		if err == nil || attempt > retryFile || !retryable(err) {
+			break
+		}
+		logger.Printf("Load failed (attempt %d of %d), reloading the input from the start in %v: %v", attempt, retryFile+1, config.ConnectRetryInterval, err)
+		time.Sleep(config.ConnectRetryInterval)
+
+		// What the failed attempts committed is skipped by the next one,
+		// so it is counted as affected instead
+		loaded := totals.Records.Affected
+		// The import id allocated by -import-id-from goes on with the next attempt
+		if totals.ImportId != 0 {
+			config.ImportId = totals.ImportId
+			config.ImportIdFrom = ""
+		}
+		reader, err = reopen()
+		if err != nil {
+			break
+		}
+		totals.Records = ingestResult{}
+		err = load(db, reader, header, config, &totals)
+		totals.Records.Affected += loaded
+		totals.Records.Skipped = max(totals.Records.Skipped-loaded, 0)
+	}
+
+	// Load the rest of several files one after another with a single import id allocated
+	// by -import-id-from, stopping at the first file that fails
+	if multiFile {
+		totals.Files = []fileTotals{newFileTotals(inputs[0], &totals)}
+		if err != nil {
+			err = fmt.Errorf("Can't load input file '%s': %w", inputs[0], err)
+		}
+		if config.ImportIdFrom != "" {
+			config.ImportId = totals.ImportId
+			config.ImportIdFrom = ""
+		}
+	}
+	for _, path := range inputs[1:] {
+		if !multiFile || err != nil {
+			break
+		}
+		var (
+			file       *os.File
+			fileHeader []string
+		)
+		file, reader, fileHeader, err = openFile(path)
+		if err != nil {
+			break
+		}
+		err = loadFile(db, reader, fileHeader, config, path, &totals)
+		file.Close()
+		if err != nil {
+			err = fmt.Errorf("Can't load input file '%s': %w", path, err)
+		}
+	}
+	if err != nil {
+		totals.Error = newLoadError(err)
+	}
+
+	totals.Duration = time.Since(start)
+	totals.Memory = memoryUsage()
+
+	status := 0
+	if err != nil {
+		status = 1
+	} else if failIfZeroAffected && totals.Records.Affected == 0 {
+		status = exitNothingAffected
+	}
+
+	if err := config.Rejects.close(); err != nil {
+		logger.Printf("Can't write reject file '%s': %v", rejectFile, err)
+	}
+	if err := config.Skipped.close(); err != nil {
+		logger.Printf("Can't write skipped file '%s': %v", skippedFile, err)
+	}
+	if err := config.ParseErrors.close(); err != nil {
+		logger.Printf("Can't write parse error file '%s': %v", parseErrorFile, err)
+	}
+
+	// The summary is written no matter whether the load succeeded
+	if summary != "" {
+		if err := writeTotalsJSON(summary, &totals); err != nil {
+			logger.Printf("Can't write summary file '%s': %v", summary, err)
+		}
+	}
+
+	// Of several files loaded one after another the ones after a failed one aren't read
+	attempted := inputs
+	if multiFile {
+		attempted = inputs[:len(totals.Files)]
+	}
+	loaded := readFiles(attempted, totals.SkippedFiles)
+
+	// Failed runs go into the history as well
+	if historyFile != "" {
+		files := loaded
+		if len(inputs) == 0 {
+			files = []string{"-"}
+		}
+		entry := historyEntry{Time: start.UTC(), Table: config.Table, Files: files, totals: totals}
+		if err := appendHistory(historyFile, entry); err != nil {
+			logger.Printf("Can't append to history file '%s': %v", historyFile, err)
+		}
+	}
+
+	if textfileOut != "" {
+		if err := writeTextfile(textfileOut, config.Table, &totals, time.Now()); err != nil {
+			logger.Printf("Can't write textfile '%s': %v", textfileOut, err)
+		}
+	}
+
+	// Only a successful load gets a manifest
+	if manifestFile != "" && err == nil {
+		entry := manifest{Time: start.UTC(), Table: config.Table, totals: totals}
+		if stdinDigest != nil {
+			entry.Files = append(entry.Files, stdinDigest.file())
+		}
+		for _, path := range loaded {
+			file, err := describeFile(path, manifestHash, config.Ledger)
+			if err != nil {
+				logger.Printf("Can't describe input file '%s' in the manifest: %v", path, err)
+				continue
+			}
+			entry.Files = append(entry.Files, file)
+		}
+		if err := writeManifest(manifestFile, entry); err != nil {
+			logger.Printf("Can't write manifest file '%s': %v", manifestFile, err)
+		}
+	}
+
+	// Nor can a failing webhook fail the load
+	if notifyURL != "" {
+		if err := notify(notifyURL, notifyOn, &totals, status); err != nil {
+			logger.Printf("Can't notify '%s': %v", notifyURL, err)
+		}
+	}
+
+	if !quiet {
+		if outputJSON {
+			printTotalsJSON(&totals)
+		} else {
+			printTotals(&totals, fields, verbose)
+		}
+	}
+
+	if status != 0 {
+		os.Exit(status)
 	}
 }
@@ -0,0 +1,1688 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// testConfig returns the settings of a small load into table t by a single worker.
+func testConfig() config {
+	return config{
+		Table:      "t",
+		Columns:    []string{"marketoguid", "leadid"},
+		Workers:    1,
+		InsertSize: 10,
+		TxSize:     100,
+		Conflict:   conflictSkip,
+	}
+}
+
+// readAll reads all the records of the CSV input.
+func readAll(t *testing.T, r io.Reader) [][]string {
+	t.Helper()
+
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+func TestNullify(t *testing.T) {
+	tests := []struct {
+		value  string
+		escape string
+		want   interface{}
+	}{
+		{"null", "", sql.NullString{}},
+		{"value", "", "value"},
+		{"", "", ""},
+		{"NULL", "", "NULL"},
+		{"nullable", "", "nullable"},
+		{`\null`, "", `\null`},
+		// One level of the escape is stripped off the null value only
+		{"null", `\`, sql.NullString{}},
+		{`\null`, `\`, "null"},
+		{`\\null`, `\`, `\null`},
+		{`\\\null`, `\`, `\\null`},
+		{`\nullable`, `\`, `\nullable`},
+		{`\value`, `\`, `\value`},
+		{`\`, `\`, `\`},
+		{"~~null", "~~", "null"},
+		{"~null", "~~", "~null"},
+	}
+
+	for _, tt := range tests {
+		if got := nullify(tt.value, tt.escape); got != tt.want {
+			t.Errorf("nullify(%q, %q) = %#v, want %#v", tt.value, tt.escape, got, tt.want)
+		}
+	}
+}
+
+func TestSplitRecord(t *testing.T) {
+	tests := []struct {
+		record string
+		want   []string
+		err    error
+	}{
+		{`a,b,c`, []string{"a", "b", "c"}, nil},
+		{`a,`, []string{"a", ""}, nil},
+		{``, []string{""}, nil},
+		{`"a,b",c`, []string{"a,b", "c"}, nil},
+		{`"say ""hi""",x`, []string{`say "hi"`, "x"}, nil},
+		{"\"two\nlines\",x", []string{"two\nlines", "x"}, nil},
+		{`"",""`, []string{"", ""}, nil},
+		{`"open`, nil, csv.ErrQuote},
+		{`"a"b`, nil, csv.ErrQuote},
+		{`a"b`, nil, csv.ErrBareQuote},
+	}
+
+	for _, tt := range tests {
+		got, err := splitRecord([]byte(tt.record), 1)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("splitRecord(%q) error = %v, want %v", tt.record, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitRecord(%q) = %q, want %q", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestRecordSplitter(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		sep   byte
+		want  [][]string
+	}{
+		{"nul", "a,b\x00c,d", 0, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"newlines in fields", "a,\"b\nc\"\x1ed\ne,f\x1e\n", 0x1e, [][]string{{"a", "b\nc"}, {"d\ne", "f"}}},
+		{"trailing newline", "a,b\x00c,d\n", 0, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"blank records", "a,b\x00\x00\r\n\x00c,d\x00", 0, [][]string{{"a", "b"}, {"c", "d"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := readAll(t, newRecordSplitter(strings.NewReader(tt.input), tt.sep, 16))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordSplitterParseError(t *testing.T) {
+	_, err := csv.NewReader(newRecordSplitter(strings.NewReader("a,b\x00c,\"d\x00"), 0, 16)).ReadAll()
+
+	var parseErr *csv.ParseError
+	if !errors.As(err, &parseErr) || parseErr.Line != 2 {
+		t.Errorf("got %v, want a parse error in record 2", err)
+	}
+}
+
+func TestRenameColumns(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      []string
+		renames     columnValues
+		want        []string
+		wantMissing []string
+		wantErr     bool
+	}{
+		{
+			name:    "case insensitive",
+			header:  []string{"marketoGUID", "leadId"},
+			renames: columnValues{{"LEADID", " lead_id "}},
+			want:    []string{"marketoGUID", "lead_id"},
+		},
+		{
+			name:        "missing",
+			header:      []string{"marketoGUID", "leadId"},
+			renames:     columnValues{{"campaignId", "campaign"}},
+			want:        []string{"marketoGUID", "leadId"},
+			wantMissing: []string{"campaignId"},
+		},
+		{
+			name:    "swap",
+			header:  []string{"a", "b"},
+			renames: columnValues{{"a", "b"}, {"b", "a"}},
+			want:    []string{"b", "a"},
+		},
+		{
+			name:    "empty",
+			header:  []string{"a", "b"},
+			renames: columnValues{{"a", " "}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate",
+			header:  []string{"a", "b"},
+			renames: columnValues{{"a", "B"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, missing, err := renameColumns(tt.header, tt.renames)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(missing, tt.wantMissing) {
+				t.Errorf("got %q, %q, want %q, %q", got, missing, tt.want, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestParseIgnoreCols(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  []string
+		header  []string
+		want    []int
+		wantErr bool
+	}{
+		{"indices sorted", []string{"2", "0"}, nil, []int{0, 2}, false},
+		{"names", []string{"C", "a"}, []string{"a", "b", "c"}, []int{0, 2}, false},
+		{"index and name", []string{"b", "2"}, []string{"a", "b", "c"}, []int{1, 2}, false},
+		{"negative index", []string{"-1"}, nil, nil, true},
+		{"name without header", []string{"b"}, nil, nil, true},
+		{"name not in header", []string{"x"}, []string{"a", "b"}, nil, true},
+		{"twice", []string{"1", "b"}, []string{"a", "b"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIgnoreCols(tt.fields, tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropFields(t *testing.T) {
+	tests := []struct {
+		name      string
+		record    []string
+		positions []int
+		columns   int
+		want      []string
+		wantErr   bool
+	}{
+		{"middle", []string{"a", "b", "c"}, []int{1}, 2, []string{"a", "c"}, false},
+		{"ends", []string{"a", "b", "c", "d"}, []int{0, 3}, 2, []string{"b", "c"}, false},
+		{"beyond the record", []string{"a", "b"}, []int{2}, 1, nil, true},
+		{"too few left", []string{"a", "b", "c"}, []int{0}, 3, nil, true},
+		{"too many left", []string{"a", "b", "c"}, []int{0}, 1, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dropFields(tt.record, tt.positions, tt.columns)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTableName(t *testing.T) {
+	tests := []struct {
+		table   string
+		wantErr string
+	}{
+		{"activities", ""},
+		{"marketo.activities", ""},
+		{`"marketo.v2".activities`, ""},
+		{`marketo."activities.2024"`, ""},
+		{"", "Invalid table name ''"},
+		{"marketo.", "Invalid table name 'marketo.'"},
+		{"marketo..activities", "Invalid table name 'marketo..activities'"},
+		{"warehouse.marketo.activities", "Invalid table name 'warehouse.marketo.activities': Postgres doesn't support cross-database references"},
+		{`"ware.house".marketo."activities"`, `Invalid table name '"ware.house".marketo."activities"': Postgres doesn't support cross-database references`},
+	}
+
+	for _, tt := range tests {
+		err := checkTableName(tt.table)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("checkTableName(%q) = %v, want no error", tt.table, err)
+		case tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)):
+			t.Errorf("checkTableName(%q) = %v, want %s", tt.table, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  [][]string
+		lines int
+	}{
+		{"none", "a,b\nc,d\n", [][]string{{"a", "b"}, {"c", "d"}}, 0},
+		{"no final newline", "a,b\nc,d", [][]string{{"a", "b"}, {"c", "d"}}, 0},
+		{"between records", "a,b\n\n\nc,d\n", [][]string{{"a", "b"}, {"c", "d"}}, 2},
+		{"empty field", "a,b\n\"\"\nc,d\n", [][]string{{"a", "b"}, {"c", "d"}}, 1},
+		{"trailing", "a,b\nc,d\n\n\r\n\n", [][]string{{"a", "b"}, {"c", "d"}}, 3},
+		{"multiline field", "a,\"b\n\nb\"\n\nc,d\n", [][]string{{"a", "b\n\nb"}, {"c", "d"}}, 1},
+		{"single column", "a\n\"\"\nb\n", [][]string{{"a"}, {""}, {"b"}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blank := &blankLines{}
+			reader := csv.NewReader(blank.reader(strings.NewReader(tt.input)))
+
+			var got [][]string
+			for {
+				record, err := reader.Read()
+				if err == io.EOF {
+					break
+				}
+				var parseErr *csv.ParseError
+				if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount && blank.skip(reader, record) {
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !blank.skip(reader, record) {
+					got = append(got, record)
+				}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if lines := blank.lines(); lines != tt.lines {
+				t.Errorf("got %d blank lines, want %d", lines, tt.lines)
+			}
+		})
+	}
+}
+
+func TestPrefilter(t *testing.T) {
+	long := strings.Repeat("y", 100) + ",x\n"
+
+	tests := []struct {
+		name   string
+		input  string
+		substr string
+		keep   int
+		want   string
+	}{
+		{"header kept", "h1,h2\na,x\nb,y\nc,x\n", "x", 1, "h1,h2\na,x\nc,x\n"},
+		{"no header", "h1,h2\na,x\nb,y\nc,x\n", "x", 0, "a,x\nc,x\n"},
+		{"no final newline", "a,x\nb,y\nc,x", "x", 0, "a,x\nc,x"},
+		{"nothing matches", "h1,h2\na,y\n", "x", 1, "h1,h2\n"},
+		{"longer than the buffer", "a,y\n" + long + "b,y\n", "x", 0, long},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(newPrefilter(strings.NewReader(tt.input), tt.substr, tt.keep, 16))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRecordSeparator(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    byte
+		wantErr bool
+	}{
+		{`\0`, 0, false},
+		{`\x1e`, 0x1e, false},
+		{`\t`, '\t', false},
+		{"|", '|', false},
+		{";", ';', false},
+		{",", 0, true},
+		{`"`, 0, true},
+		{"ab", 0, true},
+		{`é`, 0, true},
+		{`\q`, 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRecordSeparator(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseRecordSeparator(%q) = %q, %v, want %q, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTypeValidator(t *testing.T) {
+	tests := []struct {
+		typ   string
+		value string
+		want  bool
+	}{
+		{"smallint", "32767", true},
+		{"smallint", "32768", false},
+		{"integer", "-12", true},
+		{"integer", "0", true},
+		{"integer", " -12 ", false},
+		{"integer", "+12", false},
+		{"integer", "012", false},
+		{"integer", "1.0", false},
+		{"bigint", "9223372036854775807", true},
+		{"bigint", "12abc", false},
+		{"numeric", "-1.5e3", true},
+		{"numeric", "0.5", true},
+		{"numeric", ".5", false},
+		{"numeric", "5.", false},
+		{"numeric", "NaN", true},
+		{"numeric", "nan", false},
+		{"numeric", "-Infinity", true},
+		{"numeric", "1,5", false},
+		{"numeric", " 1.5", false},
+		{"double precision", "Infinity", true},
+		{"double precision", "inf", false},
+		{"boolean", "true", true},
+		{"boolean", "false", true},
+		{"boolean", "t", false},
+		{"boolean", "TRUE", false},
+		{"boolean", "yes", false},
+		{"boolean", "on", false},
+		{"boolean", "of", false},
+		{"boolean", "1", false},
+		{"boolean", " true", false},
+		{"date", "2018-01-26", true},
+		{"date", "infinity", true},
+		{"date", "2018-02-30", false},
+		{"date", "2018-01-26T06:56:35Z", false},
+		{"date", "2018-01-26 06:56:35", false},
+		{"date", "01/26/2018", false},
+		{"date", "today", false},
+		{"timestamp without time zone", "2018-01-26 06:56:35", true},
+		{"timestamp without time zone", "2018-01-26T06:56:35.123456", true},
+		{"timestamp without time zone", "2018-01-26T06:56:35.1234567", false},
+		{"timestamp without time zone", "2018-01-26T06:56:35+0000", false},
+		{"timestamp without time zone", "2018-01-26T06:56:35Z", false},
+		{"timestamp without time zone", "2018-01-26", false},
+		{"timestamp without time zone", "2018-01-26 06:56", false},
+		{"timestamp without time zone", "-infinity", true},
+		{"timestamp with time zone", "2018-01-26T06:56:35+0000", true},
+		{"timestamp with time zone", "2018-01-26T06:56:35Z", true},
+		{"timestamp with time zone", "2018-01-26 06:56:35.5+02", true},
+		{"timestamp with time zone", "2018-01-26 06:56:35-05:30", true},
+		{"timestamp with time zone", "2018-01-26 06:56:35+16", false},
+		{"timestamp with time zone", "2018-01-26 06:56:35+02:60", false},
+		{"timestamp with time zone", "2018-01-26 06:56:35", false},
+		{"timestamp with time zone", "infinity", true},
+		{"timestamp with time zone", "now", false},
+		{"timestamp with time zone", "2018-13-26 06:56:35Z", false},
+		{"uuid", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", true},
+		{"uuid", "A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11", false},
+		{"uuid", "{a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11}", false},
+		{"uuid", "a0eebc999c0b4ef8bb6d6bb9bd380a11", false},
+		{"uuid", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a1", false},
+		{"json", `{"a": [1, 2]}`, true},
+		{"jsonb", `{"a": }`, false},
+	}
+
+	for _, tt := range tests {
+		valid := typeValidator(tt.typ)
+		if valid == nil {
+			t.Errorf("typeValidator(%q) = nil, want a check", tt.typ)
+			continue
+		}
+		if got := valid(tt.value); got != tt.want {
+			t.Errorf("typeValidator(%q)(%q) = %v, want %v", tt.typ, tt.value, got, tt.want)
+		}
+	}
+
+	for _, typ := range []string{"text", "character varying", "bytea", ""} {
+		if typeValidator(typ) != nil {
+			t.Errorf("typeValidator(%q) is a check, want none", typ)
+		}
+	}
+}
+
+func TestInferType(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"1", "-2", "0"}, "bigint"},
+		{[]string{"1", "1.5"}, "numeric"},
+		{[]string{"t", "no", "TRUE"}, "boolean"},
+		{[]string{"2018-01-26", "2018-02-01"}, "date"},
+		{[]string{"2018-01-26 06:56:35", "2018-01-26T06:56:35.5"}, "timestamp"},
+		{[]string{"2018-01-26T06:56:35Z", "2018-01-26 06:56:35+02:00"}, "timestamptz"},
+		{[]string{"2018-01-26T06:56:35+0000"}, "timestamptz"},
+		{[]string{"2018-01-26", "2018-01-26 06:56:35"}, "text"},
+		{[]string{"1", "x"}, "text"},
+		{[]string{"1", "null"}, "bigint"},
+		{[]string{"null"}, "text"},
+	}
+
+	for _, tt := range tests {
+		sample := make([][]string, len(tt.values))
+		for i, value := range tt.values {
+			sample[i] = []string{"key", value}
+		}
+		if got := inferType(sample, 1); got != tt.want {
+			t.Errorf("inferType(%q) = %s, want %s", tt.values, got, tt.want)
+		}
+	}
+
+	// Records too short for the field don't count
+	if got := inferType([][]string{{"key"}, {"key", "1"}}, 1); got != "bigint" {
+		t.Errorf("inferType of a short record = %s, want bigint", got)
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func(*config)
+		table   string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "skip",
+			want: []string{
+				"WITH inserted AS (",
+				"INSERT INTO t (marketoguid, leadid) VALUES ($1,$2),($3,$4)",
+				"ON CONFLICT (marketoguid) DO NOTHING",
+				"RETURNING 1",
+				"SELECT COUNT(*) FROM inserted",
+			},
+		},
+		{
+			name:    "error",
+			config:  func(c *config) { c.Conflict = conflictError },
+			want:    []string{"INSERT INTO t (marketoguid, leadid) VALUES ($1,$2),($3,$4)"},
+			notWant: []string{"ON CONFLICT"},
+		},
+		{
+			name:   "update",
+			config: func(c *config) { c.Conflict = conflictUpdate },
+			want:   []string{"ON CONFLICT (marketoguid) DO UPDATE SET leadid = EXCLUDED.leadid"},
+		},
+		{
+			name:    "rows affected",
+			config:  func(c *config) { c.RowsAffected = true },
+			want:    []string{"INSERT INTO t (marketoguid, leadid) VALUES ($1,$2),($3,$4)", "ON CONFLICT (marketoguid) DO NOTHING"},
+			notWant: []string{"WITH inserted", "RETURNING"},
+		},
+		{
+			name:    "view",
+			config:  func(c *config) { c.View, c.RowsAffected = true, true },
+			want:    []string{"INSERT INTO t (marketoguid, leadid) VALUES ($1,$2),($3,$4)"},
+			notWant: []string{"WITH inserted", "RETURNING", "ON CONFLICT"},
+		},
+		{
+			name:   "count expression",
+			config: func(c *config) { c.CountExpr = "COUNT(*) FILTER (WHERE xmax = 0)" },
+			want:   []string{"RETURNING *", "SELECT COALESCE((COUNT(*) FILTER (WHERE xmax = 0)), 0)::bigint FROM inserted"},
+		},
+		{
+			name:    "returned keys",
+			config:  func(c *config) { c.DupAuditTable = "dup_audit" },
+			want:    []string{"ON CONFLICT (marketoguid) DO NOTHING", "RETURNING marketoguid"},
+			notWant: []string{"WITH inserted"},
+		},
+		{
+			name:   "stamped import id",
+			config: func(c *config) { c.ImportId, c.StampImportId = 7, true },
+			want:   []string{"INSERT INTO t (importid, marketoguid, leadid) VALUES ($1,$2,$3),($4,$5,$6)"},
+		},
+		{
+			name:   "expressions",
+			config: func(c *config) { c.Exprs = columnValues{{"loadedat", "now()"}} },
+			want:   []string{"INSERT INTO t (marketoguid, leadid, loadedat) VALUES ($1,$2,now()),($3,$4,now())"},
+		},
+		{
+			name:  "partition",
+			table: "t_2018_01",
+			want:  []string{"INSERT INTO t_2018_01 (marketoguid, leadid) VALUES ($1,$2),($3,$4)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			if tt.config != nil {
+				tt.config(&config)
+			}
+			table := tt.table
+			if table == "" {
+				table = config.Table
+			}
+
+			query := buildQuery(config, table, 2)
+			for _, want := range tt.want {
+				if !strings.Contains(query, want) {
+					t.Errorf("query %q doesn't contain %q", query, want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(query, notWant) {
+					t.Errorf("query %q contains %q", query, notWant)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestShortRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		{"short", []string{"g2"}, "Record on line 3 has 1 fields for 2 columns"},
+		{"long", []string{"g2", "2", "x"}, "Record on line 3 has 3 fields for 2 columns"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := newFakeDB(t, nil)
+
+			records := make(chan inputRecord, 3)
+			records <- inputRecord{line: 2, fields: []string{"g1", "1"}}
+			records <- inputRecord{line: 3, fields: tt.fields}
+			records <- inputRecord{line: 4, fields: []string{"g3", "3"}}
+			close(records)
+
+			_, err := ingest(db, testConfig(), 1, records)
+			if err == nil || err.Error() != tt.want || categorize(err) != categoryParse {
+				t.Errorf("got %v, want %s", err, tt.want)
+			}
+		})
+
+		t.Run(tt.name+" rejected", func(t *testing.T) {
+			db, fake := newFakeDB(t, nil)
+			config := testConfig()
+			path := filepath.Join(t.TempDir(), "rejects.csv")
+			config.Rejects = newRejectLog(path, config.Columns)
+
+			records := make(chan inputRecord, 3)
+			records <- inputRecord{line: 2, fields: []string{"g1", "1"}}
+			records <- inputRecord{line: 3, fields: tt.fields}
+			records <- inputRecord{line: 4, fields: []string{"g3", "3"}}
+			close(records)
+
+			result, err := ingest(db, config, 1, records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := config.Rejects.close(); err != nil {
+				t.Fatal(err)
+			}
+			if result.Processed != 3 || result.Affected != 2 || result.Rejected != 1 || result.Rejects["field_count"] != 1 {
+				t.Errorf("got %+v, want 3 records processed, 2 affected and 1 rejected for its field count", result)
+			}
+			if inserts := fake.inserts(); len(inserts) != 1 || !reflect.DeepEqual(inserts[0].Args, []driver.Value{"g1", "1", "g3", "3"}) {
+				t.Errorf("got inserts %v, want g1 and g3", inserts)
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			// The rejected record keeps its own fields
+			reader := csv.NewReader(file)
+			reader.FieldsPerRecord = -1
+			rejected, err := reader.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append(append([]string{}, tt.fields...), "3", "", tt.want)
+			if len(rejected) != 2 || !reflect.DeepEqual(rejected[1], want) {
+				t.Errorf("got reject file %q, want %q", rejected, want)
+			}
+		})
+	}
+}
+
+func TestIngestAllShortRecord(t *testing.T) {
+	db, _ := newFakeDB(t, nil)
+
+	config := testConfig()
+	config.Workers = 2
+	config.InsertSize = 1
+	reader := csv.NewReader(strings.NewReader("g1,1\ng2\ng3,3\n"))
+	reader.FieldsPerRecord = -1
+
+	_, err := ingestAll(reader, db, config)
+	if err == nil || !strings.Contains(err.Error(), "Record on line 2 has 1 fields for 2 columns") {
+		t.Errorf("got %v, want the error of the short record", err)
+	}
+}
+
+func TestReadCancel(t *testing.T) {
+	input := strings.Repeat("g,1\n", 1000)
+	config := testConfig()
+
+	done := make(chan struct{})
+	records, errc := read(done, csv.NewReader(strings.NewReader(input)), config)
+
+	// Cancel while the reader is blocked sending the records nobody receives
+	<-records
+	close(done)
+	received := 1
+	for range records {
+		received++
+	}
+	if received >= 1000 {
+		t.Errorf("got all %d records, want the read cancelled", received)
+	}
+
+	if err := <-errc; !errors.Is(err, errCancelled) {
+		t.Errorf("got %v, want %v", err, errCancelled)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("got a second error %v", err)
+	default:
+	}
+}
+
+func TestReadEnd(t *testing.T) {
+	records, errc := read(make(chan struct{}), csv.NewReader(strings.NewReader("g1,1\ng2,2\n")), testConfig())
+
+	received := 0
+	for range records {
+		received++
+	}
+	if received != 2 {
+		t.Errorf("got %d records, want 2", received)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("got a second error %v", err)
+	default:
+	}
+}
+
+func TestNewReaderLongLine(t *testing.T) {
+	// An attributes value several times the size of the read buffer
+	attributes := `{"payload":"` + strings.Repeat("x", 3*defaultReadBuffer) + `"}`
+	want := [][]string{{"marketoguid", "attributes"}, {"g1", attributes}, {"g2", "{}"}}
+	var input strings.Builder
+	csv.NewWriter(&input).WriteAll(want)
+
+	tests := []struct {
+		name    string
+		options readerOptions
+	}{
+		{"plain", readerOptions{}},
+		{"prefilter", readerOptions{Prefilter: "g", PrefilterKeep: 1}},
+		{"record separator", readerOptions{RecordSep: true, Separator: '\n'}},
+		{"blank lines", readerOptions{BlankLines: &blankLines{}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.options.BufferSize = defaultReadBuffer
+			reader, _, err := newReader(bufio.NewReaderSize(strings.NewReader(input.String()), defaultReadBuffer), tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := reader.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %d records, the long one of %d bytes, want %d bytes", len(got), len(got[1][1]), len(attributes))
+			}
+		})
+	}
+}
+
+// gzipped compresses the data as a single gzip member.
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestNewReaderGzipMembers(t *testing.T) {
+	// The way cat a.gz b.gz puts them together
+	input := append(gzipped(t, "marketoguid,leadid\ng1,1\ng2,2\n"), gzipped(t, "g3,3\ng4,4\n")...)
+	want := [][]string{{"marketoguid", "leadid"}, {"g1", "1"}, {"g2", "2"}, {"g3", "3"}, {"g4", "4"}}
+
+	tests := []struct {
+		name    string
+		options readerOptions
+	}{
+		{"detected", readerOptions{}},
+		{"forced", readerOptions{ForceGzip: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.options.BufferSize = defaultReadBuffer
+			reader, _, err := newReader(bufio.NewReader(bytes.NewReader(input)), tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := reader.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// slowWriter writes the data into the pipe a few bytes at a time with pauses in between,
+// the way a slow producer writes into a FIFO, and closes it.
+func slowWriter(w *io.PipeWriter, data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), 3)
+		if _, err := w.Write(data[:n]); err != nil {
+			return
+		}
+		data = data[n:]
+		time.Sleep(time.Millisecond)
+	}
+	w.Close()
+}
+
+func TestPipeInput(t *testing.T) {
+	data := "g1,1\ng2,2\ng3,3\n"
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    int
+		wantErr bool
+	}{
+		{"plain", []byte(data), 3, false},
+		{"gzip", gzipped(t, data), 3, false},
+		// Too short for the magic bytes of gzip, read as a record that is too short
+		{"one byte", []byte("\x1f"), 0, true},
+		{"empty", nil, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w := io.Pipe()
+			go slowWriter(w, tt.input)
+
+			reader, _, err := newReader(bufio.NewReader(r), readerOptions{BufferSize: defaultReadBuffer})
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, fake := newFakeDB(t, nil)
+			config := testConfig()
+			reader.FieldsPerRecord = len(config.Columns)
+
+			result, err := ingestAll(reader, db, config)
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) != tt.wantErr {
+				t.Fatalf("got %v, want a parse error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+			if result.Processed != tt.want || result.Affected != tt.want {
+				t.Errorf("got %d records processed and %d affected, want %d", result.Processed, result.Affected, tt.want)
+			}
+			if inserts := len(fake.inserts()); tt.want > 0 && inserts != 1 {
+				t.Errorf("got %d inserts, want 1", inserts)
+			}
+		})
+	}
+}
+
+func TestByteaRoundTrip(t *testing.T) {
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+
+	tests := []struct {
+		encoding string
+		value    string
+	}{
+		{byteaHex, `\x` + hex.EncodeToString(binary)},
+		{byteaHex, hex.EncodeToString(binary)},
+		{byteaHex, `\x` + strings.ToUpper(hex.EncodeToString(binary))},
+		{byteaBase64, base64.StdEncoding.EncodeToString(binary)},
+	}
+
+	for _, tt := range tests {
+		config := testConfig()
+		config.Columns = []string{"marketoguid", "data"}
+		config.Types = columnValues{{"data", "bytea"}}
+		config.ByteaEncoding = tt.encoding
+		coercions, err := buildCoercions(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bindings := make([]interface{}, 4)
+		batch := []inputRecord{{line: 2, fields: []string{"g1", tt.value}}, {line: 3, fields: []string{"g2", "null"}}}
+		if err := bind(bindings, batch, 2, false, 0, "", coercions); err != nil {
+			t.Fatalf("%s %.10s...: %v", tt.encoding, tt.value, err)
+		}
+		if got, ok := bindings[1].([]byte); !ok || !bytes.Equal(got, binary) {
+			t.Errorf("%s %.10s... decodes to %v, want all the bytes", tt.encoding, tt.value, bindings[1])
+		}
+		if bindings[3] != (sql.NullString{}) {
+			t.Errorf("%s null decodes to %#v, want NULL", tt.encoding, bindings[3])
+		}
+	}
+}
+
+func TestByteaInvalid(t *testing.T) {
+	tests := []struct {
+		encoding string
+		value    string
+	}{
+		{byteaHex, `\x0g`},
+		{byteaHex, `\x012`},
+		{byteaBase64, "AQI"},
+		{byteaBase64, "A$=="},
+	}
+
+	for _, tt := range tests {
+		config := testConfig()
+		config.Types = columnValues{{"leadid", "bytea"}}
+		config.ByteaEncoding = tt.encoding
+		coercions, err := buildCoercions(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs := uncoercible(inputRecord{line: 2, fields: []string{"g1", tt.value}}, coercions, "")
+		if len(errs) != 1 || errs[0].Column != "leadid" || errs[0].Line != 2 {
+			t.Errorf("%s %q: got %v, want a coercion error of column leadid", tt.encoding, tt.value, errs)
+		}
+	}
+}
+
+func TestPreserveOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		// Records whose leadid is empty are rejected
+		empty func(i int) bool
+	}{
+		{"all inserted", func(int) bool { return false }},
+		{"some rejected", func(i int) bool { return i%7 == 0 }},
+		{"whole batches rejected", func(i int) bool { return i >= 9 && i < 18 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input strings.Builder
+			want := 0
+			for i := 0; i < 100; i++ {
+				leadid := strconv.Itoa(i)
+				if tt.empty(i) {
+					leadid = ""
+				} else {
+					want++
+				}
+				fmt.Fprintf(&input, "%d,%s\n", i, leadid)
+			}
+
+			// Inserts that take a while would land out of order unless they are sequenced
+			db, fake := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+				if isInsert(query) {
+					time.Sleep(time.Duration(rand.IntN(1000)) * time.Microsecond)
+				}
+				return nil, nil, nil
+			})
+			config := testConfig()
+			config.Workers = 4
+			config.InsertSize = 3
+			config.PreserveOrder = true
+			config.Required = columnNames{"leadid"}
+			config.Rejects = newRejectLog(filepath.Join(t.TempDir(), "rejects.csv"), config.Columns)
+			defer config.Rejects.close()
+
+			result, err := ingestAll(csv.NewReader(strings.NewReader(input.String())), db, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Affected != want {
+				t.Errorf("got %d records affected, want %d", result.Affected, want)
+			}
+
+			// The sequence column, the key, goes up from insert to insert
+			last := -1
+			for _, insert := range fake.inserts() {
+				for i := 0; i < len(insert.Args); i += len(config.Columns) {
+					key, _ := strconv.Atoi(insert.Args[i].(string))
+					if key <= last {
+						t.Fatalf("got key %d inserted after %d", key, last)
+					}
+					last = key
+				}
+			}
+		})
+	}
+}
+
+// testPostgres connects to the database PLOAD_TEST_DSN names, skipping the test without one,
+// and runs the statements that set it up.
+func testPostgres(t *testing.T, setup ...string) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("PLOAD_TEST_DSN")
+	if dsn == "" {
+		t.Skip("PLOAD_TEST_DSN is not set")
+	}
+	db, err := openDB(driverPq, dsn, 10*time.Second, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, statement := range setup {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	return db
+}
+
+func TestUpdateSetJSONMerge(t *testing.T) {
+	config := testConfig()
+	config.Columns = []string{"marketoguid", "leadid", "attributes"}
+	config.JSONMerge = columnNames{"attributes"}
+
+	got := updateSet(config, "marketo.activities", config.Columns)
+	want := "leadid = EXCLUDED.leadid, attributes = COALESCE(activities.attributes || EXCLUDED.attributes, EXCLUDED.attributes, activities.attributes)"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestCheckJSONMerge(t *testing.T) {
+	// The columns of the table as describeTable reads them
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if !strings.Contains(query, "information_schema.columns") {
+			return nil, nil, nil
+		}
+		return []string{"column_name", "data_type", "optional", "generated"}, [][]driver.Value{
+			{"marketoguid", "text", false, false},
+			{"attributes", "jsonb", true, false},
+			{"payload", "json", true, false},
+		}, nil
+	})
+
+	tests := []struct {
+		column  string
+		wantErr string
+	}{
+		{"attributes", ""},
+		{"payload", "Can't merge column 'payload' as JSON: it is json in table 't', not jsonb"},
+		{"extra", "Can't merge column 'extra' as JSON: it is missing in table 't', not jsonb"},
+	}
+
+	for _, tt := range tests {
+		config := testConfig()
+		config.JSONMerge = columnNames{tt.column}
+		err := checkJSONMerge(db, config)
+		if (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr)) {
+			t.Errorf("%s: got %v, want %q", tt.column, err, tt.wantErr)
+		}
+	}
+}
+
+func TestJSONMergePostgres(t *testing.T) {
+	db := testPostgres(t,
+		"DROP TABLE IF EXISTS pload_test_merge",
+		"CREATE TABLE pload_test_merge (marketoguid text PRIMARY KEY, attributes jsonb)",
+		`INSERT INTO pload_test_merge VALUES ('overlapping', '{"a": 1, "b": 2}'), ('disjoint', '{"a": 1}'), ('nested', '{"a": {"x": 1}}'), ('kept', '{"a": 1}'), ('empty', NULL)`,
+	)
+	t.Cleanup(func() { db.Exec("DROP TABLE pload_test_merge") })
+
+	config := testConfig()
+	config.Table = "pload_test_merge"
+	config.Columns = []string{"marketoguid", "attributes"}
+	config.Conflict, config.ConflictSet = conflictUpdate, true
+	config.JSONMerge = columnNames{"attributes"}
+
+	input := `overlapping,"{""b"": 3, ""c"": 4}"
+disjoint,"{""d"": 5}"
+nested,"{""a"": {""y"": 2}}"
+kept,null
+empty,"{""a"": 1}"
+new,"{""e"": 6}"
+`
+	if err := load(db, csv.NewReader(strings.NewReader(input)), config.Columns, config, &totals{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The merge is shallow, the keys of the record win
+	want := map[string]string{
+		"overlapping": `{"a": 1, "b": 3, "c": 4}`,
+		"disjoint":    `{"a": 1, "d": 5}`,
+		"nested":      `{"a": {"y": 2}}`,
+		"kept":        `{"a": 1}`,
+		"empty":       `{"a": 1}`,
+		"new":         `{"e": 6}`,
+	}
+	rows, err := db.Query("SELECT marketoguid, attributes::text FROM pload_test_merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := map[string]string{}
+	for rows.Next() {
+		var key, attributes string
+		if err := rows.Scan(&key, &attributes); err != nil {
+			t.Fatal(err)
+		}
+		got[key] = attributes
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestJSONEmpty(t *testing.T) {
+	tests := []struct {
+		mode  string
+		value string
+		want  interface{}
+	}{
+		{jsonEmptyNull, `""`, sql.NullString{}},
+		{jsonEmptyNull, `" "`, sql.NullString{}},
+		{jsonEmptyNull, "\"\t\r\n\"", sql.NullString{}},
+		{jsonEmptyNull, `"{}"`, "{}"},
+		{jsonEmptyNull, `"{""a"": 1}"`, `{"a": 1}`},
+		{jsonEmptyNull, "null", sql.NullString{}},
+		{jsonEmptyObject, `""`, "{}"},
+		{jsonEmptyObject, `" "`, "{}"},
+		{jsonEmptyObject, `"{}"`, "{}"},
+		{jsonEmptyObject, "null", sql.NullString{}},
+	}
+
+	for _, tt := range tests {
+		config := testConfig()
+		config.Columns = []string{"marketoguid", "attributes", "payload", "note"}
+		config.ColumnTypes = map[string]string{"marketoguid": "text", "attributes": "jsonb", "payload": "json", "note": "text"}
+		config.JSONEmpty = tt.mode
+		normalizers, err := buildNormalizers(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The value goes into both JSON columns and the text one
+		line := fmt.Sprintf("g1,%[1]s,%[1]s,%[1]s\n", tt.value)
+		record, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := record[3]
+		if err := normalize(record, normalizers, 1); err != nil {
+			t.Fatal(err)
+		}
+		bindings := make([]interface{}, len(record))
+		if err := bind(bindings, []inputRecord{{line: 1, fields: record}}, len(record), false, 0, "", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if bindings[1] != tt.want || bindings[2] != tt.want {
+			t.Errorf("%s %s: got %#v and %#v, want %#v", tt.mode, tt.value, bindings[1], bindings[2], tt.want)
+		}
+		if record[3] != text {
+			t.Errorf("%s %s: text column changed to %q", tt.mode, tt.value, record[3])
+		}
+	}
+}
+
+// viewAnswer answers the lookups of load for a view the role may insert into
+// whose trigger skips the records of the keys that start with skip.
+func viewAnswer(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+	switch {
+	case strings.Contains(query, "has_table_privilege"):
+		return []string{"current_user", "granted"}, [][]driver.Value{{"loader", true}}, nil
+	case strings.Contains(query, "relkind = 'v'"):
+		return []string{"view"}, [][]driver.Value{{true}}, nil
+	case isInsert(query):
+		var rows [][]driver.Value
+		for i := 0; i < len(args); i += 2 {
+			if !strings.HasPrefix(args[i].(string), "skip") {
+				rows = append(rows, []driver.Value{args[i]})
+			}
+		}
+		return []string{"marketoguid"}, rows, nil
+	}
+
+	return nil, nil, nil
+}
+
+func TestLoadView(t *testing.T) {
+	db, fake := newFakeDB(t, viewAnswer)
+
+	input := "g1,1\nskip2,2\ng3,3\n"
+	var totals totals
+	if err := load(db, csv.NewReader(strings.NewReader(input)), testConfig().Columns, testConfig(), &totals); err != nil {
+		t.Fatal(err)
+	}
+
+	inserts := fake.inserts()
+	if len(inserts) != 1 {
+		t.Fatalf("got %d inserts, want 1", len(inserts))
+	}
+	query := strings.TrimSpace(inserts[0].Query)
+	if query != "INSERT INTO t (marketoguid, leadid) VALUES ($1,$2),($3,$4),($5,$6)" {
+		t.Errorf("got %q, want a plain insert", query)
+	}
+	// The count comes from the command tag, without the row the trigger skipped
+	if totals.Records.Processed != 3 || totals.Records.Affected != 2 {
+		t.Errorf("got %d records processed and %d affected, want 3 and 2", totals.Records.Processed, totals.Records.Affected)
+	}
+}
+
+func TestLoadViewConflict(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func(*config)
+		wantErr string
+	}{
+		{"conflict skip", func(c *config) { c.ConflictSet = true }, "Can't use -conflict skip with view 't'"},
+		{"conflict update", func(c *config) { c.Conflict, c.ConflictSet = conflictUpdate, true }, "Can't use -conflict update with view 't'"},
+		{"conflict error", func(c *config) { c.Conflict, c.ConflictSet = conflictError, true }, ""},
+		{"skipped file", func(c *config) { c.Skipped = newSkippedLog(filepath.Join(t.TempDir(), "skipped.csv"), c.Columns) }, "Can't use -skipped-file with view 't'"},
+		{"count expression", func(c *config) { c.CountExpr = "COUNT(*)" }, "Can't use -count-expr with view 't'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fake := newFakeDB(t, viewAnswer)
+			config := testConfig()
+			tt.config(&config)
+
+			err := load(db, csv.NewReader(strings.NewReader("g1,1\n")), config.Columns, config, &totals{})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("got %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want %s", err, tt.wantErr)
+			}
+			if inserts := len(fake.inserts()); tt.wantErr != "" && inserts > 0 {
+				t.Errorf("got %d inserts after the error", inserts)
+			}
+		})
+	}
+}
+
+func TestLoadViewPostgres(t *testing.T) {
+	db := testPostgres(t,
+		"DROP VIEW IF EXISTS pload_test_view",
+		"DROP TABLE IF EXISTS pload_test_view_rows",
+		"CREATE TABLE pload_test_view_rows (marketoguid text PRIMARY KEY, leadid int)",
+		"CREATE VIEW pload_test_view AS SELECT marketoguid, leadid FROM pload_test_view_rows",
+		// Duplicates are skipped by the trigger returning NULL
+		`CREATE OR REPLACE FUNCTION pload_test_view_insert() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			INSERT INTO pload_test_view_rows VALUES (NEW.marketoguid, NEW.leadid) ON CONFLICT DO NOTHING;
+			IF NOT FOUND THEN
+				RETURN NULL;
+			END IF;
+			RETURN NEW;
+		END $$`,
+		"CREATE TRIGGER pload_test_view_insert INSTEAD OF INSERT ON pload_test_view FOR EACH ROW EXECUTE FUNCTION pload_test_view_insert()",
+		"INSERT INTO pload_test_view_rows VALUES ('g2', 2)",
+	)
+	t.Cleanup(func() {
+		db.Exec("DROP VIEW pload_test_view")
+		db.Exec("DROP TABLE pload_test_view_rows")
+		db.Exec("DROP FUNCTION pload_test_view_insert()")
+	})
+
+	config := testConfig()
+	config.Table = "pload_test_view"
+	var totals totals
+	if err := load(db, csv.NewReader(strings.NewReader("g1,1\ng2,2\ng3,3\n")), config.Columns, config, &totals); err != nil {
+		t.Fatal(err)
+	}
+	if totals.Records.Processed != 3 || totals.Records.Affected != 2 {
+		t.Errorf("got %d records processed and %d affected, want 3 and 2", totals.Records.Processed, totals.Records.Affected)
+	}
+
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pload_test_view_rows").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 3 {
+		t.Errorf("got %d rows, want 3", rows)
+	}
+}
+
+// BenchmarkResults compares handing over the results of the workers through an unbuffered
+// channel with the channel ingestAll uses, buffered by the number of workers.
+func BenchmarkResults(b *testing.B) {
+	const workers = 8
+
+	// A worker sends a single result, many results stand for a result per batch
+	for _, sends := range []int{1, 1000} {
+		for _, buffer := range []int{0, workers} {
+			b.Run(fmt.Sprintf("sends=%d/buffer=%d", sends, buffer), func(b *testing.B) {
+				for b.Loop() {
+					results := make(chan ingestResult, buffer)
+					var wg sync.WaitGroup
+					wg.Add(workers)
+					for range workers {
+						go func() {
+							defer wg.Done()
+							for range sends {
+								results <- ingestResult{Processed: 1, Affected: 1}
+							}
+						}()
+					}
+					go func() {
+						wg.Wait()
+						close(results)
+					}()
+
+					totals := ingestResult{}
+					for result := range results {
+						totals.add(result)
+					}
+					if totals.Processed != workers*sends {
+						b.Fatalf("got %d results, want %d", totals.Processed, workers*sends)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkProgress counts the records of every batch the way the workers do during the load.
+func BenchmarkProgress(b *testing.B) {
+	const workers = 8
+
+	for b.Loop() {
+		p := newProgress(progressNone, time.Hour, 0)
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for range workers {
+			go func() {
+				defer wg.Done()
+				for range 1000 {
+					p.add(1, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if processed := p.processed.Load(); processed != workers*1000 {
+			b.Fatalf("got %d records, want %d", processed, workers*1000)
+		}
+	}
+}
+
+func TestCategorize(t *testing.T) {
+	tests := []struct {
+		code      string
+		category  string
+		retryable bool
+	}{
+		{"57014", categoryTimeout, false},
+		{"57P01", categoryConnection, true},
+		{"08006", categoryConnection, true},
+		{"40001", categoryOther, true},
+		{"40P01", categoryOther, true},
+		{"23505", categoryConstraint, false},
+		{"22P02", categoryParse, false},
+		{"42501", categoryPermission, false},
+		{"42P01", categoryOther, false},
+	}
+
+	for _, tt := range tests {
+		err := fmt.Errorf("Insert of 10 records: %w", &pq.Error{Code: pq.ErrorCode(tt.code)})
+		if got := categorize(err); got != tt.category {
+			t.Errorf("categorize(%s) = %s, want %s", tt.code, got, tt.category)
+		}
+		if got := retryable(err); got != tt.retryable {
+			t.Errorf("retryable(%s) = %v, want %v", tt.code, got, tt.retryable)
+		}
+	}
+}
+
+func TestIngestNormalizeReject(t *testing.T) {
+	input := func() <-chan inputRecord {
+		records := make(chan inputRecord, 3)
+		records <- inputRecord{line: 1, fields: []string{"g1", "1.0"}}
+		records <- inputRecord{line: 2, fields: []string{"g2", "1.5"}}
+		records <- inputRecord{line: 3, fields: []string{"g3", "3"}}
+		close(records)
+		return records
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		db, _ := newFakeDB(t, nil)
+		config := testConfig()
+		config.AsInt = columnNames{"leadid"}
+
+		_, err := ingest(db, config, 1, input())
+		var normalizeErr *normalizeError
+		if !errors.As(err, &normalizeErr) || normalizeErr.Line != 2 || categorize(err) != categoryParse {
+			t.Errorf("got %v, want the value of line 2 that can't be normalized", err)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		db, fake := newFakeDB(t, nil)
+		config := testConfig()
+		config.AsInt = columnNames{"leadid"}
+		path := filepath.Join(t.TempDir(), "rejects.csv")
+		config.Rejects = newRejectLog(path, config.Columns)
+
+		result, err := ingest(db, config, 1, input())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.Rejects.close(); err != nil {
+			t.Fatal(err)
+		}
+		if result.Processed != 3 || result.Affected != 2 || result.Rejected != 1 || result.Rejects["normalize"] != 1 {
+			t.Errorf("got %+v, want 3 records processed, 2 affected and 1 rejected to normalize", result)
+		}
+		if inserts := fake.inserts(); len(inserts) != 1 || !reflect.DeepEqual(inserts[0].Args, []driver.Value{"g1", "1", "g3", "3"}) {
+			t.Errorf("got inserts %v, want g1 and g3", inserts)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		rejected := readAll(t, file)
+		if len(rejected) != 2 || rejected[1][0] != "g2" || rejected[1][2] != "2" {
+			t.Errorf("got reject file %q, want the record of line 2", rejected)
+		}
+	})
+}
+
+func TestIngestSkippedKeys(t *testing.T) {
+	const (
+		a = "A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11"
+		b = "B0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A12"
+		c = "C0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A13"
+	)
+
+	tests := []struct {
+		keyType string
+		// Keys the insert returns, the way the server writes them
+		returned []string
+		want     []string
+		casts    int
+	}{
+		{"uuid", []string{strings.ToLower(a), strings.ToLower(c)}, []string{b}, 1},
+		{"text", []string{a, c}, []string{b}, 0},
+		{"character varying(36)", []string{a, c}, []string{b}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.keyType, func(t *testing.T) {
+			casts := 0
+			db, _ := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+				switch {
+				case isInsert(query):
+					var rows [][]driver.Value
+					for _, key := range tt.returned {
+						rows = append(rows, []driver.Value{key})
+					}
+					return []string{"marketoguid"}, rows, nil
+				// The keys of the batch cast to the type of the column on the server
+				case strings.Contains(query, "FROM unnest($1::text[])"):
+					casts++
+					var rows [][]driver.Value
+					for _, key := range strings.Split(strings.Trim(args[0].(string), "{}"), ",") {
+						rows = append(rows, []driver.Value{strings.ToLower(strings.Trim(key, `"`))})
+					}
+					return []string{"key"}, rows, nil
+				}
+				return nil, nil, nil
+			})
+
+			config := testConfig()
+			config.KeyType = tt.keyType
+			path := filepath.Join(t.TempDir(), "skipped.csv")
+			config.Skipped = newSkippedLog(path, config.Columns)
+
+			records := make(chan inputRecord, 3)
+			for i, key := range []string{a, b, c} {
+				records <- inputRecord{line: i + 1, fields: []string{key, strconv.Itoa(i)}}
+			}
+			close(records)
+
+			result, err := ingest(db, config, 1, records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := config.Skipped.close(); err != nil {
+				t.Fatal(err)
+			}
+			if result.Affected != 2 || result.Skipped != 1 || casts != tt.casts {
+				t.Errorf("got %d affected, %d skipped and %d casts, want 2, 1 and %d", result.Affected, result.Skipped, casts, tt.casts)
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var got []string
+			for _, record := range readAll(t, file)[1:] {
+				got = append(got, record[0])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got skipped %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		name     string
+		stamp    bool
+		importId int
+		want     []interface{}
+	}{
+		{"not stamped", false, 7, []interface{}{"x", "y"}},
+		{"stamped", true, 7, []interface{}{7, "x", "y"}},
+		// An allocated id of 0 still takes the importid column
+		{"stamped zero", true, 0, []interface{}{0, "x", "y"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bindings := make([]interface{}, len(tt.want))
+			batch := []inputRecord{{line: 1, fields: []string{"x", "y"}}}
+			if err := bind(bindings, batch, len(tt.want), tt.stamp, tt.importId, "", nil); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(bindings, tt.want) {
+				t.Errorf("got %v, want %v", bindings, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrorsOfSeveralFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "parse-errors.csv")
+
+	// Every file is read by a reader of its own with the log of the files before
+	var parseErrors *parseErrorLog
+	for _, input := range []string{"g1,1\ng\"2,2\ng3,3\n", "g4,4\ng\"5,5\n"} {
+		reader, log, err := newReader(bufio.NewReader(strings.NewReader(input)), readerOptions{BufferSize: 16, ParseErrorFile: path, ParseErrors: parseErrors})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parseErrors != nil && log != parseErrors {
+			t.Fatal("newReader started a new parse error log for the next file")
+		}
+		parseErrors = log
+
+		config := testConfig()
+		config.ParseErrors = parseErrors
+		if err := forward(nil, reader, config, make(chan inputRecord, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := parseErrors.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "g\"2,2\ng\"5,5\n"; string(got) != want || parseErrors.errors() != 2 {
+		t.Errorf("got %d parse errors %q, want 2 %q", parseErrors.errors(), got, want)
+	}
+}
+
+func TestTotalsAddFile(t *testing.T) {
+	all := totals{ImportId: 1, ParseErrors: 1, BlankLines: 2, Records: ingestResult{Processed: 3, Affected: 2, Skipped: 1}}
+	all.Files = []fileTotals{newFileTotals("a.csv", &all)}
+
+	all.addFile("b.csv", &totals{ImportId: 1, ParseErrors: 3, BlankLines: 1, Records: ingestResult{Processed: 5, Affected: 5}})
+	if all.ImportId != 1 {
+		t.Errorf("got import id %d with the same one for both files, want 1", all.ImportId)
+	}
+	all.addFile("c.csv", &totals{ImportId: 2, ParseErrors: 3, SkippedFiles: []string{"/data/c.csv"}})
+
+	want := totals{
+		ParseErrors:  3,
+		BlankLines:   3,
+		SkippedFiles: []string{"/data/c.csv"},
+		Records:      ingestResult{Processed: 8, Affected: 7, Skipped: 1},
+		Files: []fileTotals{
+			{Path: "a.csv", ImportId: 1, Processed: 3, Affected: 2, Skipped: 1},
+			{Path: "b.csv", ImportId: 1, Processed: 5, Affected: 5},
+			{Path: "c.csv", ImportId: 2},
+		},
+	}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("got %+v, want %+v", all, want)
+	}
+}
+
+func TestLoadFileLedger(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i, input := range []string{"g1,1\n", "g2,2\ng3,3\n"} {
+		path := filepath.Join(dir, fmt.Sprintf("activities-%d.csv", i+1))
+		if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	// The first file has been loaded by a run before
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "has_table_privilege"):
+			return []string{"current_user", "granted"}, [][]driver.Value{{"loader", true}}, nil
+		case strings.Contains(query, "relkind = 'v'"):
+			return []string{"view"}, [][]driver.Value{{false}}, nil
+		case strings.Contains(query, "FROM loaded_files"):
+			return []string{"exists"}, [][]driver.Value{{args[0] == paths[0]}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	config := testConfig()
+	config.LedgerTable = "loaded_files"
+	var all totals
+	for i, path := range paths {
+		entry, err := newLedgerEntry(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Ledger = entry
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		reader := csv.NewReader(file)
+		if i == 0 {
+			err = load(db, reader, config.Columns, config, &all)
+			all.Files = []fileTotals{newFileTotals(path, &all)}
+		} else {
+			err = loadFile(db, reader, config.Columns, config, path, &all)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(all.SkippedFiles, paths[:1]) || all.Records.Affected != 2 {
+		t.Errorf("got skipped files %q and %d affected, want %q and 2", all.SkippedFiles, all.Records.Affected, paths[:1])
+	}
+	var recorded []driver.Value
+	for _, insert := range fake.inserts() {
+		if strings.HasPrefix(insert.Query, "INSERT INTO loaded_files") {
+			recorded = append(recorded, insert.Args[0])
+		}
+	}
+	if !reflect.DeepEqual(recorded, []driver.Value{paths[1]}) {
+		t.Errorf("got %q recorded in the ledger, want %q", recorded, paths[1:])
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// warmPool opens and pings n connections at once and leaves them idle in the pool
+// for the workers to pick up, instead of every worker opening its own as it starts.
+// It returns how long opening them took.
+func warmPool(db *sql.DB, n int) (time.Duration, error) {
+	// The pool keeps 2 idle connections by default and would close the rest
+	db.SetMaxIdleConns(max(n, 2))
+
+	started := time.Now()
+	conns := make([]*sql.Conn, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := db.Conn(context.Background())
+			if err == nil {
+				err = conn.PingContext(context.Background())
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("Can't open connection %d of %d: %w", i+1, n, err)
+			}
+			conns[i] = conn
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	// Give them back to the pool
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	return elapsed, errors.Join(errs...)
+}
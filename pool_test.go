@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWarmPool(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		wantIdle int
+	}{
+		{"one", 1, 1},
+		{"default idle", 2, 2},
+		{"more than the default idle", 8, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := newFakeDB(t, nil)
+
+			if _, err := warmPool(db, tt.n); err != nil {
+				t.Fatal(err)
+			}
+			// All of them are left open for the workers
+			stats := db.Stats()
+			if stats.OpenConnections != tt.n || stats.Idle != tt.wantIdle {
+				t.Errorf("got %d open and %d idle connections, want %d and %d", stats.OpenConnections, stats.Idle, tt.n, tt.wantIdle)
+			}
+		})
+	}
+}
+
+func TestWarmPoolFailure(t *testing.T) {
+	pingErr := errors.New("connection refused")
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if query == "PING" {
+			return nil, nil, pingErr
+		}
+		return nil, nil, nil
+	})
+
+	_, err := warmPool(db, 3)
+	if !errors.Is(err, pingErr) {
+		t.Fatalf("got %v, want the error of the ping", err)
+	}
+	// Every connection that failed is reported
+	for _, want := range []string{"Can't open connection 1 of 3", "Can't open connection 2 of 3", "Can't open connection 3 of 3"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want it to contain %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// prefilter passes on only the lines of the input that contain the substring,
+// skipping the rest before they are parsed. It looks at raw bytes so it knows
+// nothing about fields, quoting or records that span several lines.
+type prefilter struct {
+	r      *bufio.Reader
+	substr []byte
+	// Number of leading lines, i.e. the header, passed on as they are
+	keep int
+	// The line being passed on and the error that ended the input
+	line    []byte
+	long    []byte
+	readErr error
+}
+
+func newPrefilter(r io.Reader, substr string, keep, size int) *prefilter {
+	return &prefilter{r: bufio.NewReaderSize(r, size), substr: []byte(substr), keep: keep}
+}
+
+func (p *prefilter) Read(b []byte) (int, error) {
+	for len(p.line) == 0 {
+		if p.readErr != nil {
+			return 0, p.readErr
+		}
+
+		line, err := p.readLine()
+		p.readErr = err
+		if len(line) == 0 {
+			continue
+		}
+
+		if p.keep > 0 || bytes.Contains(line, p.substr) {
+			p.line = line
+		}
+		p.keep--
+	}
+
+	n := copy(b, p.line)
+	p.line = p.line[n:]
+
+	return n, nil
+}
+
+// readLine reads a line along with its newline. The line is valid
+// until the next call since it may point into the buffer of the reader.
+func (p *prefilter) readLine() ([]byte, error) {
+	line, err := p.r.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, err
+	}
+
+	// A line longer than the buffer is put together in a buffer of its own
+	p.long = append(p.long[:0], line...)
+	for err == bufio.ErrBufferFull {
+		line, err = p.r.ReadSlice('\n')
+		p.long = append(p.long, line...)
+	}
+
+	return p.long, err
+}
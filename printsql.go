@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxPrintSQL caps the number of statements -print-sql prints.
+const maxPrintSQL = 100
+
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+// sqlPrinter prints the first statements executed by all workers with their bind values
+// interpolated, for debugging only. The statements are still executed with parameters.
+type sqlPrinter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	limit   int
+	printed int
+}
+
+func newSQLPrinter(w io.Writer, limit int) *sqlPrinter {
+	if limit <= 0 {
+		return nil
+	}
+	if limit > maxPrintSQL {
+		limit = maxPrintSQL
+	}
+
+	return &sqlPrinter{w: w, limit: limit}
+}
+
+func (p *sqlPrinter) print(query string, args []interface{}) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.printed >= p.limit {
+		return
+	}
+	p.printed++
+
+	fmt.Fprintf(p.w, "%s;\n", interpolate(query, args))
+}
+
+// interpolate replaces placeholders with quoted literals of their values.
+func interpolate(query string, args []interface{}) string {
+	return placeholder.ReplaceAllStringFunc(query, func(match string) string {
+		n, err := strconv.Atoi(match[1:])
+		if err != nil || n < 1 || n > len(args) {
+			return match
+		}
+
+		return quoteLiteral(args[n-1])
+	})
+}
+
+func quoteLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case sql.NullString:
+		if !v.Valid {
+			return "NULL"
+		}
+		return quoteString(v.String)
+	case int:
+		return strconv.Itoa(v)
+	case []byte:
+		return `'\x` + hex.EncodeToString(v) + `'::bytea`
+	case string:
+		return quoteString(v)
+	}
+
+	return quoteString(fmt.Sprint(value))
+}
+
+// quoteString quotes a string the way standard_conforming_strings expects it.
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	args := make([]interface{}, 10)
+	for i := range args {
+		args[i] = i + 1
+	}
+	args[0] = "O'Brien"
+	args[9] = "tenth"
+
+	tests := []struct {
+		name  string
+		query string
+		args  []interface{}
+		want  string
+	}{
+		{"quotes", "INSERT INTO t (a) VALUES ($1)", []interface{}{"it's 'quoted'"}, "INSERT INTO t (a) VALUES ('it''s ''quoted''')"},
+		{"null", "INSERT INTO t (a,b) VALUES ($1,$2)", []interface{}{nil, sql.NullString{}}, "INSERT INTO t (a,b) VALUES (NULL,NULL)"},
+		{"bytea", "SELECT $1", []interface{}{[]byte{0xde, 0xad, 0x00}}, `SELECT '\xdead00'::bytea`},
+		{"$1 and $10", "SELECT $1, $10, $2", args, "SELECT 'O''Brien', 'tenth', 2"},
+		{"out of range", "SELECT $0, $3, $11", args[:2], "SELECT $0, $3, $11"},
+		{"no args", "SELECT 1", nil, "SELECT 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := interpolate(tt.query, tt.args); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, "NULL"},
+		{sql.NullString{}, "NULL"},
+		{sql.NullString{String: "a'b", Valid: true}, "'a''b'"},
+		{sql.NullString{String: "", Valid: true}, "''"},
+		{42, "42"},
+		{-1, "-1"},
+		{"", "''"},
+		{`back\slash`, `'back\slash'`},
+		{"''", "''''''"},
+		{[]byte{}, `'\x'::bytea`},
+		{[]byte("ab"), `'\x6162'::bytea`},
+		{int64(7), "'7'"},
+		{true, "'true'"},
+	}
+
+	for _, tt := range tests {
+		if got := quoteLiteral(tt.value); got != tt.want {
+			t.Errorf("quoteLiteral(%#v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSQLPrinter(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{"off", 0, 0},
+		{"limit", 3, 3},
+		{"cap", maxPrintSQL + 50, maxPrintSQL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			// A nil printer prints nothing
+			p := newSQLPrinter(&out, tt.limit)
+			for range maxPrintSQL * 2 {
+				p.print("SELECT $1", []interface{}{1})
+			}
+			if got := strings.Count(out.String(), "SELECT 1;\n"); got != tt.want {
+				t.Errorf("got %d statements printed, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How -progress-format reports the progress of the load
+const (
+	progressPlain = "plain"
+	progressJSON  = "json"
+	progressNone  = "none"
+)
+
+// progress counts what the workers have done so far for reporting it while the load runs.
+// The counts include the records of transactions that are yet to be committed.
+type progress struct {
+	format   string
+	interval time.Duration
+	// Report every this many processed records as well, never if zero
+	every int64
+	start time.Time
+	// Processed records the next report by count is due at
+	due atomic.Int64
+	// Keeps the lines of the two triggers from interleaving
+	mu sync.Mutex
+
+	processed atomic.Int64
+	affected  atomic.Int64
+	// Bytes of the input read so far out of its size when the size is known
+	read atomic.Int64
+	size int64
+}
+
+func newProgress(format string, interval time.Duration, every int64) *progress {
+	p := &progress{format: format, interval: interval, every: every}
+	p.due.Store(every)
+
+	return p
+}
+
+// add counts the records of an insert and reports the progress
+// if the number of processed records has just reached the next multiple of -progress-every-rows.
+func (p *progress) add(processed, affected int) {
+	if p == nil {
+		return
+	}
+
+	p.affected.Add(int64(affected))
+	n := p.processed.Add(int64(processed))
+
+	if p.every <= 0 {
+		return
+	}
+	for {
+		due := p.due.Load()
+		if n < due {
+			return
+		}
+		// Only the worker that moves the mark on reports
+		if p.due.CompareAndSwap(due, (n/p.every+1)*p.every) {
+			p.print()
+			return
+		}
+	}
+}
+
+// count makes the bytes read from the input count towards the percentage done
+// of the size of the input, which has to be known before the load starts.
+func (p *progress) count(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+
+	return &countingReader{r, &p.read}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+
+	return n, err
+}
+
+// progressEvent is a line of the JSON progress stream.
+type progressEvent struct {
+	Processed int64    `json:"processed"`
+	Affected  int64    `json:"affected"`
+	RPS       float64  `json:"rps"`
+	ElapsedMs int64    `json:"elapsed_ms"`
+	Pct       *float64 `json:"pct,omitempty"`
+}
+
+func (p *progress) event() progressEvent {
+	elapsed := time.Since(p.start)
+	e := progressEvent{
+		Processed: p.processed.Load(),
+		Affected:  p.affected.Load(),
+		ElapsedMs: elapsed.Milliseconds(),
+	}
+	if elapsed > 0 {
+		e.RPS = float64(e.Processed) / elapsed.Seconds()
+	}
+	if p.size > 0 {
+		pct := min(100*float64(p.read.Load())/float64(p.size), 100)
+		e.Pct = &pct
+	}
+
+	return e
+}
+
+// print writes the progress so far to stderr in the format of choice.
+func (p *progress) print() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := p.event()
+
+	if p.format == progressJSON {
+		line, _ := json.Marshal(e)
+		fmt.Fprintf(os.Stderr, "%s\n", line)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Processed %d, affected %d, %.0f records/s, elapsed %v", e.Processed, e.Affected, e.RPS, time.Duration(e.ElapsedMs)*time.Millisecond)
+	if e.Pct != nil {
+		fmt.Fprintf(os.Stderr, ", %.1f%%", *e.Pct)
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+// report prints the progress every interval until stopped.
+// The elapsed time and the rate count from the start of the reporting.
+func (p *progress) report() (stop func()) {
+	if p == nil {
+		return func() {}
+	}
+	p.start = time.Now()
+	if p.interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// recordSplitter turns input whose records are separated by a byte other than a newline,
+// e.g. \0 or \x1e, into CSV with a record per line for the CSV reader. Every record is
+// parsed on its own so that newlines are just characters of its fields and written out
+// again quoted the way the CSV reader expects it.
+type recordSplitter struct {
+	r   *bufio.Reader
+	sep byte
+	// Number of the record being split
+	record int
+	out    bytes.Buffer
+	writer *csv.Writer
+	// The error that ended the input
+	readErr error
+}
+
+func newRecordSplitter(r io.Reader, sep byte, size int) *recordSplitter {
+	s := &recordSplitter{r: bufio.NewReaderSize(r, size), sep: sep}
+	s.writer = csv.NewWriter(&s.out)
+
+	return s
+}
+
+func (s *recordSplitter) Read(b []byte) (int, error) {
+	for s.out.Len() == 0 {
+		if s.readErr != nil {
+			return 0, s.readErr
+		}
+
+		chunk, err := s.r.ReadBytes(s.sep)
+		s.readErr = err
+		chunk = bytes.TrimSuffix(chunk, []byte{s.sep})
+		// The newline that ends the file doesn't belong to the last record
+		if err == io.EOF {
+			chunk = bytes.TrimSuffix(bytes.TrimSuffix(chunk, []byte("\n")), []byte("\r"))
+		}
+		// Blank records are skipped the same way the CSV reader skips blank lines,
+		// including a newline after the last separator
+		if len(bytes.TrimRight(chunk, "\r\n")) == 0 {
+			continue
+		}
+		s.record++
+
+		fields, err := splitRecord(chunk, s.record)
+		if err != nil {
+			return 0, err
+		}
+		s.writer.Write(fields)
+		s.writer.Flush()
+		if err := s.writer.Error(); err != nil {
+			return 0, err
+		}
+	}
+
+	return s.out.Read(b)
+}
+
+// splitRecord splits a record into its comma separated fields unquoting the quoted ones.
+func splitRecord(record []byte, n int) ([]string, error) {
+	var fields []string
+	for i := 0; ; {
+		// A quoted field ends with a quote followed by a comma or the end of the record
+		if i < len(record) && record[i] == '"' {
+			var field []byte
+			for i++; ; i++ {
+				if i >= len(record) {
+					return nil, &csv.ParseError{StartLine: n, Line: n, Column: i + 1, Err: csv.ErrQuote}
+				}
+				if record[i] != '"' {
+					field = append(field, record[i])
+					continue
+				}
+				if i+1 < len(record) && record[i+1] == '"' {
+					field = append(field, '"')
+					i++
+					continue
+				}
+				break
+			}
+			fields = append(fields, string(field))
+			i++
+			if i == len(record) {
+				return fields, nil
+			}
+			if record[i] != ',' {
+				return nil, &csv.ParseError{StartLine: n, Line: n, Column: i + 1, Err: csv.ErrQuote}
+			}
+			i++
+			continue
+		}
+
+		end := bytes.IndexByte(record[i:], ',')
+		if end < 0 {
+			end = len(record) - i
+		}
+		field := record[i : i+end]
+		if quote := bytes.IndexByte(field, '"'); quote >= 0 {
+			return nil, &csv.ParseError{StartLine: n, Line: n, Column: i + quote + 1, Err: csv.ErrBareQuote}
+		}
+		fields = append(fields, string(field))
+		i += end
+		if i == len(record) {
+			return fields, nil
+		}
+		i++
+	}
+}
+
+// parseRecordSeparator reads -record-sep as a single character or an escape such as \0, \x1e or \t.
+func parseRecordSeparator(value string) (byte, error) {
+	sep := value
+	if value == `\0` {
+		sep = `\x00`
+	}
+	if len(sep) > 1 {
+		unquoted, err := strconv.Unquote(`"` + sep + `"`)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid record separator '%s'", value)
+		}
+		sep = unquoted
+	}
+
+	if len(sep) != 1 || sep[0] >= 0x80 {
+		return 0, fmt.Errorf("Invalid record separator '%s': expected a single ASCII character", value)
+	}
+	switch sep[0] {
+	case ',', '"':
+		return 0, fmt.Errorf("Invalid record separator '%s': it is part of the CSV syntax", value)
+	}
+
+	return sep[0], nil
+}
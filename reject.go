@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// What -conflict does with a record whose conflict key is already in the table
+const (
+	conflictSkip   = "skip"
+	conflictError  = "error"
+	conflictUpdate = "update"
+)
+
+// rejectClasses names the SQLSTATE codes of the errors rejected records are counted by.
+var rejectClasses = map[string]string{
+	"23505": "unique_violation",
+	"23502": "not_null_violation",
+	"23503": "foreign_key_violation",
+	"23514": "check_violation",
+}
+
+// rejectClass tells which class a rejected record is counted in.
+func rejectClass(code string) string {
+	if class, ok := rejectClasses[code]; ok {
+		return class
+	}
+
+	if len(code) != 5 {
+		return "other"
+	}
+
+	switch code[:2] {
+	case "23":
+		return "integrity_constraint_violation"
+	case "22":
+		return "data_exception"
+	}
+
+	return "other"
+}
+
+// rejectable tells whether the error is caused by the data of a record
+// so that the offending records can be rejected one by one.
+func rejectable(err error) bool {
+	code := sqlState(err)
+	if len(code) != 5 {
+		return false
+	}
+
+	return code[:2] == "22" || code[:2] == "23"
+}
+
+// rejectLog writes the records the database rejects to a CSV file with the line
+// of the input they start on, the SQLSTATE code and the message of the error appended.
+// The file is created when the first record is rejected.
+type rejectLog struct {
+	csvLog
+}
+
+func newRejectLog(path string, columns []string) *rejectLog {
+	header := append(append([]string{}, columns...), "line", "sqlstate", "error")
+
+	return &rejectLog{csvLog{name: "reject file", path: path, header: header}}
+}
+
+// write writes out the record and returns the class of the error it is rejected with.
+func (r *rejectLog) write(record inputRecord, err error) (string, error) {
+	code := sqlState(err)
+	class := rejectClass(code)
+
+	var missingErr *missingError
+	if errors.As(err, &missingErr) {
+		class = "required"
+	}
+	var typeErr *typeError
+	if errors.As(err, &typeErr) {
+		class = "type_mismatch"
+	}
+	var normalizeErr *normalizeError
+	if errors.As(err, &normalizeErr) {
+		class = "normalize"
+	}
+	var coerceErr *coercionError
+	if errors.As(err, &coerceErr) {
+		class = "coercion"
+	}
+	var sizeErr *rowSizeError
+	if errors.As(err, &sizeErr) {
+		class = "oversized"
+	}
+
+	var transformErr *transformError
+	if errors.As(err, &transformErr) {
+		class = "transform"
+	}
+	var countErr *fieldCountError
+	if errors.As(err, &countErr) {
+		class = "field_count"
+	}
+
+	line := append(append([]string{}, record.fields...), strconv.Itoa(record.line), code, err.Error())
+
+	return class, r.csvLog.write(line)
+}
+
+func (r *rejectLog) close() error {
+	if r == nil {
+		return nil
+	}
+
+	return r.csvLog.close()
+}
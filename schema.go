@@ -0,0 +1,504 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+var errSchemaMismatch = errors.New("CSV header doesn't match table columns")
+
+// schemaDiff describes how the columns of a CSV header differ from the columns of a table.
+type schemaDiff struct {
+	// Columns in the file but not in the table
+	FileOnly []string
+	// Columns in the table but not in the file
+	TableOnly []string
+	// Columns present in both but in a different relative order
+	Misordered []string
+}
+
+func (d schemaDiff) empty() bool {
+	return len(d.FileOnly) == 0 && len(d.TableOnly) == 0 && len(d.Misordered) == 0
+}
+
+func printSchemaDiff(diff schemaDiff) {
+	if diff.empty() {
+		fmt.Println("CSV header matches table columns")
+		return
+	}
+
+	if len(diff.FileOnly) > 0 {
+		fmt.Printf("Columns in the file but not in the table: %s\n", strings.Join(diff.FileOnly, ", "))
+	}
+	if len(diff.TableOnly) > 0 {
+		fmt.Printf("Columns in the table but not in the file: %s\n", strings.Join(diff.TableOnly, ", "))
+	}
+	if len(diff.Misordered) > 0 {
+		fmt.Printf("Columns in a different order: %s\n", strings.Join(diff.Misordered, ", "))
+	}
+}
+
+// checkSchema compares the CSV header against the columns of the table
+// other than the ones pload fills in itself i.e. the import id and expressions.
+func checkSchema(db *sql.DB, config config, header []string) (schemaDiff, error) {
+	// The fields -positional or -map-file maps go by the names of their columns
+	if config.Positions != nil {
+		header = config.Columns
+	}
+
+	columns, err := tableColumns(db, config.Table)
+	if err != nil {
+		return schemaDiff{}, err
+	}
+
+	generated := make(map[string]bool)
+	if config.StampImportId {
+		generated[importIdColumn] = true
+	}
+	for _, expr := range config.Exprs {
+		generated[normalizeColumn(expr.Column)] = true
+	}
+
+	var loaded []string
+	for _, column := range columns {
+		if !generated[normalizeColumn(column)] {
+			loaded = append(loaded, column)
+		}
+	}
+
+	return compareSchema(header, loaded, columnMatcher(config)), nil
+}
+
+// compareSchema compares column names by their keys, by default the way
+// Postgres resolves unquoted identifiers, i.e. case insensitively.
+func compareSchema(header, columns []string, key func(string) string) schemaDiff {
+	diff := schemaDiff{}
+
+	fileCommon := common(header, columns, key, &diff.FileOnly)
+	tableCommon := common(columns, header, key, &diff.TableOnly)
+
+	for i := range fileCommon {
+		if fileCommon[i] != tableCommon[i] {
+			diff.Misordered = append(diff.Misordered, fileCommon[i])
+		}
+	}
+
+	return diff
+}
+
+// common returns names from a that are also in b in the order of a,
+// collecting the rest into only.
+func common(a, b []string, key func(string) string, only *[]string) []string {
+	present := make(map[string]bool, len(b))
+	for _, name := range b {
+		present[key(name)] = true
+	}
+
+	var names []string
+	for _, name := range a {
+		name = key(name)
+		if present[name] {
+			names = append(names, name)
+		} else {
+			*only = append(*only, name)
+		}
+	}
+
+	return names
+}
+
+func normalizeColumn(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// columnMatcher returns the key the columns of the input are matched to the columns of the table by.
+// -columns-case-insensitive folds the case of all of Unicode rather than lower casing the names
+// and -fold-accents strips the accents as well so that e.g. naïve matches naive.
+func columnMatcher(config config) func(string) string {
+	if !config.FoldCase && !config.FoldAccents {
+		return normalizeColumn
+	}
+
+	return func(name string) string {
+		name = cases.Fold().String(strings.TrimSpace(name))
+		if config.FoldAccents {
+			stripped, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), name)
+			if err == nil {
+				name = stripped
+			}
+		}
+		return name
+	}
+}
+
+// resolveColumns renames the loaded columns after the columns of the table they match
+// so that they load into them. A column without a match is left as it is for
+// the database to report. How the columns that aren't exact matches are resolved is returned along.
+func resolveColumns(db *sql.DB, config config) ([]string, []string, error) {
+	columns, err := tableColumns(db, config.Table)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := columnMatcher(config)
+	byKey := make(map[string]string, len(columns))
+	for _, column := range columns {
+		k := key(column)
+		if other, ok := byKey[k]; ok {
+			return nil, nil, fmt.Errorf("Can't match columns: table columns '%s' and '%s' are the same when folded", other, column)
+		}
+		byKey[k] = column
+	}
+
+	resolved := make([]string, len(config.Columns))
+	var mapping []string
+	for i, name := range config.Columns {
+		column, ok := byKey[key(name)]
+		switch {
+		case !ok:
+			resolved[i] = name
+			mapping = append(mapping, fmt.Sprintf("'%s' matches no column", name))
+		case column != name:
+			resolved[i] = column
+			mapping = append(mapping, fmt.Sprintf("'%s' is loaded into '%s'", name, column))
+		default:
+			resolved[i] = name
+		}
+	}
+
+	return resolved, mapping, nil
+}
+
+// tableColumn describes a column of the target table.
+type tableColumn struct {
+	Name string
+	Type string
+	// The column can be omitted from an insert without failing
+	// because it is nullable, has a default or is generated
+	Optional bool
+	// The value is produced by the database as an identity or a generated column
+	Generated bool
+}
+
+// describeTable returns columns of the table in their ordinal order.
+// An unqualified table is looked up along the search path the way queries resolve it.
+func describeTable(db *sql.DB, table string) ([]tableColumn, error) {
+	schema, name := splitTableName(table)
+
+	rows, err := db.Query(
+		`SELECT column_name,
+			data_type,
+			is_nullable = 'YES' OR column_default IS NOT NULL OR is_identity = 'YES' OR is_generated <> 'NEVER',
+			is_identity = 'YES' OR is_generated <> 'NEVER'
+		FROM information_schema.columns
+		WHERE table_schema = COALESCE(NULLIF($1, ''), (
+			SELECT n.nspname
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.oid = to_regclass(quote_ident($2))
+		), current_schema())
+		AND table_name = $2
+		ORDER BY ordinal_position`,
+		schema,
+		name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []tableColumn
+	for rows.Next() {
+		var column tableColumn
+		if err := rows.Scan(&column.Name, &column.Type, &column.Optional, &column.Generated); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("Table '%s' doesn't exist or has no visible columns", table)
+	}
+
+	return columns, nil
+}
+
+// tableColumns returns column names of the table in their ordinal order.
+func tableColumns(db *sql.DB, table string) ([]string, error) {
+	columns, err := describeTable(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+
+	return names, nil
+}
+
+// checkRequired makes sure that every column that can't be omitted from an insert is loaded.
+func checkRequired(db *sql.DB, config config) error {
+	columns, err := describeTable(db, config.Table)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	loaded := append(loadColumns(config), config.Exprs.columns()...)
+	for _, column := range columns {
+		if !column.Optional && columnIndex(loaded, column.Name) < 0 {
+			missing = append(missing, column.Name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: required columns are not loaded: %s", errSchemaMismatch, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// privilegeError reports a privilege on the table the role of the connection lacks.
+type privilegeError struct {
+	Role      string
+	Table     string
+	Privilege string
+}
+
+func (e *privilegeError) Error() string {
+	return fmt.Sprintf("Role '%s' lacks the %s privilege on table '%s'", e.Role, e.Privilege, e.Table)
+}
+
+// checkPrivileges makes sure that the role can insert into the table, and update it with
+// -conflict update, either on the whole table or on every loaded column, before anything is read.
+// A table that doesn't exist yet is left to the other checks.
+func checkPrivileges(db *sql.DB, config config) error {
+	privileges := []string{"INSERT"}
+	if config.Conflict == conflictUpdate {
+		privileges = append(privileges, "UPDATE")
+	}
+
+	loaded := append(loadColumns(config), config.Exprs.columns()...)
+	names := make([]string, len(loaded))
+	for i, column := range loaded {
+		names[i] = unquoteIdentifier(column)
+	}
+
+	for _, privilege := range privileges {
+		var (
+			role    string
+			granted sql.NullBool
+		)
+		err := db.QueryRow(
+			`SELECT current_user,
+				CASE WHEN to_regclass($1) IS NOT NULL THEN
+					has_table_privilege(to_regclass($1), $2)
+					OR (SELECT bool_and(has_column_privilege(to_regclass($1), name, $2)) FROM unnest($3::text[]) AS name)
+				END`,
+			config.Table,
+			privilege,
+			pq.Array(names),
+		).Scan(&role, &granted)
+		if err != nil {
+			return err
+		}
+		if granted.Valid && !granted.Bool {
+			return &privilegeError{Role: role, Table: config.Table, Privilege: privilege}
+		}
+	}
+
+	return nil
+}
+
+// splitTableName splits an optionally schema qualified table name into the schema and the table.
+// Unquoted names are folded to lower case the same way Postgres does it.
+func splitTableName(table string) (string, string) {
+	parts := tableNameParts(table)
+	schema := ""
+	name := table
+	if len(parts) == 2 {
+		schema, name = parts[0], parts[1]
+	}
+
+	return unquoteIdentifier(schema), unquoteIdentifier(name)
+}
+
+// tableNameParts splits a dotted name into its identifiers leaving the dots of quoted ones alone.
+func tableNameParts(table string) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i, r := range table {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '.' && !quoted:
+			parts = append(parts, table[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, table[start:])
+}
+
+// checkTableName makes sure the table is named the way Postgres can reference it:
+// as a table optionally qualified with a schema.
+func checkTableName(table string) error {
+	parts := tableNameParts(table)
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("Invalid table name '%s'", table)
+		}
+	}
+
+	if len(parts) > 2 {
+		return fmt.Errorf("Invalid table name '%s': Postgres doesn't support cross-database references, "+
+			"name the table as table or schema.table and give the database in the connection string", table)
+	}
+
+	return nil
+}
+
+func unquoteIdentifier(identifier string) string {
+	if len(identifier) >= 2 && strings.HasPrefix(identifier, `"`) && strings.HasSuffix(identifier, `"`) {
+		return strings.ReplaceAll(identifier[1:len(identifier)-1], `""`, `"`)
+	}
+
+	return strings.ToLower(identifier)
+}
+
+// insertableColumns returns the columns of the table in their table order leaving out
+// generated and identity columns, the excluded ones and the ones pload fills in itself.
+func insertableColumns(db *sql.DB, config config, exclude []string) ([]string, error) {
+	columns, err := describeTable(db, config.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	exclude = append(exclude, config.Exprs.columns()...)
+	if config.StampImportId {
+		exclude = append(exclude, importIdColumn)
+	}
+
+	var names []string
+	for _, column := range columns {
+		if column.Generated || columnIndex(exclude, column.Name) >= 0 {
+			continue
+		}
+		names = append(names, column.Name)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("Table '%s' has no columns left to load", config.Table)
+	}
+
+	return names, nil
+}
+
+// isView tells whether the table is a view, which the rows are inserted into through
+// an INSTEAD OF trigger or a rule. A table that doesn't exist yet is not a view.
+func isView(db *sql.DB, table string) (bool, error) {
+	var view bool
+	err := db.QueryRow(`SELECT COALESCE((SELECT relkind = 'v' FROM pg_class WHERE oid = to_regclass($1)), false)`, table).Scan(&view)
+
+	return view, err
+}
+
+// checkView makes sure the load asks nothing of a view that takes ON CONFLICT
+// or RETURNING from a data modifying CTE, which views don't support.
+func checkView(config config) error {
+	switch {
+	case config.ConflictSet && config.Conflict != conflictError:
+		return fmt.Errorf("Can't use -conflict %s with view '%s': views don't support ON CONFLICT, leave -conflict out or use -conflict %s", config.Conflict, config.Table, conflictError)
+	case config.Skipped != nil:
+		return fmt.Errorf("Can't use -skipped-file with view '%s': nothing is skipped without ON CONFLICT", config.Table)
+	case config.DupAuditTable != "":
+		return fmt.Errorf("Can't use -dup-audit-table with view '%s': nothing is skipped without ON CONFLICT", config.Table)
+	case config.CountExpr != "":
+		return fmt.Errorf("Can't use -count-expr with view '%s': the count comes from the command tag", config.Table)
+	}
+
+	return nil
+}
+
+// headerMismatchError reports a header that differs from -expect-header
+// at the first position where they differ.
+type headerMismatchError struct {
+	Expected []string
+	Actual   []string
+	// Zero based position of the first column that differs
+	Position int
+}
+
+func (e *headerMismatchError) Error() string {
+	column := func(columns []string) string {
+		if e.Position < len(columns) {
+			return "'" + columns[e.Position] + "'"
+		}
+		return "nothing"
+	}
+
+	return fmt.Sprintf("Header doesn't match -expect-header at column %d: expected %s, got %s\n  expected: %s\n  actual:   %s",
+		e.Position+1, column(e.Expected), column(e.Actual), strings.Join(e.Expected, ","), strings.Join(e.Actual, ","))
+}
+
+func (e *headerMismatchError) Unwrap() error {
+	return errSchemaMismatch
+}
+
+// checkHeader compares the header to the expected one column by column,
+// ignoring the case of the names if asked to.
+func checkHeader(header, expected []string, fold bool) error {
+	actual := make([]string, len(header))
+	for i, name := range header {
+		actual[i] = strings.TrimSpace(name)
+	}
+
+	for i := 0; i < max(len(actual), len(expected)); i++ {
+		if i < len(actual) && i < len(expected) && (actual[i] == expected[i] || fold && strings.EqualFold(actual[i], expected[i])) {
+			continue
+		}
+		return &headerMismatchError{Expected: expected, Actual: actual, Position: i}
+	}
+
+	return nil
+}
+
+// checkExtraColumns fails if the header has fields the load leaves out: the ones -map-file
+// or -positional doesn't map or, as the fields otherwise go by position, the ones beyond
+// the columns. The fields -ignore-cols drops are left out on purpose.
+func checkExtraColumns(header []string, config config) error {
+	var extra []string
+	if config.Positions != nil {
+		mapped := make(map[int]bool, len(config.Positions))
+		for _, position := range config.Positions {
+			mapped[position] = true
+		}
+		for i, name := range header {
+			if !mapped[i] {
+				extra = append(extra, name)
+			}
+		}
+	} else if loaded := len(config.Columns) + len(config.IgnoreCols); len(header) > loaded {
+		extra = header[loaded:]
+	}
+
+	if len(extra) > 0 {
+		return fmt.Errorf("The input has columns that aren't loaded: %s", strings.Join(extra, ", "))
+	}
+
+	return nil
+}
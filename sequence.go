@@ -0,0 +1,83 @@
+package main
+
+import "sync"
+
+// sequencer lets workers take turns in the order of the batches in the input.
+type sequencer struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	turn    int
+	stopped bool
+}
+
+func newSequencer() *sequencer {
+	s := &sequencer{}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// wait blocks until it is the turn of the batch with the given number.
+// It returns false if the sequence has been stopped.
+func (s *sequencer) wait(batch int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.turn != batch && !s.stopped {
+		s.cond.Wait()
+	}
+
+	return !s.stopped
+}
+
+// next passes the turn on to the following batch.
+func (s *sequencer) next() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.turn++
+	s.cond.Broadcast()
+}
+
+// stop releases everybody waiting for their turn because the load is failing.
+func (s *sequencer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	s.cond.Broadcast()
+}
+
+// deal hands out the records to workers in turns of a batch each so that
+// the n-th batch of the k-th of w workers is the n*w+k-th batch of the input.
+// Every record carries the number of its turn.
+// The channels of the workers are closed once the records run out.
+func deal(done <-chan struct{}, records <-chan inputRecord, workers, batchSize int) []<-chan inputRecord {
+	channels := make([]chan inputRecord, workers)
+	dealt := make([]<-chan inputRecord, workers)
+	for i := range channels {
+		channels[i] = make(chan inputRecord, batchSize)
+		dealt[i] = channels[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, channel := range channels {
+				close(channel)
+			}
+		}()
+
+		n := 0
+		for record := range records {
+			record.turn = n / batchSize
+			select {
+			case channels[n/batchSize%workers] <- record:
+			case <-done:
+				return
+			}
+			n++
+		}
+	}()
+
+	return dealt
+}
@@ -0,0 +1,35 @@
+package main
+
+import "hash/fnv"
+
+// shard routes every record to the worker picked by the hash of its value of the column
+// so that records with the same value always go to the same worker, run after run.
+// The channels of the workers are closed once the records run out.
+func shard(done <-chan struct{}, records <-chan inputRecord, workers, index, bufferSize int) []<-chan inputRecord {
+	channels := make([]chan inputRecord, workers)
+	sharded := make([]<-chan inputRecord, workers)
+	for i := range channels {
+		channels[i] = make(chan inputRecord, bufferSize)
+		sharded[i] = channels[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, channel := range channels {
+				close(channel)
+			}
+		}()
+
+		for record := range records {
+			hash := fnv.New32a()
+			hash.Write([]byte(record.fields[index]))
+			select {
+			case channels[hash.Sum32()%uint32(workers)] <- record:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return sharded
+}
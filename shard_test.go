@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestShard(t *testing.T) {
+	records := make(chan inputRecord)
+	go func() {
+		defer close(records)
+		for i := range 100 {
+			records <- inputRecord{line: i + 1, fields: []string{fmt.Sprintf("g%d", i%10), fmt.Sprint(i)}}
+		}
+	}()
+
+	done := make(chan struct{})
+	sharded := shard(done, records, 3, 0, 1)
+	if len(sharded) != 3 {
+		t.Fatalf("got %d channels, want 3", len(sharded))
+	}
+
+	// Drain the workers together, a worker that isn't received from holds up the rest
+	type routed struct {
+		worker int
+		record inputRecord
+	}
+	all := make(chan routed)
+	for worker, channel := range sharded {
+		go func() {
+			for record := range channel {
+				all <- routed{worker, record}
+			}
+			all <- routed{worker: -1}
+		}()
+	}
+
+	workerOf := make(map[string]int)
+	lastLine := make(map[int]int)
+	count := 0
+	for closed := 0; closed < len(sharded); {
+		r := <-all
+		if r.worker < 0 {
+			closed++
+			continue
+		}
+		count++
+
+		key := r.record.fields[0]
+		if worker, seen := workerOf[key]; seen && worker != r.worker {
+			t.Errorf("key %s went to workers %d and %d", key, worker, r.worker)
+		}
+		workerOf[key] = r.worker
+		// A worker gets its records in the order of the input
+		if r.record.line < lastLine[r.worker] {
+			t.Errorf("worker %d got line %d after line %d", r.worker, r.record.line, lastLine[r.worker])
+		}
+		lastLine[r.worker] = r.record.line
+	}
+	if count != 100 {
+		t.Errorf("got %d records, want 100", count)
+	}
+
+	// The same key goes to the same worker run after run
+	again := make(chan inputRecord, 10)
+	for i := range 10 {
+		again <- inputRecord{fields: []string{fmt.Sprintf("g%d", i), ""}}
+	}
+	close(again)
+	for worker, channel := range shard(done, again, 3, 0, 10) {
+		for record := range channel {
+			if want := workerOf[record.fields[0]]; worker != want {
+				t.Errorf("key %s went to worker %d, want %d as before", record.fields[0], worker, want)
+			}
+		}
+	}
+}
+
+func TestShardDone(t *testing.T) {
+	// Never closed, so the channels close only if the shard stops on done. There are
+	// more records than it can route in the receives racing done below.
+	records := make(chan inputRecord, 1000)
+	for i := range cap(records) {
+		records <- inputRecord{fields: []string{fmt.Sprintf("g%d", i), ""}}
+	}
+
+	done := make(chan struct{})
+	sharded := shard(done, records, 2, 0, 0)
+	close(done)
+
+	for worker, channel := range sharded {
+		timeout := time.After(time.Second)
+		for open := true; open; {
+			select {
+			case _, open = <-channel:
+			case <-timeout:
+				t.Fatalf("channel of worker %d is not closed once done", worker)
+			}
+		}
+	}
+}
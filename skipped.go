@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// skippedLog writes the records ON CONFLICT DO NOTHING skips to a CSV file
+// with the line of the input they start on appended.
+// The file is created when the first record is skipped.
+type skippedLog struct {
+	csvLog
+}
+
+func newSkippedLog(path string, columns []string) *skippedLog {
+	header := append(append([]string{}, columns...), "line")
+
+	return &skippedLog{csvLog{name: "skipped file", path: path, header: header}}
+}
+
+func (s *skippedLog) write(record inputRecord) error {
+	return s.csvLog.write(append(append([]string{}, record.fields...), strconv.Itoa(record.line)))
+}
+
+func (s *skippedLog) close() error {
+	if s == nil {
+		return nil
+	}
+
+	return s.csvLog.close()
+}
+
+// describeKeyType returns the type of the conflict key column of the table with its modifiers,
+// or an empty string if the table has no such column.
+func describeKeyType(db *sql.DB, table string) (string, error) {
+	var typ string
+	err := db.QueryRow(
+		`SELECT format_type(atttypid, atttypmod)
+		FROM pg_attribute
+		WHERE attrelid = to_regclass($1) AND attname = $2 AND NOT attisdropped`,
+		table,
+		conflictKey,
+	).Scan(&typ)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Can't look up the type of column '%s': %w", conflictKey, err)
+	}
+
+	return typ, nil
+}
+
+// keptAsSent tells whether the values of the type come back as text exactly as they were sent.
+func keptAsSent(typ string) bool {
+	return typ == "" || typ == "text" || strings.HasPrefix(typ, "character varying")
+}
+
+// batchKeys returns the conflict keys of the batch the way the insert returns them. Unless the key
+// column is text they are cast to its type and back on the server, e.g. an upper case uuid comes back
+// in lower case and a padded integer without the padding, so that they compare with the returned keys.
+func batchKeys(tx *sql.Tx, config config, batch []inputRecord, keyIndex int) ([]sql.NullString, error) {
+	keys := make([]sql.NullString, len(batch))
+	for i, record := range batch {
+		key, ok := nullify(record.fields[keyIndex], config.NullEscape).(string)
+		keys[i] = sql.NullString{String: key, Valid: ok}
+	}
+	if keptAsSent(config.KeyType) {
+		return keys, nil
+	}
+
+	rows, err := tx.Query(
+		fmt.Sprintf(`SELECT key::%s::text FROM unnest($1::text[]) WITH ORDINALITY AS keys(key, n) ORDER BY n`, config.KeyType),
+		pq.Array(keys),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		if err := rows.Scan(&keys[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, rows.Err()
+}
+
+// skippedRecords returns the records of the batch whose conflict keys, as batchKeys returns them,
+// are not among the keys the insert returned. Of several records with the same key
+// the ones beyond the number of times it was returned are skipped.
+func skippedRecords(batch []inputRecord, keys, returned []sql.NullString) []inputRecord {
+	inserted := make(map[string]int, len(returned))
+	for _, key := range returned {
+		if key.Valid {
+			inserted[key.String]++
+		}
+	}
+
+	var skipped []inputRecord
+	for i, record := range batch {
+		// NULLs never conflict
+		if !keys[i].Valid {
+			continue
+		}
+		if inserted[keys[i].String] > 0 {
+			inserted[keys[i].String]--
+			continue
+		}
+		skipped = append(skipped, record)
+	}
+
+	return skipped
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// maxSlowest is the number of the slowest batches that are reported.
+const maxSlowest = 10
+
+// batchTiming describes how long inserting a batch took.
+type batchTiming struct {
+	Worker int
+	// Number of the first record of the batch among the records the worker received
+	Record  int
+	Records int
+	Table   string
+	// Conflict key of the first record of the batch if it is loaded
+	Key      string `json:",omitempty"`
+	Duration time.Duration
+}
+
+// slowest keeps the slowest batches seen so far in a min-heap
+// so that the fastest of them is the one to give way.
+type slowest []batchTiming
+
+func (s slowest) Len() int            { return len(s) }
+func (s slowest) Less(i, j int) bool  { return s[i].Duration < s[j].Duration }
+func (s slowest) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
+func (s *slowest) Push(x interface{}) { *s = append(*s, x.(batchTiming)) }
+func (s *slowest) Pop() interface{} {
+	old := *s
+	n := len(old)
+	timing := old[n-1]
+	*s = old[:n-1]
+	return timing
+}
+
+// add records the batch if it is among the slowest ones.
+func (s *slowest) add(timing batchTiming) {
+	if s.Len() < maxSlowest {
+		heap.Push(s, timing)
+		return
+	}
+	if timing.Duration > (*s)[0].Duration {
+		(*s)[0] = timing
+		heap.Fix(s, 0)
+	}
+}
+
+// sorted returns the batches from the slowest to the fastest one.
+func (s slowest) sorted() []batchTiming {
+	if len(s) == 0 {
+		return nil
+	}
+
+	timings := append([]batchTiming(nil), s...)
+	sort.Slice(timings, func(i, j int) bool { return timings[i].Duration > timings[j].Duration })
+
+	return timings
+}
+
+// mergeSlowest merges two lists of the slowest batches keeping the slowest of both.
+func mergeSlowest(a, b []batchTiming) []batchTiming {
+	var s slowest
+	for _, timing := range a {
+		s.add(timing)
+	}
+	for _, timing := range b {
+		s.add(timing)
+	}
+
+	return s.sorted()
+}
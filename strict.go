@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The literals of the types the way the server writes them back, so that a value that passes
+// is stored as it is written rather than being read into something else
+var (
+	integerPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+	numericPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+	uuidPattern    = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	// ISO 8601 with the microseconds the types keep at most and, for timestamptz only, an offset
+	datePattern      = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+	timestampPattern = regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2})[ T]([0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]{1,6})?)(Z|[+-][0-9]{2}(:?[0-9]{2})?)?$`)
+)
+
+// typeCheck tells whether a value is written the way the type of its column
+// expects it rather than relying on the database to make sense of it.
+type typeCheck struct {
+	Column string
+	Index  int
+	Type   string
+	Valid  func(string) bool
+}
+
+// describeColumnTypes returns the data types of the columns of the table by their lower case names.
+func describeColumnTypes(db *sql.DB, table string) (map[string]string, error) {
+	columns, err := describeTable(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]string, len(columns))
+	for _, column := range columns {
+		types[strings.ToLower(column.Name)] = column.Type
+	}
+
+	return types, nil
+}
+
+// buildTypeChecks picks the checks of the loaded columns after their types in the table.
+// Columns of the types without a check, e.g. text, take any value.
+func buildTypeChecks(config config) []typeCheck {
+	if !config.StrictTypes {
+		return nil
+	}
+
+	var checks []typeCheck
+	for i, column := range config.Columns {
+		typ := config.ColumnTypes[strings.ToLower(column)]
+		if valid := typeValidator(typ); valid != nil {
+			checks = append(checks, typeCheck{column, i, typ, valid})
+		}
+	}
+
+	return checks
+}
+
+// typeValidator returns the check of values of the data type or nil if there is none.
+// The checks take the canonical literals of the types only and refuse the values the server
+// would take by coercing them: spaces around a number, t or yes for true, a timestamp for a date,
+// a timestamp without an offset, read in the time zone of the session, for a timestamptz and one
+// with an offset for a timestamp, which drops it.
+func typeValidator(typ string) func(string) bool {
+	switch typ {
+	case "smallint":
+		return func(value string) bool { return parsesInt(value, 16) }
+	case "integer":
+		return func(value string) bool { return parsesInt(value, 32) }
+	case "bigint":
+		return func(value string) bool { return parsesInt(value, 64) }
+	case "numeric", "real", "double precision":
+		return func(value string) bool {
+			switch value {
+			case "NaN", "Infinity", "-Infinity":
+				return true
+			}
+			return numericPattern.MatchString(value)
+		}
+	case "boolean":
+		return func(value string) bool { return value == "true" || value == "false" }
+	case "date":
+		return func(value string) bool {
+			return isInfinity(value) || datePattern.MatchString(value) && parsesDate(value)
+		}
+	case "timestamp without time zone":
+		return func(value string) bool { return isInfinity(value) || parsesTimestamp(value, false) }
+	case "timestamp with time zone":
+		return func(value string) bool { return isInfinity(value) || parsesTimestamp(value, true) }
+	case "uuid":
+		return uuidPattern.MatchString
+	case "json", "jsonb":
+		return func(value string) bool { return json.Valid([]byte(value)) }
+	}
+
+	return nil
+}
+
+func parsesInt(value string, bitSize int) bool {
+	if !integerPattern.MatchString(value) {
+		return false
+	}
+	_, err := strconv.ParseInt(value, 10, bitSize)
+	return err == nil
+}
+
+func isInfinity(value string) bool {
+	return value == "infinity" || value == "-infinity"
+}
+
+// parsesDate tells whether the ISO 8601 date exists.
+func parsesDate(value string) bool {
+	_, err := time.Parse(time.DateOnly, value)
+	return err == nil
+}
+
+// parsesTimestamp tells whether the value is an ISO 8601 timestamp that exists, with an offset
+// of at most 15 hours if it has to have one or without one if it can't.
+func parsesTimestamp(value string, offset bool) bool {
+	match := timestampPattern.FindStringSubmatch(value)
+	if match == nil || (match[4] != "") != offset {
+		return false
+	}
+	if _, err := time.Parse(time.DateTime, match[1]+" "+match[2]); err != nil {
+		return false
+	}
+	if len(match[4]) < 3 {
+		return true
+	}
+
+	hours, _ := strconv.Atoi(match[4][1:3])
+	minutes := 0
+	if rest := strings.TrimPrefix(match[4][3:], ":"); rest != "" {
+		minutes, _ = strconv.Atoi(rest)
+	}
+
+	return hours <= 15 && minutes < 60
+}
+
+// typeError reports a value that doesn't parse as the type of its column.
+type typeError struct {
+	Column string
+	Type   string
+	Value  string
+	Line   int
+}
+
+func (e *typeError) Error() string {
+	return fmt.Sprintf("Value '%s' of column '%s' in the record on line %d is not a valid %s", e.Value, e.Column, e.Line, e.Type)
+}
+
+// mistyped returns the first of the checked fields whose value isn't valid for the column type.
+// NULLs are valid for any type.
+func mistyped(record []string, checks []typeCheck) (typeCheck, bool) {
+	for _, check := range checks {
+		value := record[check.Index]
+		if value != nullValue && !check.Valid(value) {
+			return check, true
+		}
+	}
+
+	return typeCheck{}, false
+}
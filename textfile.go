@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// writeTextfile writes the totals of the run in the Prometheus text format for
+// the textfile collector of node_exporter. The file is written under a temporary name
+// the collector ignores and renamed into place so that it never reads half of it.
+func writeTextfile(path string, table string, totals *totals, end time.Time) error {
+	labels := fmt.Sprintf(`{table="%s"}`, escapeLabel(table))
+
+	var text strings.Builder
+	gauge := func(name, help string, value any) {
+		fmt.Fprintf(&text, "# HELP %s %s\n# TYPE %s gauge\n%s%s %v\n", name, help, name, name, labels, value)
+	}
+	success := 0
+	if totals.Error == nil {
+		success = 1
+	}
+	gauge("pload_last_run_success", "Whether the last run succeeded.", success)
+	gauge("pload_last_run_timestamp_seconds", "When the last run ended in seconds since the epoch.", end.Unix())
+	gauge("pload_last_run_duration_seconds", "How long the last run took.", totals.Duration.Seconds())
+	gauge("pload_last_run_processed", "Records processed by the last run.", totals.Records.Processed)
+	gauge("pload_last_run_affected", "Records inserted or updated by the last run.", totals.Records.Affected)
+	gauge("pload_last_run_skipped", "Records skipped on a conflict by the last run.", totals.Records.Skipped)
+	gauge("pload_last_run_rejected", "Records the database refused in the last run.", totals.Records.Rejected)
+	gauge("pload_last_run_parse_errors", "Records of the last run that failed to parse.", totals.ParseErrors)
+	gauge("pload_last_run_duplicates", "Records of the last run dropped by -dedupe.", totals.Duplicates)
+
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// The collector only reads files ending with .prom
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(text.String()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// escapeLabel escapes a label value of the Prometheus text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
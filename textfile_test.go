@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	dir := t.TempDir()
+	// The directory is created if it doesn't exist
+	path := filepath.Join(dir, "textfile", "pload.prom")
+
+	end := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		totals totals
+		want   []string
+	}{
+		{
+			"success",
+			totals{
+				Records:     ingestResult{Processed: 10, Affected: 7, Skipped: 2, Rejected: 1},
+				ParseErrors: 3,
+				Duplicates:  4,
+				Duration:    1500 * time.Millisecond,
+			},
+			[]string{
+				"# HELP pload_last_run_success Whether the last run succeeded.\n# TYPE pload_last_run_success gauge\npload_last_run_success{table=\"marketo.activities\"} 1\n",
+				`pload_last_run_timestamp_seconds{table="marketo.activities"} 1700000000` + "\n",
+				`pload_last_run_duration_seconds{table="marketo.activities"} 1.5` + "\n",
+				`pload_last_run_processed{table="marketo.activities"} 10` + "\n",
+				`pload_last_run_affected{table="marketo.activities"} 7` + "\n",
+				`pload_last_run_skipped{table="marketo.activities"} 2` + "\n",
+				`pload_last_run_rejected{table="marketo.activities"} 1` + "\n",
+				`pload_last_run_parse_errors{table="marketo.activities"} 3` + "\n",
+				`pload_last_run_duplicates{table="marketo.activities"} 4` + "\n",
+			},
+		},
+		{
+			"failure",
+			totals{Error: newLoadError(errors.New("boom"))},
+			[]string{`pload_last_run_success{table="marketo.activities"} 0` + "\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := writeTextfile(path, "marketo.activities", &tt.totals, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(text), want) {
+					t.Errorf("got %s, want it to contain %q", text, want)
+				}
+			}
+			if got := strings.Count(string(text), "# TYPE "); got != 9 {
+				t.Errorf("got %d metrics, want 9", got)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); mode != 0644 {
+				t.Errorf("got mode %v, want 0644", mode)
+			}
+
+			// Nothing but the file is left behind
+			entries, err := os.ReadDir(filepath.Dir(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Name() != "pload.prom" {
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("got files %v, want only pload.prom", names)
+			}
+		})
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"marketo.activities", "marketo.activities"},
+		{`"Activities"`, `\"Activities\"`},
+		{`a\b`, `a\\b`},
+		{"a\nb", `a\nb`},
+		{`\"`, `\\\"`},
+	}
+
+	for _, tt := range tests {
+		if got := escapeLabel(tt.value); got != tt.want {
+			t.Errorf("escapeLabel(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/types"
+	"github.com/expr-lang/expr/vm"
+)
+
+// transformer evaluates the -transform expression against records. The fields
+// of a record are variables named after their columns, NULL fields are nil.
+// The expression returns a map of the columns to change to their new values.
+type transformer struct {
+	program *vm.Program
+	columns []string
+	env     map[string]interface{}
+}
+
+func newTransformer(script string, columns []string) (*transformer, error) {
+	// Fields are checked at run time since any of them may be NULL
+	fields := make(types.Map, len(columns))
+	for _, column := range columns {
+		fields[column] = types.Any
+	}
+
+	program, err := expr.Compile(script, expr.Env(fields), expr.AsKind(reflect.Map))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid transform: %w", err)
+	}
+
+	env := make(map[string]interface{}, len(columns))
+
+	return &transformer{program: program, columns: columns, env: env}, nil
+}
+
+// transformError reports a record the expression fails on.
+type transformError struct {
+	Line int
+	Err  error
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("Record on line %d: %v", e.Line, e.Err)
+}
+
+func (e *transformError) Unwrap() error {
+	return e.Err
+}
+
+// transform changes the record in place. It isn't safe for concurrent use.
+func (t *transformer) transform(record []string) error {
+	for i, column := range t.columns {
+		if i >= len(record) || record[i] == nullValue {
+			t.env[column] = nil
+			continue
+		}
+		t.env[column] = record[i]
+	}
+
+	output, err := expr.Run(t.program, t.env)
+	if err != nil {
+		return fmt.Errorf("Transform failed: %w", err)
+	}
+
+	changes, ok := output.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Transform returned %T instead of a map of columns", output)
+	}
+
+	// Leave the record intact if any of the changes can't be applied
+	for column := range changes {
+		if i := columnIndex(t.columns, column); i < 0 || i >= len(record) {
+			return fmt.Errorf("Transform returned column '%s' that is not loaded", column)
+		}
+	}
+
+	for column, value := range changes {
+		i := columnIndex(t.columns, column)
+		switch value := value.(type) {
+		case nil:
+			record[i] = nullValue
+		case string:
+			record[i] = value
+		default:
+			record[i] = fmt.Sprint(value)
+		}
+	}
+
+	return nil
+}
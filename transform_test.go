@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewTransformer(t *testing.T) {
+	tests := []struct {
+		script  string
+		wantErr bool
+	}{
+		{`{"leadid": upper(leadid)}`, false},
+		{`{}`, false},
+		{`{"leadid": `, true},
+		// Checked at compile time to return a map
+		{`upper(leadid)`, true},
+	}
+
+	for _, tt := range tests {
+		_, err := newTransformer(tt.script, []string{"marketoguid", "leadid"})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newTransformer(%q) got %v, want an error %v", tt.script, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		record  []string
+		want    []string
+		wantErr string
+	}{
+		{"upper", `{"leadid": upper(leadid)}`, []string{"g1", "abc"}, []string{"g1", "ABC"}, ""},
+		{"untouched", `{}`, []string{"g1", "abc"}, []string{"g1", "abc"}, ""},
+		{"to null", `{"leadid": leadid == "0" ? nil : leadid}`, []string{"g1", "0"}, []string{"g1", nullValue}, ""},
+		{"from null", `{"leadid": leadid ?? "none"}`, []string{"g1", nullValue}, []string{"g1", "none"}, ""},
+		{"not a string", `{"leadid": len(marketoguid) * 2}`, []string{"g1", "x"}, []string{"g1", "4"}, ""},
+		{"unknown column", `{"leadid": "x", "other": "y"}`, []string{"g1", "abc"}, []string{"g1", "abc"},
+			"Transform returned column 'other' that is not loaded"},
+		{"failing", `{"leadid": upper(leadid)}`, []string{"g1", nullValue}, []string{"g1", nullValue}, "Transform failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer, err := newTransformer(tt.script, []string{"marketoguid", "leadid"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			record := append([]string{}, tt.record...)
+
+			err = transformer.transform(record)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+			// A record the transform fails on is left as it was
+			if !reflect.DeepEqual(record, tt.want) {
+				t.Errorf("got %q, want %q", record, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTransformError(t *testing.T) {
+	const input = "g1,a\ng2,null\ng3,c\n"
+	transformConfig := func(t *testing.T) config {
+		config := testConfig()
+		var err error
+		config.Transform, err = newTransformer(`{"leadid": upper(leadid)}`, config.Columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		db, _ := newFakeDB(t, nil)
+
+		_, err := ingestAll(csv.NewReader(strings.NewReader(input)), db, transformConfig(t))
+		var transformErr *transformError
+		if !errors.As(err, &transformErr) || transformErr.Line != 2 {
+			t.Errorf("got %v, want the transform error of line 2", err)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		db, fake := newFakeDB(t, nil)
+		config := transformConfig(t)
+		path := filepath.Join(t.TempDir(), "rejects.csv")
+		config.Rejects = newRejectLog(path, config.Columns)
+
+		result, err := ingestAll(csv.NewReader(strings.NewReader(input)), db, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.Rejects.close(); err != nil {
+			t.Fatal(err)
+		}
+		if result.Processed != 3 || result.Affected != 2 || result.Rejected != 1 || result.Rejects["transform"] != 1 {
+			t.Errorf("got %+v, want 3 records processed, 2 affected and 1 rejected by the transform", result)
+		}
+		if inserts := fake.inserts(); len(inserts) != 1 || len(inserts[0].Args) != 4 || inserts[0].Args[1] != "A" || inserts[0].Args[3] != "C" {
+			t.Errorf("got inserts %v, want g1 and g3 transformed", inserts)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		rejected := readAll(t, file)
+		if len(rejected) != 2 || rejected[1][0] != "g2" || rejected[1][2] != "2" {
+			t.Errorf("got reject file %q, want the record of line 2", rejected)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// checkPreparedTransactions makes sure the server lets every worker prepare its transaction.
+func checkPreparedTransactions(db *sql.DB, workers int) error {
+	var setting string
+	err := db.QueryRow("SHOW max_prepared_transactions").Scan(&setting)
+	if err != nil {
+		return err
+	}
+
+	max, err := strconv.Atoi(setting)
+	if err != nil {
+		return fmt.Errorf("Can't parse max_prepared_transactions '%s': %w", setting, err)
+	}
+	if max < workers {
+		return fmt.Errorf("-2pc needs max_prepared_transactions of at least %d, the server allows %d", workers, max)
+	}
+
+	return nil
+}
+
+// prepare prepares the transaction for committing later under the id.
+// The session is done with it once it is prepared so the Tx is let go.
+func prepare(tx *sql.Tx, id string) error {
+	// The id can't be passed as a parameter, it is generated and never contains a quote
+	_, err := tx.Exec(fmt.Sprintf("PREPARE TRANSACTION '%s'", id))
+	// Give the connection back, there is no transaction left to roll back
+	tx.Rollback()
+
+	return err
+}
+
+// settle commits or rolls back all the prepared transactions.
+// It keeps going past a failure and reports the transactions left prepared.
+func settle(db *sql.DB, ids []string, commit bool) error {
+	statement := "ROLLBACK PREPARED"
+	if commit {
+		statement = "COMMIT PREPARED"
+	}
+
+	var (
+		left    []string
+		lastErr error
+	)
+	for _, id := range ids {
+		_, err := db.Exec(fmt.Sprintf("%s '%s'", statement, id))
+		if err != nil {
+			left = append(left, id)
+			lastErr = err
+		}
+	}
+
+	if lastErr != nil {
+		return fmt.Errorf("Can't %s %d of %d prepared transactions, settle %s by hand: %w",
+			strings.ToLower(statement), len(left), len(ids), strings.Join(left, ", "), lastErr)
+	}
+
+	return nil
+}
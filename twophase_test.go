@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/csv"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var preparedIdPattern = regexp.MustCompile(`^(PREPARE TRANSACTION|COMMIT PREPARED|ROLLBACK PREPARED) '(.+)'$`)
+
+// preparedIds returns the ids of the transactions the statements prepared, committed and rolled back.
+func preparedIds(fake *fakeDB) (prepared, committed, rolledBack []string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	for _, statement := range fake.statements {
+		match := preparedIdPattern.FindStringSubmatch(statement.Query)
+		if match == nil {
+			continue
+		}
+		switch match[1] {
+		case "PREPARE TRANSACTION":
+			prepared = append(prepared, match[2])
+		case "COMMIT PREPARED":
+			committed = append(committed, match[2])
+		case "ROLLBACK PREPARED":
+			rolledBack = append(rolledBack, match[2])
+		}
+	}
+	slices.Sort(prepared)
+	slices.Sort(committed)
+	slices.Sort(rolledBack)
+
+	return prepared, committed, rolledBack
+}
+
+// twoPhaseConfig deals the records to two workers in turns. With -preserve-order
+// every batch, of a single record, is prepared on its own.
+func twoPhaseConfig() config {
+	config := testConfig()
+	config.TwoPhase = "pload_test"
+	config.Workers = 2
+	config.InsertSize = 1
+	config.PreserveOrder = true
+
+	return config
+}
+
+func TestIngestAllTwoPhase(t *testing.T) {
+	db, fake := newFakeDB(t, nil)
+
+	reader := csv.NewReader(strings.NewReader("g1,1\ng2,2\ng3,3\ng4,4\n"))
+	result, err := ingestAll(reader, db, twoPhaseConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Affected != 4 {
+		t.Errorf("got %d records affected, want 4", result.Affected)
+	}
+
+	prepared, committed, rolledBack := preparedIds(fake)
+	want := []string{"pload_test_1_1", "pload_test_1_2", "pload_test_2_1", "pload_test_2_2"}
+	if !slices.Equal(prepared, want) {
+		t.Errorf("got prepared %v, want %v", prepared, want)
+	}
+	if !slices.Equal(committed, want) {
+		t.Errorf("got committed %v, want %v", committed, want)
+	}
+	if len(rolledBack) > 0 {
+		t.Errorf("got rolled back %v, want none", rolledBack)
+	}
+}
+
+func TestIngestAllTwoPhaseFailure(t *testing.T) {
+	insertErr := errors.New("insert failed")
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		// The last record of the second worker
+		if isInsert(query) && slices.Contains(args, driver.Value("g4")) {
+			return nil, nil, insertErr
+		}
+		return nil, nil, nil
+	})
+
+	reader := csv.NewReader(strings.NewReader("g1,1\ng2,2\ng3,3\ng4,4\n"))
+	result, err := ingestAll(reader, db, twoPhaseConfig())
+	if !errors.Is(err, insertErr) {
+		t.Fatalf("got %v, want the error of the insert", err)
+	}
+	if result.Affected != 0 || result.Processed != 0 {
+		t.Errorf("got %d records processed and %d affected, want none", result.Processed, result.Affected)
+	}
+
+	prepared, committed, rolledBack := preparedIds(fake)
+	// The second worker prepares its first transaction before the insert of the second fails
+	if !slices.Contains(prepared, "pload_test_2_1") {
+		t.Errorf("got prepared %v, want pload_test_2_1 among them", prepared)
+	}
+	if slices.Contains(prepared, "pload_test_2_2") {
+		t.Errorf("got prepared %v, want the failed transaction left out", prepared)
+	}
+	if !slices.Equal(rolledBack, prepared) {
+		t.Errorf("got rolled back %v, want all of the prepared %v", rolledBack, prepared)
+	}
+	if len(committed) > 0 {
+		t.Errorf("got committed %v, want none", committed)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	settleErr := errors.New("no such transaction")
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.HasSuffix(query, "'t_2'") {
+			return nil, nil, settleErr
+		}
+		return nil, nil, nil
+	})
+
+	err := settle(db, []string{"t_1", "t_2", "t_3"}, true)
+	if !errors.Is(err, settleErr) {
+		t.Fatalf("got %v, want the error of the failed commit", err)
+	}
+	want := "Can't commit prepared 1 of 3 prepared transactions, settle t_2 by hand: no such transaction"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+
+	// It keeps going past the failure
+	_, committed, _ := preparedIds(fake)
+	if !slices.Equal(committed, []string{"t_1", "t_2", "t_3"}) {
+		t.Errorf("got committed %v, want all of them tried", committed)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Encodings of binary values
+const (
+	byteaHex    = "hex"
+	byteaBase64 = "base64"
+)
+
+// What -on-coerce-error does with a value -types can't convert
+const (
+	coerceFail   = "fail"
+	coerceNull   = "null"
+	coerceReject = "reject"
+)
+
+// coercion converts the values of a column into what is bound for the column's type.
+type coercion struct {
+	Column string
+	Index  int
+	Type   string
+	Coerce func(string) (interface{}, error)
+}
+
+// buildCoercions resolves the -types columns to field positions.
+func buildCoercions(config config) ([]coercion, error) {
+	var coercions []coercion
+
+	for _, t := range config.Types {
+		index := columnIndex(config.Columns, t.Column)
+		if index < 0 {
+			return nil, fmt.Errorf("Can't set the type of column '%s': it is not loaded", t.Column)
+		}
+
+		var coerce func(string) (interface{}, error)
+		switch strings.ToLower(t.Value) {
+		case "bytea":
+			switch config.ByteaEncoding {
+			case byteaHex:
+				coerce = decodeHex
+			case byteaBase64:
+				coerce = decodeBase64
+			default:
+				return nil, fmt.Errorf("Unsupported bytea encoding '%s'", config.ByteaEncoding)
+			}
+		case "smallint":
+			coerce = parseInt(16)
+		case "integer":
+			coerce = parseInt(32)
+		case "bigint":
+			coerce = parseInt(64)
+		default:
+			return nil, fmt.Errorf("Unsupported type '%s' of column '%s'", t.Value, t.Column)
+		}
+
+		coercions = append(coercions, coercion{t.Column, index, strings.ToLower(t.Value), coerce})
+	}
+
+	return coercions, nil
+}
+
+// coerce converts the values of a record bound to the row according to the column types.
+func coerce(row []interface{}, coercions []coercion) error {
+	for _, c := range coercions {
+		// NULLs are left as they are
+		value, ok := row[c.Index].(string)
+		if !ok {
+			continue
+		}
+
+		coerced, err := c.Coerce(value)
+		if err != nil {
+			return fmt.Errorf("Can't convert value of column '%s' to %s: %v", c.Column, c.Type, err)
+		}
+		row[c.Index] = coerced
+	}
+
+	return nil
+}
+
+// coercionError reports a value of a record that -types can't convert.
+type coercionError struct {
+	Column string
+	Type   string
+	Line   int
+	Err    error
+	// Position of the field in the record
+	index int
+}
+
+func (e *coercionError) Error() string {
+	return fmt.Sprintf("Can't convert value of column '%s' in the record on line %d to %s: %v", e.Column, e.Line, e.Type, e.Err)
+}
+
+func (e *coercionError) Unwrap() error {
+	return e.Err
+}
+
+// uncoercible tries the coercions on the values of the record ahead of binding it
+// and returns the errors of the values that fail to convert.
+func uncoercible(record inputRecord, coercions []coercion, nullEscape string) []*coercionError {
+	var errs []*coercionError
+	for _, c := range coercions {
+		value, ok := nullify(record.fields[c.Index], nullEscape).(string)
+		if !ok {
+			continue
+		}
+		if _, err := c.Coerce(value); err != nil {
+			errs = append(errs, &coercionError{c.Column, c.Type, record.line, err, c.Index})
+		}
+	}
+
+	return errs
+}
+
+// parseInt returns the conversion of integers that fit the given number of bits.
+func parseInt(bitSize int) func(string) (interface{}, error) {
+	return func(value string) (interface{}, error) {
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, bitSize)
+		if err != nil {
+			return nil, err.(*strconv.NumError).Err
+		}
+		return n, nil
+	}
+}
+
+// decodeHex decodes binary data in hex, with or without the \x prefix of the Postgres hex format.
+// lib/pq sends []byte as bytea.
+func decodeHex(value string) (interface{}, error) {
+	return hex.DecodeString(strings.TrimPrefix(value, `\x`))
+}
+
+func decodeBase64(value string) (interface{}, error) {
+	return base64.StdEncoding.DecodeString(value)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// updateSet builds the SET clause of -conflict update that overwrites every inserted
+// column but the conflict key with the value of the record, except for the
+// -json-merge-cols which are merged into the values in the table.
+func updateSet(config config, table string, columns []string) string {
+	// The row in the table goes by the name of the table without the schema
+	parts := tableNameParts(table)
+	target := parts[len(parts)-1]
+
+	var set []string
+	for _, column := range columns {
+		if strings.EqualFold(column, conflictKey) {
+			continue
+		}
+		value := "EXCLUDED." + column
+		// NULL on either side leaves the other side as it is instead of wiping it out
+		if columnIndex(config.JSONMerge, column) >= 0 {
+			value = fmt.Sprintf("COALESCE(%[1]s.%[2]s || EXCLUDED.%[2]s, EXCLUDED.%[2]s, %[1]s.%[2]s)", target, column)
+		}
+		set = append(set, fmt.Sprintf("%s = %s", column, value))
+	}
+
+	return strings.Join(set, ", ")
+}
+
+// checkJSONMerge makes sure the -json-merge-cols are jsonb columns of the table,
+// json has no || operator.
+func checkJSONMerge(db *sql.DB, config config) error {
+	types, err := describeColumnTypes(db, config.Table)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range config.JSONMerge {
+		if typ := types[strings.ToLower(column)]; typ != "jsonb" {
+			if typ == "" {
+				typ = "missing"
+			}
+			return fmt.Errorf("Can't merge column '%s' as JSON: it is %s in table '%s', not jsonb", column, typ, config.Table)
+		}
+	}
+
+	return nil
+}